@@ -1,10 +1,9 @@
 package main
 
 import (
-    "encoding/json"
     "flag"
     "fmt"
-    "io/ioutil"
+    "net/url"
     "os"
     "path/filepath"
     "strconv"
@@ -28,39 +27,88 @@ var Commit string
 const DefaultOutputFormat = "%(upload_date)s %(title)s (%(id)s)"
 
 var (
+    barStyle       download.BarStyle
+    benchmarkMode  bool
+    benchSegments  uint
+    breakerCool    time.Duration
+    breakerRate    float64
+    byteProgress   bool
+    caFile         string
+    compressSegs   bool
+    concatList     bool
     disableResume  bool
+    dryRunMode     bool
+    endSegment     uint
     flagSet        *flag.FlagSet
     failThreshold  uint
+    ffmpegPath     string
     forceIPv4      bool
     forceIPv6      bool
-    fregData       util.FregJson
+    fregData       = &util.FregJson {}
     fsync          bool
+    idleTimeout    time.Duration
     input          string
+    insecure       bool
     ipPoolFile     string
     keepFiles      bool
+    keepMerged     bool
+    live           bool
+    livePoll       time.Duration
+    localTime      bool
+    logAsync       bool
+    logCaller      bool
+    logFormat      string
     logLevel       string
+    logRelative    bool
+    logRepeat      int
+    logTimeFormat  string
+    maxConns       int
+    maxDuration    time.Duration
+    maxLost        uint
+    maxRedirects   int
+    maxReorder     uint
+    maxSegBytes    int64
+    mergeAhead     int
     mergeOnlyFile  string
+    mergeSegments  bool
     merger         string
     mergerArgs     = make(map[string]map[string]string)
+    minInterval    time.Duration
     network        = util.NetworkAny
+    noKeepAlives   bool
+    noMerge        bool
     onlyAudio      bool
     onlyVideo      bool
     output         string
     overwriteTemp  bool
     preferredAudio []int
     preferredVideo []int
+    progressBar    string
+    progressEvery  time.Duration
     queue          string
+    queryParams    = make(url.Values)
+    quiet          bool
+    rampUp         time.Duration
+    rangeResume    bool
     queueMode      segments.QueueMode
     requeueDelay   time.Duration
     requeueFailed  uint
     requeueLast    bool
+    resultFile     string
+    retryBudget    uint
     retryThreshold uint
     segmentCount   uint
+    skipDedup      bool
+    splitSegments  int
+    stallTimeout   time.Duration
     startSegment   uint
     tempDir        string
     threads        uint
     useQuic        bool
     verbose        bool
+    verifyBefore   bool
+    verifyMedia    bool
+    verifyMerged   string
     versionPrint   bool
     windowName     string
 )
@@ -85,10 +133,66 @@ Options:
         -6, --ipv6
             Force use of IPv6.
 
+        --benchmark
+                Measure the throughput and failure rate with several thread
+                counts (1, 2, 4, 8 and 16) and recommend one, then exit. Each
+                thread count downloads its own 'benchmark-segments' segments
+                of the video track (audio with '--only audio'), starting at
+                'start-segment'. Nothing is written to disk.
+
+        --benchmark-segments COUNT
+                Segments downloaded with each thread count by 'benchmark'.
+                Default is 20
+
+        --breaker-cooldown DURATION
+                How long all threads pause once the 'breaker-threshold'
+                failure rate is reached.
+                Default is 30s
+
+        --breaker-threshold RATE
+                Pause all threads for 'breaker-cooldown' once this fraction
+                (0 to 1, eg 0.5) of the segment attempts in the last 30
+                seconds failed, giving a throttling host some rest instead of
+                retrying blindly. 0 disables it.
+                Default is 0
+
+        --byte-progress
+                Base the progress percentage on the downloaded size instead of
+                the amount of segments. The total size is estimated once a few
+                segments are done.
+
+        --ca-file FILE
+                PEM file with the root certificates used to verify TLS
+                connections, instead of the system ones. Useful behind TLS
+                intercepting proxies.
+
+        --compress-segments
+                Gzip the segment files, to keep segments with less space, eg
+                together with 'keep-files'. Segments that don't get at least
+                5%% smaller, like most video, are stored as is. Merging
+                decompresses them, but they need to be decompressed (eg with
+                'gzip -dc') to be used otherwise. Can't be combined with
+                'concat-list'.
+
+        --concat-list
+                Also write FFmpeg concat demuxer lists of the segment files
+                next to the output (OUTPUT.audio.ffconcat and
+                OUTPUT.video.ffconcat), to mux them yourself later, eg with
+                ffmpeg -f concat -safe 0 -i OUTPUT.video.ffconcat. Lost segments
+                are listed as comments. Only written if the segments are kept,
+                which needs 'keep-files' unless the download-only merger is
+                used.
+
         --connect-retries AMOUNT
                 Amount of times to retry on connection failure.
                 Default is 3
 
+        --disable-keep-alives
+                Use a new connection for every request instead of reusing
+                them, for hosts or proxies that misbehave with reused
+                connections. Slower, as each request needs a new handshake.
+                Not used with QUIC.
+
         --disable-resume
                 Disables resume support. Fragment files will be deleted as
                 soon as they have been merged, instead of being deleted only
@@ -96,15 +200,46 @@ Options:
                 If both this option and 'keep-files' are passed, segments won't
                 be deleted at all.
 
+        --dry-run
+                Only check that the input works and show what would be
+                downloaded: the segment count, queue mode and estimated size,
+                from requesting the first and last segments. Nothing is written
+                to disk.
+
+        --end-segment NUMBER
+                Segment to stop at (exclusive), to only download part of a
+                stream together with 'start-segment'. 0 downloads until the
+                end of the stream.
+
+                Default is 0.
+
+        --ffmpeg-path PATH
+                Path of the FFmpeg binary to use for muxing. By default it's
+                looked up in PATH.
+
         --fsync
-                If enabled, fsync is called after writing data to segment files.
-                This forces the contents to be written to disk by the OS, which
-                is usually not required but might help avoid issues with remote
-                file systems.
+                If enabled, fsync is called after writing data to segment files,
+                merged files and the output. This forces the contents to be
+                written to disk by the OS, which is usually not required but
+                might help avoid issues with remote file systems or losing data
+                on a crash. Each sync waits for the disk, which is cheap on
+                SSDs but can slow down downloads with many threads noticeably
+                on spinning disks.
+
+        --idle-timeout DURATION
+                How long unused connections are kept open for reuse. Lower it
+                if idle connections get dropped by something in between. Valid
+                units are s, m, h. Not used with QUIC. 0 uses the default.
+
+                Default is 0 (90s).
 
         --input FILE
                 Input JSON file. Required.
 
+        --insecure
+                Disable TLS certificate verification. Only use this if you
+                know what you're doing.
+
         --ip-pool FILE
                 File containing IP addresses to use for downloading. Each
                 line should be either empty or contain an IP address.
@@ -115,10 +250,96 @@ Options:
         -k, --keep-files
                 Do not delete temporary files.
 
+        --keep-intermediate
+                Keep the merged audio and video files in the temporary
+                directory after muxing them into the output. They're deleted
+                by default, even with 'keep-files'.
+
+        --live
+                Record a stream that's still live. New segments are downloaded
+                as they become available, until the stream ends.
+
+        --live-poll-interval INTERVAL
+                How often to check for new segments in live mode. Valid units
+                are s, m, h.
+
+                Default is 10s.
+
+        --local-time
+                Show log timestamps in the local time zone instead of UTC.
+
+        --log-async
+                Write logs from a background goroutine, so downloads don't
+                wait on the terminal. Low priority messages may be dropped
+                if they're logged faster than they can be written.
+
+        --log-caller
+                Include the source file and line of each log message, for
+                all messages instead of only untagged ones.
+
+        --log-format FORMAT
+                Log format to use (text, json). The json format writes one
+                object per line, with progress updates as separate events.
+                Default is 'text'
+
         --log-level LEVEL
-                Log level to use (debug, info, warn, error, fatal).
+                Log level to use (debug, info, warn, error, fatal), or its
+                number from 0 (debug) to 4 (fatal).
                 Default is 'info'
 
+        --log-relative-paths
+                Show the source files of log messages relative to the source
+                root (eg download/download.go) instead of only their name, to
+                tell apart files with the same name in different packages.
+
+        --log-repeat-threshold N
+                Collapse runs of identical log messages, only showing the
+                first N followed by a 'last message repeated' line.
+                Default is 0 (disabled)
+
+        --log-time-format FORMAT
+                Format of log timestamps. Either 'full', 'short' (time of day
+                only), 'none' or a Go time layout (eg '2006-01-02T15:04:05').
+                Ignored by the json log format.
+                Default is 'full'
+
+        --max-connections AMOUNT
+                Maximum simultaneous connections per host, independent of the
+                thread count. Threads wait for a free connection when all are
+                in use. Not used with QUIC. 0 means no limit.
+                Default is 0
+
+        --max-duration DURATION
+                Stop downloading new segments after this long and merge what
+                was downloaded so far, with the rest reported as lost. Valid
+                units are s, m, h. 0 means no limit.
+
+        --max-lost-segments AMOUNT
+                Abort the download once more than AMOUNT segments have been
+                given up on, as the URL is most likely broken. Segments that
+                were downloaded are still merged. 0 means no limit.
+                Default is 0
+
+        --max-redirects AMOUNT
+                Maximum redirects followed by a request before it fails, to
+                stop redirect loops. Headers of the original request are kept
+                on redirects to other hosts. A negative value disables
+                redirects.
+                Default is 10
+
+        --max-reorder-window AMOUNT
+                Don't download segments more than AMOUNT segments ahead of the
+                next one to merge, so a slow segment can't leave many finished
+                ones waiting. Threads idle while waiting, so this can slow the
+                download down. 0 means no limit.
+                Default is 0
+
+        --max-segment-bytes BYTES
+                Treat segments bigger than BYTES as failed and retry them,
+                so a broken host streaming an endless response can't fill
+                the disk. 0 means no limit.
+                Default is 0
+
         --merge DOWNLOAD_INFO_JSON
                 Merges a download created with the download-only merger
                 (see below) into a video file.
@@ -126,6 +347,20 @@ Options:
                 Most merger related options (such as --merger, -k, -o, --temp-dir)
                 still apply.
 
+        --merge-read-ahead COUNT
+                Read up to COUNT of the next downloaded segments into memory
+                in the background while merging the current one, so reading
+                and writing overlap. Speeds up merging on fast storage, at the
+                cost of COUNT segments of memory per track. Only used by the
+                concat and tcp mergers. 0 reads one segment at a time.
+
+                Default is 0
+
+        --merge-segments
+                Skips downloading and only merges the segments already in the
+                temporary directory, eg from an interrupted run. Requires
+                --temp-dir. Missing segments are reported as lost.
+
         --merger NAME
                 Selects which merger should be used. Currently implemented
                 mergers are 'tcp', 'concat' and 'download-only'.
@@ -149,6 +384,20 @@ Options:
 
                 See examples below for an example.
 
+        --min-request-interval DURATION
+                Minimum time between two segment requests of a thread, which
+                limits the request rate to about THREAD_COUNT requests per
+                DURATION. Gentler on hosts that ban fast clients than lowering
+                the thread count. 0 means no limit.
+                Default is 0
+
+        --no-merge
+                Only download the segments and leave them in the temp dir,
+                named with zero padded numbers so they sort in order, without
+                merging them. Unlike the download-only merger, no output file
+                is written. The temp dir is kept even if it wasn't given with
+                'temp-dir'.
+
         --only WHICH
                 Downloads only audio or only video.
 
@@ -177,8 +426,30 @@ Options:
                 are available, the program will error instead of picking the best
                 quality.
 
+        --progress-bar STYLE
+                Draw a bar in front of the download progress percentage: none,
+                ascii or unicode. Use ascii if block characters show up wrong
+                in your terminal.
+
+                Default is none.
+
+        --progress-interval INTERVAL
+                Redraw the progress at most once per interval, showing the
+                latest state at the end of each one. Lowers the logging
+                overhead and flicker with many threads. Valid units are ms, s,
+                m. 0 redraws on every finished segment.
+
+                Default is 0.
+
+        --query-param KEY=VALUE
+                Adds a query parameter to every segment URL, replacing the one
+                with the same key the URLs already have. Can be used multiple
+                times to add several parameters, using the same key again
+                gives it multiple values. The sq parameter can't be changed.
+
         -q, --queue-mode MODE
-                Order to download segments (sequential, out-of-order).
+                Order to download segments (sequential, out-of-order,
+                earliest-first, auto).
 
                 Sequential mode assigns the segments sequentially to the threads.
 
@@ -186,8 +457,33 @@ Options:
                 thread that finishes it's work helping the others until all segments
                 are done.
 
+                Earliest first mode always downloads the lowest numbered segment
+                available, retrying failed segments as soon as their requeue delay
+                is up instead of at the end. This allows the start of the output
+                to be merged early, but spreads requests over less of the stream
+                than out of order mode.
+
+                Auto mode uses sequential mode with a single thread or when there
+                are less than 4 segments per thread, and out of order mode otherwise.
+
                 Default is 'out-of-order'
 
+        --quiet
+                Only log warnings and errors and don't show progress, but still
+                print a one line summary of the result at the end.
+
+        --ramp-up DURATION
+                Start the download threads gradually over this long instead of
+                all at once, to avoid a burst of requests that can trigger rate
+                limits. Valid units are s, m, h. 0 starts them all at once.
+
+        --range-resume
+                If the connection breaks while downloading a segment, request
+                only the rest of it instead of starting over. Saves bandwidth on
+                large segments with flaky connections. Assumes the server
+                supports range requests, segments are downloaded again from
+                the start when it doesn't.
+
         --requeue-delay DELAY
                 Minimum amount of time to wait before redownloading a segment
                 once it's been requeued. Valid delay units are s, m, h.
@@ -205,7 +501,23 @@ Options:
         --requeue-last
                 If used, the last segment is allowed to be requeued, otherwise
                 it'll be failed instantly.
+
+        --result-file PATH
+                Once the downloads finish, write their results as JSON to
+                PATH.audio.json and PATH.video.json, for use by scripts: the
+                total, lost, failed and unattempted segments, the lost ranges
+                (inclusive), the downloaded bytes, the elapsed time and whether
+                the download succeeded. The files are replaced atomically and
+                have a "version" field, bumped on incompatible changes.
         
+        --retry-budget AMOUNT
+                Stop downloading once this many attempts at segments failed in
+                total, across all segments, keeping what was downloaded and
+                reporting the rest as lost. Caps the time wasted on a broken
+                URL, unlike 'retries' which is per segment. 0 means no limit.
+
+                Default is 0.
+
         --retries AMOUNT
                 Amount of times to retry downloading segments on failure.
                 Failure includes error responses from youtube and connection
@@ -213,8 +525,31 @@ Options:
 
                 Default is 20.
 
+        --skip-init-dedup
+                Merge the segments as they are. By default, MP4 init segments
+                (ftyp and moov boxes) repeating the previous segment's are
+                left out of the merged files, as they're only valid once at
+                the start. Use it for streams whose segments have no init
+                segment, to skip checking for one. Only used by the concat and
+                tcp mergers.
+
+        --split-segments COUNT
+                Split the output into parts of COUNT segments each, named
+                OUTPUT.part001.mkv, OUTPUT.part002.mkv and so on. Parts start
+                at segment boundaries, so each can be played on its own.
+                Requires the concat merger.
+
+        --stall-timeout DURATION
+                Warn when no segment was downloaded for DURATION while threads
+                are trying to, most often because the URL expired, and again
+                each time DURATION passes without progress. 0 disables the
+                warning.
+
+                Default is 5m.
+
         --start-segment NUMBER
-                Starting segment for the download, to clip parts of a stream.
+                Starting segment for the download (inclusive), to clip parts
+                of a stream.
 
                 Default is 0.
 
@@ -231,6 +566,11 @@ Options:
                 files used. Will be created if it doesn't exist. If not specified,
                 a random temporary directory will be created.
 
+                Segments are downloaded directly into it, and merged files
+                are written to it too, only FFmpeg writes to the output
+                directory. Nothing is moved between the two, so they can be
+                on different drives, but both need room for the full video.
+
         -t, --threads THREAD_COUNT
                 Number of threads to use for downloads. The number of used
                 threads will be THREAD_COUNT for audio and THREAD_COUNT for video.
@@ -243,12 +583,30 @@ Options:
         --use-quic=QUIC
                 Whether or not HTTP/3 should be used. Only disable this if some
                 middle box (firewall, etc) is interfering with HTTP/3 downloads.
+                Downloads switch to HTTP/2 on their own if the QUIC handshake
+                fails, eg when UDP is blocked. Builds with the 'noquic' tag
+                always use HTTP/2.
 
                 Default is 'true'
 
         -v, --verbose
                 Sets log level to 'debug' if present. Overrides the 'log-level' flag.
 
+        --verify-before-merge
+                Once all segments are downloaded, check every segment file
+                again before merging and download the bad ones again. Merging
+                only starts at the end, so 'max-reorder-window' is ignored.
+
+        --verify-media
+                Check that downloaded segments look like media files and retry
+                them otherwise, instead of merging eg an error page served by
+                a throttling host.
+
+        --verify-merged FILE
+                Count the segments in a merged file kept by the concat merger
+                (see 'keep-files') and exit, without downloading anything. With
+                'segment-count', fails if fewer segments are found.
+
         -V, --version
                 Print the version and exit.
 
@@ -285,7 +643,7 @@ FORMAT TEMPLATE OPTIONS
         youtube-dl. See https://github.com/ytdl-org/youtube-dl#output-template
 
         For file names, each template substitution is sanitized by replacing invalid file name
-        characters with underscore (_).
+        characters (on any OS) and control characters with underscore (_).
 
         description (string): Video description
         id (string): Video identifier
@@ -294,12 +652,17 @@ FORMAT TEMPLATE OPTIONS
         channel (string): Full name of the channel the livestream is on
         channel_id (string): ID of the channel
         channel_url (string): URL of the channel
+        date (string: YYYYMMDD): Same as upload_date
+        height (number): Height of the downloaded video format, eg 1080
+        itag (number): Itag of the downloaded video format
         publish_date (string: YYYYMMDD): Stream publish date, UTC timezone
         start_date (string: YYYYMMDD): Stream start date, UTC timezone
         upload_date (string: YYYYMMDD): Stream start date, UTC timezone
         start_timestamp (string: RFC3339 timestamp): Stream start date
 
         The description, url and channel_url fields are substitured by nothing for file names.
+        Numbers can be used with %%(key)d too. Values that aren't known, such as height for
+        an unknown format, are substituted by NA.
 `, self, DefaultOutputFormat)
 }
 
@@ -327,26 +690,94 @@ func init() {
     flagSet.BoolVar(&forceIPv6, "6", false, "Force use of IPv6.")
     flagSet.BoolVar(&forceIPv6, "ipv6", false, "Force use of IPv6.")
 
+    flagSet.BoolVar(&benchmarkMode, "benchmark", false, "Measure the throughput with several thread counts, then exit.")
+
+    flagSet.UintVar(&benchSegments, "benchmark-segments", download.DefaultBenchmarkSegments, "Segments downloaded per thread count by --benchmark.")
+
+    flagSet.DurationVar(&breakerCool, "breaker-cooldown", download.DefaultBreakerCooldown, "How long threads pause once the breaker opens.")
+
+    flagSet.Float64Var(&breakerRate, "breaker-threshold", 0, "Failure rate that pauses all threads.")
+
+    flagSet.BoolVar(&byteProgress, "byte-progress", false, "Base progress on the downloaded size.")
+
+    flagSet.StringVar(&caFile, "ca-file", "", "PEM file with root certificates to use.")
+
+    flagSet.BoolVar(&compressSegs, "compress-segments", false, "Gzip the segment files.")
+
+    flagSet.BoolVar(&concatList, "concat-list", false, "Write FFmpeg concat lists of the segment files.")
+
     flagSet.UintVar(&retryThreshold, "connect-retries", download.DefaultRetryThreshold, "Amount of times to retry a request on connection failure.")
 
+    flagSet.BoolVar(&noKeepAlives, "disable-keep-alives", false, "Don't reuse connections.")
+
     flagSet.BoolVar(&disableResume, "disable-resume", false, "Disable resume support.")
 
+    flagSet.BoolVar(&dryRunMode, "dry-run", false, "Only show what would be downloaded.")
+
+    flagSet.UintVar(&endSegment, "end-segment", 0, "Segment to stop at (exclusive).")
+
+    flagSet.StringVar(&ffmpegPath, "ffmpeg-path", "", "Path of the FFmpeg binary.")
+
     flagSet.BoolVar(&fsync, "fsync", false, "Force flushing of OS buffers after writing segment files.")
 
+    flagSet.DurationVar(&idleTimeout, "idle-timeout", 0, "How long idle connections are kept open.")
+
     flagSet.StringVar(&input, "i",     "", "Input JSON file.")
     flagSet.StringVar(&input, "input", "", "Input JSON file.")
 
+    flagSet.BoolVar(&insecure, "insecure", false, "Disable TLS certificate verification.")
+
     flagSet.StringVar(&ipPoolFile, "ip-pool", "", "IP addresses to use.")
 
     flagSet.BoolVar(&keepFiles, "k",          false, "Do not delete temporary files.")
     flagSet.BoolVar(&keepFiles, "keep-files", false, "Do not delete temporary files.")
 
+    flagSet.BoolVar(&keepMerged, "keep-intermediate", false, "Keep the merged audio and video files after muxing.")
+
+    flagSet.BoolVar(&live, "live", false, "Record a stream that's still live.")
+
+    flagSet.DurationVar(&livePoll, "live-poll-interval", download.DefaultLivePollInterval, "How often to check for new segments in live mode.")
+
+    flagSet.BoolVar(&localTime, "local-time", false, "Show log timestamps in the local time zone.")
+
+    flagSet.BoolVar(&logAsync, "log-async", false, "Write logs from a background goroutine.")
+
+    flagSet.BoolVar(&logCaller, "log-caller", false, "Include the source location of all log messages.")
+
+    flagSet.StringVar(&logFormat, "log-format", "text", "Log format to use (text, json).")
+
     flagSet.StringVar(&logLevel, "log-level", "info", "Log level to use (debug, info, warn, error, fatal).")
 
+    flagSet.BoolVar(&logRelative, "log-relative-paths", false, "Show source files relative to the source root.")
+
+    flagSet.IntVar(&logRepeat, "log-repeat-threshold", 0, "Collapse runs of identical log messages after this many.")
+
+    flagSet.StringVar(&logTimeFormat, "log-time-format", "full", "Format of log timestamps.")
+
+    flagSet.IntVar(&maxConns, "max-connections", 0, "Maximum simultaneous connections per host.")
+
+    flagSet.DurationVar(&maxDuration, "max-duration", 0, "Stop downloading after this long.")
+
+    flagSet.UintVar(&maxLost, "max-lost-segments", 0, "Abort after losing more than this many segments.")
+
+    flagSet.IntVar(&maxRedirects, "max-redirects", 10, "Maximum redirects followed by a request.")
+
+    flagSet.UintVar(&maxReorder, "max-reorder-window", 0, "Maximum segments downloaded ahead of merging.")
+
+    flagSet.Int64Var(&maxSegBytes, "max-segment-bytes", 0, "Maximum size of a segment, bigger ones are retried.")
+
     flagSet.StringVar(&mergeOnlyFile, "merge", "", "Merges a file generated by the download-only merger.")
 
+    flagSet.IntVar(&mergeAhead, "merge-read-ahead", 0, "Segments to read ahead while merging.")
+
+    flagSet.BoolVar(&mergeSegments, "merge-segments", false, "Only merge segments already in the temp dir.")
+
     flagSet.StringVar(&merger, "merger", "", "Which merger to use.")
 
+    flagSet.DurationVar(&minInterval, "min-request-interval", 0, "Minimum time between requests of a thread.")
+
+    flagSet.BoolVar(&noMerge, "no-merge", false, "Only download the segments, without merging them.")
+
     flagSet.Func("only", "Choose to download only audio or video.", func(s string) error {
         switch s {
         case "audio":
@@ -389,8 +820,30 @@ func init() {
         return nil
     })
 
-    flagSet.StringVar(&queue, "q",          "out-of-order", "Order to download segments (sequential, out-of-order).")
-    flagSet.StringVar(&queue, "queue-mode", "out-of-order", "Order to download segments (sequential, out-of-order).")
+    flagSet.StringVar(&progressBar, "progress-bar", "none", "Progress bar style (none, ascii, unicode).")
+
+    flagSet.DurationVar(&progressEvery, "progress-interval", 0, "Redraw the progress at most once per interval.")
+
+    flagSet.Func("query-param", "Add a query parameter to every segment URL.", func(s string) error {
+        kv := strings.SplitN(s, "=", 2)
+        if len(kv) < 2 || kv[0] == "" {
+            return fmt.Errorf("Invalid query parameter '%s', format is KEY=VALUE", s)
+        }
+        if kv[0] == "sq" {
+            return fmt.Errorf("The sq query parameter can't be changed")
+        }
+        queryParams.Add(kv[0], kv[1])
+        return nil
+    })
+
+    flagSet.StringVar(&queue, "q",          "out-of-order", "Order to download segments (sequential, out-of-order, earliest-first, auto).")
+    flagSet.StringVar(&queue, "queue-mode", "out-of-order", "Order to download segments (sequential, out-of-order, earliest-first, auto).")
+
+    flagSet.BoolVar(&quiet, "quiet", false, "Only log warnings and errors, with a summary at the end.")
+
+    flagSet.DurationVar(&rampUp, "ramp-up", 0, "Spread the start of the threads over this long.")
+
+    flagSet.BoolVar(&rangeResume, "range-resume", false, "Resume interrupted segments with range requests.")
 
     flagSet.DurationVar(&requeueDelay, "requeue-delay", 2 * time.Minute, "How long to wait before retrying a requeued segment.")
 
@@ -398,10 +851,20 @@ func init() {
 
     flagSet.BoolVar(&requeueLast, "requeue-last", false, "Whether or not the last segment should be requeued.")
 
+    flagSet.StringVar(&resultFile, "result-file", "", "Write the download results as JSON to PATH.audio.json and PATH.video.json.")
+
+    flagSet.UintVar(&retryBudget, "retry-budget", 0, "Stop after this many failed attempts in total.")
+
     flagSet.UintVar(&failThreshold, "retries", download.DefaultFailThreshold, "Amount of times to retry downloading segments on failure.")
 
     flagSet.UintVar(&segmentCount, "segment-count", 0, "How many segments to download.")
 
+    flagSet.BoolVar(&skipDedup, "skip-init-dedup", false, "Merge segments without leaving out repeated init segments.")
+
+    flagSet.IntVar(&splitSegments, "split-segments", 0, "Split the output into parts of this many segments.")
+
+    flagSet.DurationVar(&stallTimeout, "stall-timeout", 5 * time.Minute, "Warn when no segment was downloaded for this long.")
+
     flagSet.UintVar(&startSegment, "start-segment", 0, "Starting segment.")
 
     flagSet.StringVar(&tempDir, "temp-dir", "", "Directory to store temporary files. A randomly-named one will be created if empty.")
@@ -414,6 +877,12 @@ func init() {
     flagSet.BoolVar(&verbose, "v",       false, "Enable debug logging. Overrides log-level.")
     flagSet.BoolVar(&verbose, "verbose", false, "Enable debug logging. Overrides log-level.")
 
+    flagSet.BoolVar(&verifyBefore, "verify-before-merge", false, "Check segment files again before merging.")
+
+    flagSet.BoolVar(&verifyMedia, "verify-media", false, "Check that segments look like media files.")
+
+    flagSet.StringVar(&verifyMerged, "verify-merged", "", "Count the segments in a merged file and exit.")
+
     flagSet.BoolVar(&versionPrint, "V",       false, "Print version and exit")
     flagSet.BoolVar(&versionPrint, "version", false, "Print version and exit")
 
@@ -462,16 +931,66 @@ func parseArgs() {
         os.Exit(1)
     }
     log.SetDefaultLevel(level)
+    log.SetQuiet(quiet)
+
+    if localTime {
+        log.SetLocalTime()
+    }
+    log.SetShowCaller(logCaller)
+    log.SetRelativePaths(logRelative)
+    log.SetRepeatThreshold(logRepeat)
+    if logAsync {
+        log.SetAsync(log.DefaultAsyncQueueSize)
+    }
+
+    switch logTimeFormat {
+    case "full":
+        log.SetTimeFormat(log.TimeFull)
+    case "short":
+        log.SetTimeFormat(log.TimeShort)
+    case "none":
+        log.SetTimeFormat(log.TimeNone)
+    default:
+        log.SetTimeFormat(logTimeFormat)
+    }
+
+    switch strings.ToLower(logFormat) {
+    case "text":
+        log.SetFormat(log.FormatText)
+    case "json":
+        log.SetFormat(log.FormatJSON)
+    default:
+        log.Fatalf("Invalid log format '%s'", logFormat)
+    }
+
+    switch strings.ToLower(progressBar) {
+    case "none":
+        barStyle = download.NoBar
+    case "ascii":
+        barStyle = download.ASCIIBar
+    case "unicode":
+        barStyle = download.UnicodeBar
+    default:
+        log.Fatalf("Invalid progress bar style '%s'", progressBar)
+    }
 
     switch strings.ToLower(queue) {
     case "sequential":
         queueMode = segments.QueueSequential
     case "out-of-order":
         queueMode = segments.QueueOutOfOrder
+    case "earliest-first":
+        queueMode = segments.QueueEarliestFirst
+    case "auto":
+        queueMode = segments.QueueAuto
     default:
         log.Fatalf("Invalid queue mode '%s'", queue)
     }
 
+    if breakerRate < 0 || breakerRate > 1 {
+        log.Fatalf("Invalid breaker threshold %v, must be between 0 and 1", breakerRate)
+    }
+
     if forceIPv4 && forceIPv6 {
         log.Fatalf("--ipv4 and --ipv6 options cannot be combined")
     } else if forceIPv4 {
@@ -480,22 +999,46 @@ func parseArgs() {
         network = util.NetworkIPv6
     }
 
-    if input == "" && mergeOnlyFile == "" {
+    if maxSegBytes < 0 {
+        log.Fatalf("--max-segment-bytes must not be negative")
+    }
+    if mergeAhead < 0 {
+        log.Fatalf("--merge-read-ahead must not be negative")
+    }
+
+    if mergeSegments && tempDir == "" {
+        log.Fatalf("--merge-segments requires --temp-dir")
+    }
+
+    if compressSegs && concatList {
+        log.Fatalf("--compress-segments cannot be combined with --concat-list")
+    }
+
+    if noMerge && (mergeSegments || mergeOnlyFile != "") {
+        log.Fatalf("--no-merge cannot be combined with --merge or --merge-segments")
+    }
+
+    if dryRunMode && input == "" {
+        log.Fatalf("--dry-run requires --input")
+    }
+
+    if benchmarkMode && input == "" {
+        log.Fatalf("--benchmark requires --input")
+    }
+
+    if input == "" && mergeOnlyFile == "" && verifyMerged == "" {
         log.Fatalf("No input file specified")
     }
 
     //can't parse the mergeOnlyFile struct here because of cyclic dependencies,
     //so only handle the regular info json
     if input != "" {
-        inputData, err := ioutil.ReadFile(input)
-        if err != nil {
-            log.Fatalf("Unable to read file '%s': %v", input, err)
-        }
-
-        if err = json.Unmarshal(inputData, &fregData); err != nil {
-            log.Fatalf("Unable to parse freg json: %v", err)
+        var err error
+        if fregData, err = util.LoadFregJson(input); err != nil {
+            log.Fatalf("Unable to load freg json: %v", err)
         }
 
+        fregData.PreferVideo(preferredVideo)
         output, err = fregData.FormatTemplate(output, true)
         if err != nil {
             log.Fatalf("Invalid output template: %v", err)
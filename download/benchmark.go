@@ -0,0 +1,220 @@
+package download
+
+import (
+    "fmt"
+    "os"
+    "time"
+
+    "github.com/HoloArchivists/ytarchive-raw-go/download/segments"
+    "github.com/HoloArchivists/ytarchive-raw-go/log"
+    "github.com/HoloArchivists/ytarchive-raw-go/util"
+)
+
+// thread counts tried by Benchmark if BenchmarkOptions.Levels is empty
+var DefaultBenchmarkLevels = []uint { 1, 2, 4, 8, 16 }
+
+// segments downloaded per thread count if BenchmarkOptions.Segments is 0
+const DefaultBenchmarkSegments = 20
+
+// highest failed attempt rate a thread count can have to be recommended.
+// higher thread counts aren't tried once a level goes over it, as more
+// requests only make throttling worse.
+const benchmarkMaxErrorRate = 0.05
+
+// a thread count is recommended once it gets this fraction of the best
+// throughput, as more threads for a few percent more speed only make
+// throttling more likely
+const benchmarkGoodEnough = 0.9
+
+type BenchmarkOptions struct {
+    // makes the requests, defaults to a client with the default config
+    Client       *util.HttpClient
+    // thread counts to try, in order. defaults to DefaultBenchmarkLevels.
+    Levels       []uint
+    Logger       *log.Logger
+    // segments downloaded with each thread count, defaults to
+    // DefaultBenchmarkSegments
+    Segments     uint
+    // called with the task of each thread count before it's started, to
+    // change the download settings, eg Progress or RetryDelay. Threads,
+    // StartSegment, EndSegment, Store and Merger are overwritten.
+    Setup        func(task *DownloadTask)
+    // each thread count downloads its own Segments segments, one range
+    // after the other starting here, so the later ones don't get segments
+    // cached by the earlier ones. the stream needs len(Levels) * Segments
+    // segments from there.
+    StartSegment uint
+    Url          string
+}
+
+type BenchmarkLevel struct {
+    Threads        uint
+    // bytes downloaded, over Elapsed
+    Bytes          int64
+    Downloaded     int
+    Elapsed        time.Duration
+    // why the download of this level failed completely, if it did
+    Error          error
+    FailedAttempts uint
+    Lost           int
+}
+
+// Bytes downloaded per second.
+func (l *BenchmarkLevel) Throughput() float64 {
+    if l.Elapsed <= 0 {
+        return 0
+    }
+    return float64(l.Bytes) / l.Elapsed.Seconds()
+}
+
+// Fraction of the segment attempts that failed, between 0 and 1.
+func (l *BenchmarkLevel) ErrorRate() float64 {
+    attempts := uint(l.Downloaded) + l.FailedAttempts
+    if attempts == 0 {
+        return 0
+    }
+    return float64(l.FailedAttempts) / float64(attempts)
+}
+
+func (l *BenchmarkLevel) String() string {
+    if l.Error != nil {
+        return fmt.Sprintf("%d thread(s): failed: %v", l.Threads, l.Error)
+    }
+    return fmt.Sprintf(
+        "%d thread(s): %.2f MiB/s, %.1f%% failed attempts, %d lost segment(s)",
+        l.Threads,
+        l.Throughput() / (1 << 20),
+        l.ErrorRate() * 100,
+        l.Lost,
+    )
+}
+
+type BenchmarkResult struct {
+    // the thread counts tried, in order
+    Levels      []BenchmarkLevel
+    // the lowest thread count with an acceptable error rate that reached
+    // close to the best throughput. the lowest thread count tried if none
+    // had an acceptable error rate.
+    Recommended uint
+}
+
+// Downloads a small sample of segments with each thread count of
+// opts.Levels, measuring the throughput and error rate of each, to help
+// picking DownloadTask.Threads. Nothing is written to disk or merged.
+func Benchmark(opts *BenchmarkOptions) (*BenchmarkResult, error) {
+    levels := opts.Levels
+    if len(levels) == 0 {
+        levels = DefaultBenchmarkLevels
+    }
+    sample := opts.Segments
+    if sample == 0 {
+        sample = DefaultBenchmarkSegments
+    }
+    logger := opts.Logger
+    if logger == nil {
+        logger = log.New("benchmark")
+    }
+    client := opts.Client
+    if client == nil {
+        client = util.NewClient(&util.HttpClientConfig {})
+        defer client.Close()
+    }
+
+    res := &BenchmarkResult {}
+    for i, threads := range levels {
+        start := opts.StartSegment + uint(i) * sample
+        logger.Infof("Downloading segments %d to %d with %d thread(s)", start, start + sample - 1, threads)
+        task := &DownloadTask {
+            Client: client,
+            Logger: logger,
+            Url:    opts.Url,
+        }
+        if opts.Setup != nil {
+            opts.Setup(task)
+        }
+        task.Threads = threads
+        task.StartSegment = start
+        task.EndSegment = start + sample
+        task.Store = discardStore {}
+        task.Merger = discardMerger {}
+        task.NoMerge = false
+        //required, but nothing is written there
+        task.SegmentDir = os.TempDir()
+        if task.Progress == nil {
+            task.Progress = NewProgress().Video()
+        }
+
+        task.Start()
+        r := task.Wait()
+        task.Close()
+        level := BenchmarkLevel {
+            Threads:        threads,
+            Bytes:          r.TotalBytes,
+            Downloaded:     r.TotalSegments - len(r.LostSegments),
+            Elapsed:        r.Elapsed,
+            FailedAttempts: r.FailedAttempts,
+            Lost:           len(r.LostSegments),
+        }
+        if r.Failed() {
+            level.Error = r.Error
+        }
+        res.Levels = append(res.Levels, level)
+        logger.Info(level.String())
+
+        if level.Error != nil {
+            if i == 0 {
+                return res, fmt.Errorf("Benchmark failed: %w", level.Error)
+            }
+            break
+        }
+        if level.ErrorRate() > benchmarkMaxErrorRate {
+            logger.Infof("Error rate over %.0f%%, not trying more threads", benchmarkMaxErrorRate * 100)
+            break
+        }
+    }
+
+    var best float64
+    for i := range res.Levels {
+        l := &res.Levels[i]
+        if l.Error == nil && l.ErrorRate() <= benchmarkMaxErrorRate && l.Throughput() > best {
+            best = l.Throughput()
+        }
+    }
+    res.Recommended = levels[0]
+    for i := range res.Levels {
+        l := &res.Levels[i]
+        if l.Error == nil && l.ErrorRate() <= benchmarkMaxErrorRate && l.Throughput() >= best * benchmarkGoodEnough {
+            res.Recommended = l.Threads
+            break
+        }
+    }
+    return res, nil
+}
+
+// drops the segments, for Benchmark
+type discardStore struct {}
+
+func (discardStore) Existing(segment int) (string, int64, bool) {
+    return "", 0, false
+}
+
+func (discardStore) Create(segment int) (SegmentWriter, error) {
+    return discardWriter {}, nil
+}
+
+type discardWriter struct {}
+
+func (discardWriter) Write(p []byte) (int, error) {
+    return len(p), nil
+}
+
+func (discardWriter) Commit(fsync bool) (string, error) {
+    return "", nil
+}
+
+func (discardWriter) Abort() {}
+
+// merges nothing, the segments of Benchmark aren't kept
+type discardMerger struct {}
+
+func (discardMerger) Merge(*segments.SegmentStatus) {}
@@ -0,0 +1,120 @@
+package download
+
+import (
+    "sync"
+    "time"
+)
+
+// failure rate is measured over the attempts made in this window
+const breakerWindow = 30 * time.Second
+
+// attempts needed in the window before the breaker can open, so a few
+// failures right at the start don't pause everything
+const breakerMinAttempts = 10
+
+const DefaultBreakerCooldown = 30 * time.Second
+
+type breakerAttempt struct {
+    at time.Time
+    ok bool
+}
+
+// pauses all threads of a task for a cool-down once too many of the recent
+// segment attempts failed, see DownloadTask.BreakerThreshold
+type circuitBreaker struct {
+    mu        sync.Mutex
+    attempts  []breakerAttempt
+    openUntil time.Time
+    open      bool
+}
+
+func (d *DownloadTask) breakerCooldown() time.Duration {
+    if d.BreakerCooldown <= 0 {
+        return DefaultBreakerCooldown
+    }
+    return d.BreakerCooldown
+}
+
+// records the outcome of a segment attempt, opening the breaker if the
+// failure rate went over BreakerThreshold
+func (d *DownloadTask) breakerRecord(ok bool) {
+    if d.BreakerThreshold <= 0 {
+        return
+    }
+    b := &d.breaker
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    now := time.Now()
+    if b.open {
+        //requests finishing after it opened don't count towards the next one
+        return
+    }
+    b.attempts = append(b.attempts, breakerAttempt { at: now, ok: ok })
+    start := 0
+    for start < len(b.attempts) && now.Sub(b.attempts[start].at) > breakerWindow {
+        start++
+    }
+    b.attempts = b.attempts[start:]
+    if ok || len(b.attempts) < breakerMinAttempts {
+        return
+    }
+    failed := 0
+    for _, a := range b.attempts {
+        if !a.ok {
+            failed++
+        }
+    }
+    rate := float64(failed) / float64(len(b.attempts))
+    if rate < d.BreakerThreshold {
+        return
+    }
+
+    cooldown := d.breakerCooldown()
+    d.logger().Warnf(
+        "%.0f%% of the last %d attempts failed, pausing requests for %v",
+        rate * 100,
+        len(b.attempts),
+        cooldown,
+    )
+    b.open = true
+    b.openUntil = now.Add(cooldown)
+    b.attempts = nil
+}
+
+func (d *DownloadTask) breakerOpen() bool {
+    d.breaker.mu.Lock()
+    defer d.breaker.mu.Unlock()
+    return d.breaker.open
+}
+
+// blocks while the breaker is open. returns false if stop is closed first.
+func (d *DownloadTask) breakerWait(stop <-chan struct{}) bool {
+    if d.BreakerThreshold <= 0 {
+        return true
+    }
+    b := &d.breaker
+    b.mu.Lock()
+    if !b.open {
+        b.mu.Unlock()
+        return true
+    }
+    wait := time.Until(b.openUntil)
+    b.mu.Unlock()
+
+    if wait > 0 {
+        select {
+        case <-time.After(wait):
+        case <-stop:
+            return false
+        }
+    }
+
+    b.mu.Lock()
+    if b.open && !time.Now().Before(b.openUntil) {
+        b.open = false
+        d.logger().Warn("Cool-down over, resuming requests")
+    }
+    b.mu.Unlock()
+    return true
+}
@@ -0,0 +1,71 @@
+package download
+
+import (
+    "bufio"
+    "bytes"
+    "compress/gzip"
+    "fmt"
+    "io"
+    "os"
+
+    "github.com/HoloArchivists/ytarchive-raw-go/util"
+)
+
+// records what the first segment starts with, from its first
+// util.MediaSniffLen bytes
+func (d *DownloadTask) checkFirstSegment(head []byte) {
+    d.resultMu.Lock()
+    defer d.resultMu.Unlock()
+    d.result.FirstContainer = util.SniffMedia(head)
+    d.result.FirstHasInit = util.StartsWithInit(head)
+    d.result.firstChecked = true
+}
+
+// same as checkFirstSegment, for a segment downloaded by a previous run.
+// left unchecked if the file can't be read.
+func (d *DownloadTask) checkFirstSegmentFile(filename string) {
+    f, err := os.Open(filename)
+    if err != nil {
+        return
+    }
+    defer f.Close()
+    var r io.Reader = bufio.NewReader(f)
+    //segments kept with CompressSegments are gzipped
+    if magic, _ := r.(*bufio.Reader).Peek(2); bytes.Equal(magic, []byte { 0x1f, 0x8b }) {
+        if r, err = gzip.NewReader(r); err != nil {
+            return
+        }
+    }
+    head := make([]byte, util.MediaSniffLen)
+    n, _ := io.ReadFull(r, head)
+    d.checkFirstSegment(head[:n])
+}
+
+// Whether the output is expected to play from start to end, with the
+// reason if it isn't. Stricter than Success: segments must be contiguous
+// from the first one, which must start with the init segment the player
+// needs (only checked if the first segment was downloaded or reused by the
+// download, not with MergeOnly). Meaningless with DryRun.
+func (r *DownloadResult) Complete() (bool, string) {
+    if r.Failed() {
+        return false, fmt.Sprintf("Download failed: %v", r.Error)
+    }
+    if r.TotalSegments == 0 {
+        return false, "No segments"
+    }
+    if len(r.LostRanges) > 0 {
+        if r.LostRanges[0].Start == 0 {
+            return false, fmt.Sprintf("First segment is missing, lost segments %v", r.LostRanges)
+        }
+        return false, fmt.Sprintf("%d segment(s) missing in %d gap(s): %v", len(r.LostSegments), len(r.LostRanges), r.LostRanges)
+    }
+    if r.firstChecked {
+        if r.FirstContainer == util.ContainerUnknown {
+            return false, "First segment isn't MP4 or WebM media"
+        }
+        if !r.FirstHasInit {
+            return false, "First segment doesn't start with an init segment"
+        }
+    }
+    return true, ""
+}
@@ -0,0 +1,78 @@
+package download
+
+import (
+    "bytes"
+    "compress/gzip"
+)
+
+// compressed segments are only kept if they're at least this much smaller,
+// already compressed media is stored as is
+const compressMinSavings = 0.05
+
+// gzips the segments of the wrapped store before they're written, see
+// DownloadTask.CompressSegments
+type compressingStore struct {
+    store SegmentStore
+    task  *DownloadTask
+}
+
+func (s compressingStore) Existing(segment int) (string, int64, bool) {
+    return s.store.Existing(segment)
+}
+
+func (s compressingStore) Create(segment int) (SegmentWriter, error) {
+    w, err := s.store.Create(segment)
+    if err != nil {
+        return nil, err
+    }
+    return &compressingWriter {
+        w:    w,
+        task: s.task,
+    }, nil
+}
+
+// keeps the segment in memory until Commit, to only compress it if it's
+// worth it
+type compressingWriter struct {
+    w    SegmentWriter
+    task *DownloadTask
+    raw  bytes.Buffer
+}
+
+func (w *compressingWriter) Write(p []byte) (int, error) {
+    return w.raw.Write(p)
+}
+
+func (w *compressingWriter) Commit(fsync bool) (string, error) {
+    data := w.raw.Bytes()
+
+    var compressed bytes.Buffer
+    zw := gzip.NewWriter(&compressed)
+    _, err := zw.Write(data)
+    if closeErr := zw.Close(); err == nil {
+        err = closeErr
+    }
+    if err == nil && float64(compressed.Len()) <= float64(len(data)) * (1 - compressMinSavings) {
+        data = compressed.Bytes()
+    }
+
+    if _, err := w.w.Write(data); err != nil {
+        w.w.Abort()
+        return "", err
+    }
+    filename, err := w.w.Commit(fsync)
+    if err == nil {
+        w.task.addStoredBytes(int64(len(data)))
+    }
+    return filename, err
+}
+
+func (w *compressingWriter) Abort() {
+    w.w.Abort()
+}
+
+func (d *DownloadTask) addStoredBytes(n int64) {
+    d.resultMu.Lock()
+    defer d.resultMu.Unlock()
+    d.result.StoredBytes += n
+}
@@ -0,0 +1,37 @@
+package download
+
+import (
+    "bufio"
+    "compress/flate"
+    "compress/gzip"
+    "compress/zlib"
+    "fmt"
+    "io"
+    "net/http"
+    "strings"
+)
+
+// Returns the decoded body of a response. The transport only decompresses
+// responses by itself when it added the Accept-Encoding header, a proxy can
+// still send encoded ones, which would corrupt the segment if written as is.
+func decodedBody(resp *http.Response) (io.Reader, error) {
+    encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+    switch encoding {
+    case "", "identity":
+        return resp.Body, nil
+    case "gzip", "x-gzip":
+        return gzip.NewReader(resp.Body)
+    case "deflate":
+        //supposed to be zlib wrapped, but some servers send raw deflate
+        br := bufio.NewReader(resp.Body)
+        head, err := br.Peek(2)
+        if err != nil {
+            return nil, err
+        }
+        if head[0] & 0x0f == 8 && (uint(head[0]) << 8 | uint(head[1])) % 31 == 0 {
+            return zlib.NewReader(br)
+        }
+        return flate.NewReader(br), nil
+    }
+    return nil, fmt.Errorf("Unsupported content encoding '%s'", encoding)
+}
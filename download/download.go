@@ -1,12 +1,20 @@
 package download
 
 import (
+    "bufio"
+    "bytes"
+    "context"
+    "errors"
     "fmt"
     "io"
+    "math/rand"
+    "net"
     "net/http"
+    "net/url"
     "os"
     "path/filepath"
     "strconv"
+    "strings"
     "sync"
     "time"
 
@@ -19,34 +27,292 @@ import (
 
 const DefaultFailThreshold = 20
 const DefaultRetryThreshold = 3
+const DefaultRetryDelay = time.Second
+const DefaultLivePollInterval = 10 * time.Second
+
+// in live mode, how many times in a row a segment past the last downloaded
+// one has to 404 for the stream to be considered over
+const liveEndNotFoundThreshold = 3
+
+var errNotFound = fmt.Errorf("Segment not found")
+
+// Set as DownloadResult.Error when the download finished but some segments
+// were lost, so the merged output has gaps. Wrapped in a DownloadError of
+// kind ErrURLExpired if segments were lost to 403s or a failed URL refresh,
+// so check for it with errors.Is.
+var ErrPartial = fmt.Errorf("Some segments were lost")
+
+// Set as DownloadResult.Error when more than MaxLostSegments segments were
+// given up on and the download was stopped.
+var ErrTooManyLost = fmt.Errorf("Too many segments lost, download aborted")
+
+// Set as DownloadResult.Error when GlobalRetryBudget failed attempts were
+// made and the download was stopped.
+var ErrRetryBudgetExhausted = fmt.Errorf("Retry budget exhausted, download aborted")
 
 type DownloadResult struct {
-    Error         error
-    LostSegments  []int
-    TotalSegments int
+    // time from Start until the download finished
+    Elapsed             time.Duration
+    Error               error
+    // with DryRun, the total size estimated from the probed segments
+    EstimatedBytes      int64
+    // failed attempts at segments, counted against GlobalRetryBudget
+    FailedAttempts      uint
+    // lost segments that were requested but failed
+    FailedSegments      []int
+    // the container of the first segment, unknown if it isn't media or
+    // wasn't checked, see Complete
+    FirstContainer      util.Container
+    // whether the first segment starts with an init segment, see Complete
+    FirstHasInit        bool
+    // successful segment downloads per host that served them
+    HostCounts          map[string]int
+    // failed segment requests per host that answered them
+    HostFailures        map[string]int
+    // LostSegments grouped into ranges of consecutive segments
+    LostRanges          []segments.Range
+    // all lost segments, both failed and unattempted
+    LostSegments        []int
+    // the queue mode used, with QueueAuto resolved to the mode it picked
+    QueueMode           segments.QueueMode
+    // requests made for each segment that needed more than one, including
+    // the successful one and attempts before a requeue. segments downloaded
+    // on the first try are left out.
+    SegmentAttempts     map[int]int
+    // with CompressSegments, bytes written to disk for the segments counted
+    // in TotalBytes, once compressed
+    StoredBytes         int64
+    // bytes of all segments downloaded by this task, not counting failed
+    // requests or segments already downloaded by a previous run
+    TotalBytes          int64
+    TotalSegments       int
+    // with NoMerge, the file of each segment in order, empty for lost ones
+    SegmentFiles        []string
+    // lost segments that were never requested, eg because the download was
+    // stopped before getting to them
+    UnattemptedSegments []int
+    // whether FirstContainer and FirstHasInit are known
+    firstChecked        bool
 }
 
 type DownloadTask struct {
-    Client         *util.HttpClient
-    FailThreshold  uint
-    Fsync          bool
-    Logger         *log.Logger
-    Merger         merge.Merger
-    Progress       *Progress
-    QueueMode      segments.QueueMode
-    RequeueDelay   time.Duration
-    RequeueFailed  uint
-    RequeueLast    bool
-    RetryThreshold uint
-    SegmentCount   uint
-    SegmentDir     string
-    StartSegment   uint
-    Threads        uint
-    Url            string
-    wg             sync.WaitGroup
-    result         DownloadResult
-    started        bool
-    parsedUrl      *parsedURL
+    // how long all threads pause once the breaker opens, see
+    // BreakerThreshold. defaults to DefaultBreakerCooldown.
+    BreakerCooldown    time.Duration
+    // failure rate (0 to 1) of the segment attempts in the last 30 seconds
+    // at which all threads stop making requests for BreakerCooldown, so a
+    // throttling host gets some rest instead of every thread hammering it.
+    // 0 disables the breaker.
+    BreakerThreshold   float64
+    // base the progress percentage on downloaded bytes, estimating the
+    // total size from the first segments. count based until then.
+    ByteProgress       bool
+    // remove leftover segment files of this task after a failed download,
+    // including downloaded ones, instead of keeping them for a later run
+    CleanupOnError     bool
+    // gzip segment files, for keeping segments around with less space.
+    // segments that don't get at least 5% smaller, like most already
+    // compressed media, are stored as is. files keep their names, the
+    // mergers decompress them transparently, but they need to be
+    // decompressed before being used otherwise (eg with NoMerge or the
+    // segment lists of merge.MuxerOptions.ConcatList). segments are kept
+    // in memory until complete.
+    CompressSegments   bool
+    // makes the requests, defaults to a client with the default config.
+    // tests can use a client with a custom Transport, see
+    // util.HttpClientConfig.
+    Client             *util.HttpClient
+    // when reached, no new segments are started and the download finishes
+    // like after Stop, with the remaining segments lost. zero for no limit.
+    Deadline           time.Time
+    // remove leftover incomplete segment files of this task once the
+    // download is done. downloaded segments are left to the merger.
+    DeleteSegments     bool
+    // dials the TCP connections of the default client, eg to bind to a
+    // specific interface. ignored if Client is set, see
+    // util.HttpClientConfig.DialContext.
+    DialContext        func(ctx context.Context, network, addr string) (net.Conn, error)
+    // only plan the download: the segment count and queue mode are resolved
+    // and the first and last segments are requested, to check the URL and
+    // set DownloadResult.EstimatedBytes. nothing is written, SegmentDir
+    // isn't needed and Merger is optional (given no segments if set).
+    DryRun             bool
+    // don't log anything, regardless of Logger. progress is still reported
+    // to Progress.
+    DiscardLogs        bool
+    // if set, receives an event for each downloaded, lost and merged
+    // segment, and is closed once the download finishes (segments merged
+    // after that aren't reported). events are dropped instead of waiting
+    // when it's full, so it should be buffered.
+    Events             chan<- ProgressEvent
+    // stream segment number to stop at (exclusive), to only download part
+    // of a stream together with StartSegment. 0 downloads until the end.
+    EndSegment         uint
+    FailThreshold      uint
+    // name prefix of this task's segment files, defaults to one made from
+    // the video id and itag. should be unique per stream, as tasks sharing
+    // a SegmentDir use it to tell their files apart (also when resuming).
+    FilePrefix         string
+    // only connect over IPv4 or IPv6 with the default client. ignored if
+    // Client is set. can't both be set.
+    ForceIPv4          bool
+    ForceIPv6          bool
+    // flush each segment to disk before marking it done, so it survives a
+    // crash. costs a disk round trip per segment, which adds up on
+    // spinning disks with many threads.
+    Fsync              bool
+    // stop the download once this many attempts at segments failed in
+    // total, counting every segment, with the remaining segments lost. a
+    // ceiling on the work wasted on a broken URL, regardless of the per
+    // segment limits. 0 means no limit.
+    GlobalRetryBudget  uint
+    // keep downloading new segments as they become available, until the
+    // stream ends or Stop is called
+    Live               bool
+    // how often to check for new segments in live mode
+    LivePollInterval   time.Duration
+    Logger             *log.Logger
+    // stop the download once more than this many segments have been given
+    // up on, as the URL is most likely broken. the segments downloaded so
+    // far are still merged. 0 means no limit.
+    MaxLostSegments    uint
+    // how far ahead of the next segment to merge threads may download,
+    // see segments.SegmentStatus.SetReorderWindow. bounds the downloaded
+    // segments waiting to be merged, at the cost of speed when a segment
+    // is slow. 0 means no limit.
+    MaxReorderWindow   uint
+    // segments with bodies bigger than this are treated as failed and
+    // retried, to stop a broken host from filling the disk. 0 means no
+    // limit.
+    MaxSegmentBytes    int64
+    // skip downloading, only merge the segments of this task already in
+    // SegmentDir. missing ones are reported as lost.
+    MergeOnly          bool
+    // minimum time between the starts of two segment requests of a thread,
+    // to limit the request rate to about Threads / MinRequestInterval
+    // without lowering Threads. 0 doesn't wait.
+    MinRequestInterval time.Duration
+    // segments smaller than this are treated as failed and retried, as
+    // they're likely error pages or truncated. 0 disables the check.
+    MinSegmentBytes    int64
+    // only download the segments and leave them in SegmentDir, listed in
+    // DownloadResult.SegmentFiles, without merging anything. segment files
+    // are named with zero padded numbers so they sort in order, which also
+    // means they aren't picked up by runs without NoMerge. Merger is
+    // optional, and given no segments if set.
+    NoMerge            bool
+    // if set, receives the download state for monitoring
+    Metrics            MetricsSink
+    Merger             merge.Merger
+    // called with the current URL when it seems to have expired, either
+    // because its expire time passed or because requests keep getting 403s.
+    // returns a fresh URL for the same stream, used by all threads from then
+    // on. only called by one thread at a time.
+    OnURLExpired       func(oldURL string) (newURL string, err error)
+    // called after each attempt at downloading a segment, from the worker
+    // that made it, so it should return quickly
+    OnSegment          func(SegmentMetrics)
+    // called with how long the download has been stuck each time it's
+    // warned about, see StallTimeout
+    OnStall            func(stalled time.Duration)
+    Progress           *Progress
+    // query parameters added to every segment URL, eg ones some deployments
+    // need that the URLs don't have. a parameter here replaces the one with
+    // the same key in the URL (for path style URLs, only its first value is
+    // used), except sq which is always the segment number.
+    QueryParams        url.Values
+    // spread the start of the threads over this long instead of starting
+    // them all at once, to avoid a burst of requests. 0 disables it.
+    RampUp             time.Duration
+    // if reading a segment fails partway, continue it with a range request
+    // instead of downloading it again, falling back to that if the server
+    // doesn't honor the range. saves bandwidth on large segments over
+    // flaky connections.
+    RangeResume        bool
+    QueueMode          segments.QueueMode
+    // decides whether a request that failed without a response because of
+    // a transient error (eg a timeout or connection reset) is retried right
+    // away, before counting as a failed attempt at the segment. other
+    // errors are never retried. defaults to RetryThreshold attempts.
+    RequestRetryPolicy RetryPolicy
+    RequeueDelay       time.Duration
+    RequeueFailed      uint
+    RequeueLast        bool
+    // once the download finishes, its result is written there as JSON for
+    // scripts, see ResultFileVersion. replaced atomically.
+    ResultFile         string
+    // base delay between attempts at a segment with the default
+    // RetryPolicy. doubles with each failure, starting at twice this value
+    // and up to 4 times it. defaults to DefaultRetryDelay.
+    RetryDelay         time.Duration
+    // decides whether a failed segment is retried, before it's requeued or
+    // given up on. defaults to FailThreshold attempts (less for the last
+    // segment) with a backoff based on RetryDelay.
+    RetryPolicy        RetryPolicy
+    RetryThreshold     uint
+    SegmentCount       uint
+    // where segment files are written. partial segments are written there
+    // too and renamed once complete, so segment data is never moved to
+    // another filesystem.
+    SegmentDir         string
+    // stream segment number to start at (inclusive). segment numbers in
+    // DownloadResult and events are relative to it.
+    StartSegment       uint
+    // warn when no segment was downloaded for this long while threads are
+    // trying to, then again each time it passes without progress. each
+    // warning also calls OnStall and asks OnURLExpired for a new URL. 0
+    // disables the check.
+    StallTimeout       time.Duration
+    // where segments are written, defaults to files in SegmentDir
+    Store              SegmentStore
+    Threads            uint
+    Url                string
+    // use HTTP/3 for the default client, falling back to HTTP/2 if the QUIC
+    // handshake fails. ignored if Client is set.
+    UseQuic            bool
+    // once all segments are downloaded, check the segment files again
+    // before merging anything, and download the bad ones again. costs an
+    // extra read of every segment and delays merging until the end, which
+    // makes MaxReorderWindow unusable.
+    VerifyBeforeMerge  bool
+    // check that segments start like a fragmented MP4 or WebM file, and
+    // retry them otherwise. catches error pages served with a 200 status.
+    VerifyMedia        bool
+    wg                 sync.WaitGroup
+    clientOnce         sync.Once
+    ownsClient         bool
+    closeOnce          sync.Once
+    events             *eventSender
+    result             DownloadResult
+    resultMu           sync.Mutex
+    givenUp            uint
+    // why the download was stopped early, if it was
+    abortErr           error
+    // the first sign of the URL expiring that made segments fail, see
+    // urlExpired
+    expiredErr         error
+    startTime          time.Time
+    started            bool
+    // protects Url and parsedUrl once started, as OnURLExpired can change them
+    urlMu              sync.RWMutex
+    parsedUrl          *parsedURL
+    urlGeneration      uint64
+    refreshMu          sync.Mutex
+    refreshFailedAt    time.Time
+    forbiddenCount     int32
+    statusMu           sync.Mutex
+    status             *segments.SegmentStatus
+    stopRequested      bool
+    // stream end detection in live mode, see liveNotFound
+    liveMu             sync.Mutex
+    highestOk          int
+    notFoundSeg        int
+    notFoundCount      int
+    threadsMu          sync.Mutex
+    threadStatus       []ThreadStatus
+    // when the last segment was downloaded, see StallTimeout
+    lastProgress       time.Time
+    breaker            circuitBreaker
 }
 
 func (d *DownloadTask) Start() {
@@ -63,40 +329,229 @@ func (d *DownloadTask) Start() {
     if d.Threads < 1 {
         d.Threads = 1
     }
+    if d.RetryDelay <= 0 {
+        d.RetryDelay = DefaultRetryDelay
+    }
+    if d.LivePollInterval <= 0 {
+        d.LivePollInterval = DefaultLivePollInterval
+    }
+
+    d.started = true
+    d.startTime = time.Now()
 
     if len(d.Url) == 0 {
-        log.Fatal("Empty URL")
+        d.failStart(&DownloadError { Kind: ErrInvalidURL, Err: fmt.Errorf("Empty URL") })
+        return
     }
-    if d.Merger == nil {
-        log.Fatal("Missing Merger")
+    if d.Merger == nil && !d.DryRun && (!d.NoMerge || d.MergeOnly) {
+        d.failStart(&DownloadError { Kind: ErrInvalidOption, Err: fmt.Errorf("Missing Merger") })
+        return
     }
-    if len(d.SegmentDir) == 0 {
-        log.Fatal("Empty SegmentDir")
+    if len(d.SegmentDir) == 0 && !d.DryRun {
+        d.failStart(&DownloadError { Kind: ErrInvalidOption, Err: fmt.Errorf("Empty SegmentDir") })
+        return
+    }
+    if d.ForceIPv4 && d.ForceIPv6 {
+        d.failStart(&DownloadError { Kind: ErrInvalidOption, Err: fmt.Errorf("ForceIPv4 and ForceIPv6 cannot be combined") })
+        return
+    }
+    if strings.ContainsAny(d.FilePrefix, `/\`) {
+        d.failStart(&DownloadError { Kind: ErrInvalidOption, Err: fmt.Errorf("FilePrefix must not contain path separators") })
+        return
     }
 
+    if err := validateURL(d.Url); err != nil {
+        d.failStart(&DownloadError { Kind: ErrInvalidURL, Err: err })
+        return
+    }
     parsedUrl, err := parseDownloadURL(d.Url)
     if err != nil {
-        d.logger().Fatalf("Failed to parse URL: %v", err)
+        d.failStart(&DownloadError { Kind: ErrInvalidURL, Err: fmt.Errorf("Failed to parse URL: %v", err) })
+        return
     }
     d.parsedUrl = parsedUrl
 
+    if !d.DryRun {
+        if err := os.MkdirAll(d.SegmentDir, 0755); err != nil {
+            d.failStart(fmt.Errorf("Unable to create segment directory: %v", err))
+            return
+        }
+    }
+
+    if !isGoogleVideoHost(parsedUrl.host) {
+        d.logger().Warnf("URL host '%s' doesn't look like a googlevideo fragment URL", parsedUrl.host)
+    }
+    if parsedUrl.missingSq {
+        d.logger().Warn("URL has no 'sq' segment parameter, it might not be a fragment URL")
+    }
+
     if parsedUrl.expire == nil {
         d.logger().Warn("Unable to find 'expire' field in URL")
     } else if now := time.Now(); now.After(*parsedUrl.expire) {
-        d.Logger.Warnf("URL expired %v ago, download will most likely fail", now.Sub(*parsedUrl.expire).Round(time.Second))
+        d.logger().Warnf("URL expired %v ago, download will most likely fail", now.Sub(*parsedUrl.expire).Round(time.Second))
+    }
+
+    if d.Events != nil {
+        d.events = &eventSender { ch: d.Events }
     }
 
     d.wg.Add(1)
-    d.started = true
     go d.run()
 }
 
+// ends the task before any download started. the merger is still run with
+// no segments, so anything waiting on it doesn't hang.
+func (d *DownloadTask) failStart(err error) {
+    d.logger().Errorf("Invalid download task: %v", err)
+    d.result.Error = err
+    if d.Merger != nil {
+        merge.MergeNothing(d.Merger)
+    }
+    if d.Events != nil {
+        close(d.Events)
+    }
+    d.writeResultFile()
+}
+
+func (d *DownloadTask) segmentDone(segment int, cached bool) {
+    d.segmentProgressed()
+    d.Progress.done(segment, cached)
+    d.events.send(ProgressEvent {
+        Type:    EventSegmentDone,
+        Segment: segment,
+        Cached:  cached,
+    })
+}
+
+func (d *DownloadTask) segmentLost(segment int) {
+    d.Progress.lost()
+    if d.Metrics != nil {
+        d.Metrics.SegmentLost()
+    }
+    d.events.send(ProgressEvent {
+        Type:    EventSegmentLost,
+        Segment: segment,
+    })
+}
+
+func (d *DownloadTask) createStatus(segmentCount int, threads int, mode segments.QueueMode) *segments.SegmentStatus {
+    status := segments.Create(segmentCount, threads, mode, d.RequeueDelay)
+    if (d.VerifyBeforeMerge || d.NoMerge) && d.MaxReorderWindow > 0 {
+        //nothing is merged until the end, workers would wait forever
+        d.logger().Warn("Reorder window is ignored when not merging while downloading")
+    } else {
+        status.SetReorderWindow(int(d.MaxReorderWindow))
+    }
+    if d.events != nil {
+        status.SetMergeCallback(func(segment int) {
+            d.events.send(ProgressEvent {
+                Type:    EventSegmentMerged,
+                Segment: segment,
+            })
+        })
+    }
+    return status
+}
+
 func (d *DownloadTask) Wait() *DownloadResult {
     d.wg.Wait()
     return &d.result
 }
 
+// Stops the download. Segments currently being downloaded are finished, but
+// no new ones are started. For live streams, this ends the recording.
+func (d *DownloadTask) Stop() {
+    d.statusMu.Lock()
+    defer d.statusMu.Unlock()
+
+    d.stopRequested = true
+    if d.status != nil {
+        d.status.Stop()
+    }
+}
+
+// The number of segments to download, available while the download is still
+// running, eg for a progress display. 0 until the segment count is known, and
+// with DryRun (see the DownloadResult instead). On live streams it grows as
+// new segments become available.
+func (d *DownloadTask) TotalSegments() int {
+    d.statusMu.Lock()
+    status := d.status
+    d.statusMu.Unlock()
+
+    if status == nil {
+        return 0
+    }
+    return status.Total()
+}
+
+func (d *DownloadTask) setStatus(status *segments.SegmentStatus) {
+    d.statusMu.Lock()
+    defer d.statusMu.Unlock()
+
+    d.status = status
+    if d.stopRequested {
+        status.Stop()
+    }
+}
+
+func (d *DownloadTask) client() *util.HttpClient {
+    d.clientOnce.Do(func() {
+        if d.Client == nil {
+            network := util.NetworkAny
+            if d.ForceIPv4 {
+                network = util.NetworkIPv4
+            } else if d.ForceIPv6 {
+                network = util.NetworkIPv6
+            }
+            d.Client = util.NewClient(&util.HttpClientConfig {
+                DialContext: d.DialContext,
+                Network:     network,
+                UseQuic:     d.UseQuic,
+            })
+            d.ownsClient = true
+        }
+    })
+    return d.Client
+}
+
+// Releases what the task holds on to once it's done: stops the download if
+// it's still running and waits for it, then closes the connections of the
+// default client, or only the idle ones if Client was set, since it might
+// be shared with other tasks. Leftover segment files are already removed
+// when the download finishes, as set by DeleteSegments and CleanupOnError.
+// Safe to call more than once, and after Wait.
+func (d *DownloadTask) Close() {
+    d.closeOnce.Do(func() {
+        d.Stop()
+        d.Wait()
+
+        if d.Client == nil {
+            return
+        }
+        if d.ownsClient {
+            d.Client.Close()
+        } else {
+            d.Client.CloseIdleConnections()
+        }
+    })
+}
+
+func (d *DownloadTask) store() SegmentStore {
+    var store SegmentStore = fileStore { task: d }
+    if d.Store != nil {
+        store = d.Store
+    }
+    if d.CompressSegments {
+        return compressingStore { store: store, task: d }
+    }
+    return store
+}
+
 func (d *DownloadTask) logger() *log.Logger {
+    if d.DiscardLogs {
+        return log.Discard
+    }
     if d.Logger != nil {
         return d.Logger
     }
@@ -106,13 +561,31 @@ func (d *DownloadTask) logger() *log.Logger {
 func (d *DownloadTask) getSegmentCount() (int, error) {
     d.logger().Info("Getting total segments")
 
-    url := d.parsedUrl.SegmentURL(0)
-    resp, err := d.Client.GetRequester().Get(url)
+    segmentCount, err := d.fetchSegmentCount()
     if err != nil {
         return -1, err
     }
+    d.logger().Infof("Total segments: %d", segmentCount)
+
+    return segmentCount, nil
+}
+
+func (d *DownloadTask) fetchSegmentCount() (int, error) {
+    parsedUrl, _ := d.currentURL()
+    url := parsedUrl.SegmentURL(0, d.QueryParams)
+    resp, err := d.client().GetRequester().Get(url)
+    if err != nil {
+        return -1, &DownloadError { Kind: ErrNetwork, Err: err }
+    }
     defer resp.Body.Close()
 
+    if resp.StatusCode == http.StatusNotFound {
+        return -1, errNotFound
+    }
+    if resp.StatusCode == http.StatusForbidden {
+        return -1, &DownloadError { Kind: ErrURLExpired, Err: fmt.Errorf("Response status: %s", resp.Status) }
+    }
+
     header := resp.Header.Get("x-head-seqnum")
     if header == "" {
         return -1, fmt.Errorf("Unable to get segment count, response status: %s", resp.Status)
@@ -122,13 +595,183 @@ func (d *DownloadTask) getSegmentCount() (int, error) {
     if err != nil {
         return -1, fmt.Errorf("Unable to parse x-head-seqnum '%s': %v", header, err)
     }
-    d.logger().Infof("Total segments: %d", segmentCount)
-
     return segmentCount, nil
 }
 
+// periodically checks for new segments of a live stream until the
+// stream ends or the download is stopped
+func (d *DownloadTask) pollLiveSegments(status *segments.SegmentStatus) {
+    for {
+        select {
+        case <-time.After(d.LivePollInterval):
+        case <-status.StopChan():
+            return
+        }
+        if status.Stopped() {
+            return
+        }
+
+        segmentCount, err := d.fetchSegmentCount()
+        if err == errNotFound {
+            //nothing downloaded yet, might just be a transient 404
+            if !d.liveDownloadedAny() {
+                d.logger().Warn("Segment count request got a 404 before any segment was downloaded, retrying")
+                continue
+            }
+            d.logger().Info("Stream ended, finishing download")
+            status.Stop()
+            return
+        }
+        if err != nil {
+            d.logger().Warnf("Unable to check for new segments: %v", err)
+            continue
+        }
+        streamCount := segmentCount
+        if segmentCount, err = d.rangeCount(streamCount); err != nil {
+            continue
+        }
+        if segmentCount > status.Total() {
+            d.logger().Debugf("Live segment count grew to %d", segmentCount)
+            status.Extend(segmentCount)
+            d.setTotalMetric(segmentCount)
+            d.Progress.grow(segmentCount)
+        }
+        if d.EndSegment > 0 && streamCount >= int(d.EndSegment) {
+            d.logger().Info("Reached end segment, finishing download")
+            status.EndLive()
+            return
+        }
+    }
+}
+
+// turns a stream segment count into the number of segments in the range
+// between StartSegment and EndSegment
+func (d *DownloadTask) rangeCount(streamCount int) (int, error) {
+    end := streamCount
+    if d.EndSegment > 0 && int(d.EndSegment) < end {
+        end = int(d.EndSegment)
+    }
+    if end <= int(d.StartSegment) {
+        return -1, fmt.Errorf("No segments between start segment %d and end segment %d", d.StartSegment, end)
+    }
+    return end - int(d.StartSegment), nil
+}
+
+// stops the download if too many segments were given up on
+func (d *DownloadTask) segmentGivenUp() {
+    d.resultMu.Lock()
+    d.givenUp++
+    abort := d.MaxLostSegments > 0 && d.givenUp > d.MaxLostSegments && d.abortErr == nil
+    if abort {
+        d.abortErr = ErrTooManyLost
+    }
+    d.resultMu.Unlock()
+
+    if abort {
+        d.logger().Errorf("Gave up on more than %d segments, aborting download", d.MaxLostSegments)
+        d.Stop()
+    }
+}
+
+// counts a failed attempt, stops the download once GlobalRetryBudget is
+// used up
+func (d *DownloadTask) attemptFailed() {
+    d.resultMu.Lock()
+    d.result.FailedAttempts++
+    abort := d.GlobalRetryBudget > 0 && d.result.FailedAttempts >= d.GlobalRetryBudget && d.abortErr == nil
+    if abort {
+        d.abortErr = ErrRetryBudgetExhausted
+    }
+    d.resultMu.Unlock()
+
+    if abort {
+        d.logger().Errorf("%d attempts at segments failed, retry budget exhausted, aborting download", d.GlobalRetryBudget)
+        d.Stop()
+    }
+}
+
+func (d *DownloadTask) addTotalBytes(n int64) {
+    d.resultMu.Lock()
+    defer d.resultMu.Unlock()
+    d.result.TotalBytes += n
+}
+
+// a segment was downloaded in live mode
+func (d *DownloadTask) liveOk(segment int) {
+    d.liveMu.Lock()
+    defer d.liveMu.Unlock()
+
+    if segment > d.highestOk {
+        d.highestOk = segment
+    }
+    if segment >= d.notFoundSeg {
+        d.notFoundCount = 0
+    }
+}
+
+// whether a segment was downloaded in live mode, before which 404s aren't
+// taken as the end of the stream
+func (d *DownloadTask) liveDownloadedAny() bool {
+    d.liveMu.Lock()
+    defer d.liveMu.Unlock()
+    return d.highestOk >= 0
+}
+
+// a segment returned 404 in live mode. once the stream ends, segments after
+// the last one keep returning 404, while earlier ones are still available.
+// a 404 on a segment after the highest downloaded one is treated as the end
+// of the stream if it keeps happening, instead of retrying it until the
+// fail threshold is reached.
+func (d *DownloadTask) liveNotFound(status *segments.SegmentStatus, segment int) {
+    d.liveMu.Lock()
+    defer d.liveMu.Unlock()
+
+    //nothing downloaded yet, might just be an expired url
+    if d.highestOk < 0 || segment <= d.highestOk {
+        return
+    }
+    if segment != d.notFoundSeg {
+        d.notFoundSeg = segment
+        d.notFoundCount = 0
+    }
+    d.notFoundCount++
+    if d.notFoundCount == liveEndNotFoundThreshold {
+        d.logger().Infof("Segment %d not found after segment %d was downloaded, stream ended", segment, d.highestOk)
+        status.Stop()
+    }
+}
+
 func (d *DownloadTask) run() {
     defer d.wg.Done()
+    defer d.writeResultFile()
+    defer func() {
+        if dropped := d.events.close(); dropped > 0 {
+            d.logger().Debugf("Dropped %d progress event(s), channel full", dropped)
+        }
+    }()
+    defer func() {
+        d.result.Elapsed = time.Since(d.startTime)
+    }()
+    defer func() {
+        if d.DryRun {
+            return
+        }
+        if d.result.Failed() {
+            if d.CleanupOnError {
+                d.cleanupSegments(true)
+            }
+        } else if d.DeleteSegments {
+            d.cleanupSegments(false)
+        }
+    }()
+
+    if d.MergeOnly {
+        d.mergeExisting()
+        return
+    }
+
+    d.Progress.setup()
+    defer d.Progress.endSetup()
 
     var segmentCount int
     if d.SegmentCount == 0 {
@@ -139,26 +782,84 @@ func (d *DownloadTask) run() {
             segmentCount, err = d.getSegmentCount()
             if err != nil {
                 fails = append(fails, err)
-                time.Sleep(2 * time.Second)
+                if i < 2 {
+                    time.Sleep(2 * time.Second)
+                }
                 continue
             }
             ok = true
             break
         }
         if !ok {
-            d.result.Error = fmt.Errorf("Unable to fetch segment count: %v", fails)
+            for _, err := range fails {
+                d.logger().Debugf("Segment count fetch failed: %v", err)
+            }
+            //keep the last error wrapped so its category can be checked
+            d.result.Error = fmt.Errorf("Unable to fetch segment count after %d attempts: %w", len(fails), fails[len(fails) - 1])
+            if d.Merger != nil {
+                merge.MergeNothing(d.Merger)
+            }
             return
         }
     } else {
-        segmentCount = int(d.SegmentCount)
+        segmentCount = int(d.SegmentCount + d.StartSegment)
+    }
+    segmentCount, err := d.rangeCount(segmentCount)
+    if err != nil {
+        d.result.Error = err
+        if d.Merger != nil {
+            merge.MergeNothing(d.Merger)
+        }
+        return
     }
 
     d.result.TotalSegments = segmentCount
+    if d.DryRun {
+        d.dryRun(segmentCount)
+        return
+    }
+    d.setTotalMetric(segmentCount)
 
-    d.Progress.init(segmentCount, d.parsedUrl.expire)
+    parsedUrl, _ := d.currentURL()
+    d.Progress.init(segmentCount, parsedUrl.expire)
+    if d.ByteProgress {
+        d.Progress.setByteMode()
+    }
 
-    segmentStatus := segments.Create(segmentCount, int(d.Threads), d.QueueMode, d.RequeueDelay)
-    go d.Merger.Merge(segmentStatus)
+    segmentStatus := d.createStatus(segmentCount, int(d.Threads), d.QueueMode)
+    d.result.QueueMode = segmentStatus.Mode()
+    if d.QueueMode == segments.QueueAuto {
+        d.logger().Infof("Using %v queue mode", segmentStatus.Mode())
+    }
+    if d.Live {
+        segmentStatus.SetLive()
+        d.Progress.setLive()
+        d.highestOk = -1
+        d.notFoundSeg = -1
+    }
+    d.setStatus(segmentStatus)
+    if d.NoMerge {
+        if d.Merger != nil {
+            merge.MergeNothing(d.Merger)
+        }
+    } else if !d.VerifyBeforeMerge {
+        go d.Merger.Merge(segmentStatus)
+    }
+    if !d.Deadline.IsZero() {
+        timer := time.AfterFunc(time.Until(d.Deadline), func() {
+            d.logger().Warn("Deadline reached, finishing download")
+            d.Stop()
+        })
+        defer timer.Stop()
+    }
+    if d.Live {
+        go d.pollLiveSegments(segmentStatus)
+    }
+
+    d.initThreadStatus(d.Threads)
+    threadsDone := make(chan struct{})
+    go d.logThreadStatus(threadsDone)
+    go d.watchStalls(threadsDone)
 
     var downloadGroup sync.WaitGroup
     for i := uint(0); i < d.Threads; i++ {
@@ -168,11 +869,171 @@ func (d *DownloadTask) run() {
             d,
             &downloadGroup,
             segmentStatus,
+            d.startDelay(i),
         )
     }
 
     downloadGroup.Wait()
-    d.result.LostSegments = segmentStatus.MissedSegments()
+    close(threadsDone)
+    for _, seg := range segmentStatus.Finish() {
+        d.segmentLost(seg)
+    }
+    if d.Live {
+        //make sure the poller exits
+        segmentStatus.Stop()
+        d.Progress.liveEnded(segmentStatus.Total())
+    }
+    if d.VerifyBeforeMerge {
+        d.verifySegments(segmentStatus)
+    }
+    if d.NoMerge {
+        d.listSegmentFiles(segmentStatus)
+    } else if d.VerifyBeforeMerge {
+        go d.Merger.Merge(segmentStatus)
+    }
+    d.result.TotalSegments = segmentStatus.Total()
+    d.setTotalMetric(segmentStatus.Total())
+    if d.abortErr != nil {
+        d.result.Error = d.abortErr
+    }
+    d.setLostSegments(segmentStatus)
+}
+
+// Whether the download completed without any error or lost segment.
+func (r *DownloadResult) Success() bool {
+    return r.Error == nil && len(r.LostSegments) == 0
+}
+
+// Whether the download failed completely, as opposed to a successful or
+// partial one.
+func (r *DownloadResult) Failed() bool {
+    return r.Error != nil && !errors.Is(r.Error, ErrPartial)
+}
+
+func (d *DownloadTask) setLostSegments(status *segments.SegmentStatus) {
+    lost := status.MissedSegments()
+    unattempted := status.UnattemptedSegments()
+
+    isUnattempted := make(map[int]bool, len(unattempted))
+    for _, seg := range unattempted {
+        isUnattempted[seg] = true
+    }
+    var failed []int
+    for _, seg := range lost {
+        if !isUnattempted[seg] {
+            failed = append(failed, seg)
+        }
+    }
+
+    d.result.LostSegments = lost
+    d.result.LostRanges = segments.Ranges(lost)
+    if len(lost) > 0 && d.result.Error == nil {
+        d.result.Error = ErrPartial
+        if expired := d.urlExpiredErr(); expired != nil {
+            d.result.Error = &DownloadError { Kind: ErrURLExpired, Err: fmt.Errorf("%w, last failure: %v", ErrPartial, expired) }
+        }
+    }
+    d.result.FailedSegments = failed
+    d.result.UnattemptedSegments = unattempted
+}
+
+// sets DownloadResult.SegmentFiles for NoMerge
+func (d *DownloadTask) listSegmentFiles(status *segments.SegmentStatus) {
+    files := make([]string, status.Total())
+    kept := 0
+    for seg := range files {
+        if result, ok := status.Result(seg); ok && result.Ok {
+            files[seg] = result.Filename
+            kept++
+        }
+    }
+    d.result.SegmentFiles = files
+    d.logger().Infof("Kept %d segment file(s) in %s without merging", kept, d.SegmentDir)
+}
+
+// merges the already downloaded segments in SegmentDir, without making
+// any requests. without a SegmentCount, the highest segment found is
+// assumed to be the last one.
+func (d *DownloadTask) mergeExisting() {
+    segmentCount := int(d.SegmentCount)
+    if segmentCount > 0 && d.EndSegment > 0 && d.EndSegment < d.StartSegment + d.SegmentCount {
+        segmentCount = int(d.EndSegment) - int(d.StartSegment)
+    }
+    if segmentCount <= 0 {
+        var err error
+        if segmentCount, err = d.countExistingSegments(); err != nil {
+            d.result.Error = fmt.Errorf("Unable to find existing segments: %v", err)
+            merge.MergeNothing(d.Merger)
+            return
+        }
+    }
+    d.logger().Infof("Merging %d existing segment(s)", segmentCount)
+
+    d.result.TotalSegments = segmentCount
+    d.setTotalMetric(segmentCount)
+    d.Progress.init(segmentCount, nil)
+
+    segmentStatus := d.createStatus(segmentCount, 1, segments.QueueSequential)
+    d.setStatus(segmentStatus)
+    go d.Merger.Merge(segmentStatus)
+
+    for i := 0; i < segmentCount; i++ {
+        donePath := segmentBaseFileName(d, i) + ".done"
+        if !util.FileNotEmpty(donePath) {
+            d.logger().Warnf("Segment %d is missing", i)
+            segmentStatus.Downloaded(i, segments.SegmentResult { Ok: false })
+            d.segmentLost(i)
+            continue
+        }
+        segmentStatus.Downloaded(i, segments.SegmentResult {
+            Ok: true,
+            Filename: donePath,
+        })
+        d.segmentDone(i, true)
+    }
+    segmentStatus.Finish()
+    d.setLostSegments(segmentStatus)
+}
+
+// returns one more than the highest downloaded segment number in SegmentDir
+func (d *DownloadTask) countExistingSegments() (int, error) {
+    entries, err := os.ReadDir(d.SegmentDir)
+    if err != nil {
+        return -1, err
+    }
+    prefix := segmentFilePrefix(d)
+    count := 0
+    for _, e := range entries {
+        name := e.Name()
+        if e.IsDir() || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ".done") {
+            continue
+        }
+        n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, prefix), ".done"))
+        if err != nil || n < 0 {
+            continue
+        }
+        if n + 1 > count {
+            count = n + 1
+        }
+    }
+    if count == 0 {
+        return -1, fmt.Errorf("No segments found in '%s'", d.SegmentDir)
+    }
+    return d.rangeCount(count)
+}
+
+// how long a thread waits before starting with RampUp: threads are spread
+// evenly over it, each with a random offset within its slot
+func (d *DownloadTask) startDelay(thread uint) time.Duration {
+    if d.RampUp <= 0 || thread == 0 {
+        return 0
+    }
+    slot := d.RampUp / time.Duration(d.Threads)
+    jitter := time.Duration(0)
+    if slot > 0 {
+        jitter = time.Duration(rand.Int63n(int64(slot)))
+    }
+    return slot * time.Duration(thread) + jitter
 }
 
 func downloadTask(
@@ -180,18 +1041,37 @@ func downloadTask(
     task *DownloadTask,
     wg *sync.WaitGroup,
     status *segments.SegmentStatus,
+    startDelay time.Duration,
 ) {
     defer wg.Done()
+    defer task.setThreadState(threadNumber, ThreadDone, -1, 0)
+    if startDelay > 0 {
+        task.logger().Debugf("Thread %d starting in %v", threadNumber, startDelay.Round(time.Millisecond))
+        select {
+        case <-time.After(startDelay):
+        case <-status.StopChan():
+            return
+        }
+    }
+    if task.Metrics != nil {
+        task.Metrics.ThreadActive(1)
+        defer task.Metrics.ThreadActive(-1)
+    }
     queue := status.CreateQueue(int(threadNumber))
-    requester := task.Client.GetRequester()
+    requester := task.client().GetRequester()
 
-    failCount := uint(0)
+    failCount := 0
+    exhausted := false
     networkFailCount := uint(0)
+    var attempt SegmentMetrics
 
     seg := -1
     requeues := uint(0)
+    //start of the last segment request, for MinRequestInterval
+    var lastRequest time.Time
     for {
         if seg == -1 {
+            task.setThreadState(threadNumber, ThreadIdle, -1, 0)
             var ok bool
             seg, requeues, ok = queue.NextSegment()
             if !ok {
@@ -201,16 +1081,8 @@ func downloadTask(
             if seg == -1 {
                 panic("Segment == -1")
             }
-            task.logger().Debugf("Getting segment %d", seg)
-        }
-
-        //the last segment often isn't available, so use less retries for it
-        fails := task.FailThreshold
-        if status.IsLast(seg) {
-            //at least 5
-            fails = task.FailThreshold / 4
-            if fails < 5 {
-                fails = 5
+            if task.logger().Enabled(log.LevelDebug) {
+                task.logger().Debugf("Getting segment %d", seg)
             }
         }
 
@@ -218,13 +1090,14 @@ func downloadTask(
             task.logger().Warnf("Suspicious network failures for segment %d, replacing http client", seg)
 
             requester.Dispose()
-            requester = task.Client.GetRequester()
+            requester = task.client().GetRequester()
             networkFailCount = 0
 
             continue
         }
 
-        if failCount >= fails {
+        if exhausted {
+            exhausted = false
             if requeues < task.RequeueFailed && (!status.IsLast(seg) || task.RequeueLast) {
                 task.logger().Warnf("Failed segment %d, requeue %d/%d", seg, requeues + 1, task.RequeueFailed)
                 queue.RequeueFailed(seg, requeues + 1)
@@ -236,143 +1109,354 @@ func downloadTask(
             }
 
             task.logger().Warnf("Giving up segment %d", seg)
+            if attempt.StatusCode == http.StatusForbidden {
+                task.urlExpired(attempt.Error)
+            }
 
             status.Downloaded(seg, segments.SegmentResult { Ok: false })
-            task.Progress.lost()
+            task.segmentLost(seg)
+            task.segmentGivenUp()
 
             seg = -1
             failCount = 0
             continue
         }
 
-        task.logger().Debugf("Current segment: %d", seg)
+        if task.breakerOpen() {
+            task.setThreadState(threadNumber, ThreadPaused, seg, failCount)
+        }
+        if !task.breakerWait(status.StopChan()) {
+            task.logger().Debugf("Download stopped, abandoning segment %d", seg)
+            return
+        }
+        if task.logger().Enabled(log.LevelDebug) {
+            task.logger().Debugf("Current segment: %d", seg)
+        }
+        if wait := task.MinRequestInterval - time.Since(lastRequest); wait > 0 {
+            select {
+            case <-time.After(wait):
+            case <-status.StopChan():
+                task.logger().Debugf("Download stopped, abandoning segment %d", seg)
+                return
+            }
+        }
+        task.setThreadState(threadNumber, ThreadDownloading, seg, failCount)
 
-        ok, cached := downloadSegment(task, requester, status, seg, &networkFailCount)
+        status.Attempted(seg)
+        requestStart := time.Now()
+        ok, cached := downloadSegment(task, requester, status, seg, &networkFailCount, &attempt)
+        if !cached {
+            lastRequest = requestStart
+            task.breakerRecord(ok)
+        }
         if ok {
-            task.Progress.done(seg, cached)
+            task.countAttempt(seg, true)
+            task.segmentDone(seg, cached)
 
             seg = -1
             failCount = 0
         } else {
+            if status.Stopped() {
+                //no point retrying, it's left unreported so Finish handles it
+                task.logger().Debugf("Download stopped, abandoning segment %d", seg)
+                break
+            }
             failCount++
-            task.logger().Debugf("Failed segment %d [%d/%d]", seg, failCount, fails)
-
-            //exponential backoff, up to 4 seconds between retries
-            sleepShift := failCount
-            if sleepShift > 2 {
-                sleepShift = 2
+            task.countAttempt(seg, false)
+            task.attemptFailed()
+            retry, delay := task.segmentRetryPolicy(status.IsLast(seg)).ShouldRetry(failCount, attempt.StatusCode, attempt.Error)
+            if !retry {
+                task.logger().Debugf("Failed segment %d [%d], not retrying", seg, failCount)
+                exhausted = true
+                continue
             }
+            task.logger().Debugf("Failed segment %d [%d], retrying in %v", seg, failCount, delay)
+            task.setThreadState(threadNumber, ThreadRetrying, seg, failCount)
 
-            time.Sleep(time.Duration(1 << sleepShift) * time.Second)
+            //stopping shouldn't have to wait for the delay
+            select {
+            case <-time.After(delay):
+            case <-status.StopChan():
+                task.logger().Debugf("Download stopped, abandoning segment %d", seg)
+                return
+            }
         }
     }
 }
 
+// all segment files of a task start with this prefix, so tasks can share
+// a SegmentDir
+func segmentFilePrefix(task *DownloadTask) string {
+    if task.FilePrefix != "" {
+        return task.FilePrefix + "."
+    }
+    parsedUrl, _ := task.currentURL()
+    return fmt.Sprintf("segment-%s_%d.", parsedUrl.id, parsedUrl.itag)
+}
+
+// files are named after the stream segment number, so runs with different
+// start segments can share them
 func segmentBaseFileName(task *DownloadTask, segment int) string {
+    format := "%s%d"
+    if task.NoMerge {
+        format = "%s%08d"
+    }
     return filepath.Join(
         task.SegmentDir,
-        fmt.Sprintf(
-            "segment-%s_%d.%d",
-            task.parsedUrl.id,
-            task.parsedUrl.itag,
-            segment,
-        ),
+        fmt.Sprintf(format, segmentFilePrefix(task), task.StartSegment + uint(segment)),
     )
 }
 
-func downloadSegment(task *DownloadTask, requester *util.HttpRequester, status *segments.SegmentStatus, segment int, networkErrors *uint) (bool, bool) {
-    segmentBasePath := segmentBaseFileName(task, segment)
-    segmentDownloadPath := segmentBasePath + ".incomplete"
-    segmentDonePath := segmentBasePath + ".done"
+// removes segment files of this task left in SegmentDir, such as incomplete
+// downloads of interrupted runs. completed segments are only removed if
+// all is set. must only be called once no workers are running.
+func (d *DownloadTask) cleanupSegments(all bool) {
+    entries, err := os.ReadDir(d.SegmentDir)
+    if err != nil {
+        d.logger().Warnf("Unable to list segment dir for cleanup: %v", err)
+        return
+    }
+    prefix := segmentFilePrefix(d)
+    removed := 0
+    for _, e := range entries {
+        name := e.Name()
+        if e.IsDir() || !strings.HasPrefix(name, prefix) {
+            continue
+        }
+        if !all && !strings.HasSuffix(name, ".incomplete") {
+            continue
+        }
+        if err := os.Remove(filepath.Join(d.SegmentDir, name)); err != nil {
+            d.logger().Warnf("Unable to remove leftover segment file '%s': %v", name, err)
+            continue
+        }
+        removed++
+    }
+    if removed > 0 {
+        d.logger().Debugf("Removed %d leftover segment file(s)", removed)
+    }
+}
 
+// attempt is set to the details of the request made, if any
+func downloadSegment(task *DownloadTask, requester *util.HttpRequester, status *segments.SegmentStatus, segment int, networkErrors *uint, attempt *SegmentMetrics) (ok bool, cached bool) {
     //already downloaded
-    if util.FileNotEmpty(segmentDonePath) {
+    if filename, size, ok := task.store().Existing(segment); ok {
         task.logger().Debugf("Segment %d already downloaded", segment)
+        if segment == 0 {
+            task.checkFirstSegmentFile(filename)
+        }
+        task.Progress.addBytes(size)
+        if task.Live {
+            task.liveOk(segment)
+        }
         status.Downloaded(segment, segments.SegmentResult {
             Ok: true,
-            Filename: segmentDonePath,
+            Filename: filename,
         })
         return true, true
     }
 
-    targetUrl := task.parsedUrl.SegmentURL(task.StartSegment + uint(segment))
+    metrics := SegmentMetrics {
+        Segment: segment,
+    }
+    start := time.Now()
+    defer func() {
+        metrics.Duration = time.Since(start)
+        metrics.Ok = ok
+        *attempt = metrics
+        task.countHost(&metrics)
+        if task.OnSegment != nil {
+            task.OnSegment(metrics)
+        }
+        if task.Metrics != nil {
+            task.Metrics.SegmentAttempt(metrics)
+        }
+    }()
+
+    parsedUrl, urlGeneration := task.currentURL()
+    targetUrl := parsedUrl.SegmentURL(task.StartSegment + uint(segment), task.QueryParams)
 
     req, err := http.NewRequest("GET", targetUrl, nil)
     if err != nil {
-        task.logger().Fatalf("Unable to create http request: %v", err)
+        task.logger().Errorf("Unable to create request for segment %d: %v", segment, err)
+        metrics.Error = err
+        return false, false
     }
     req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/89.0.4389.90 Safari/537.36")
 
-    resp, err := doRequest(task, requester, req)
+    resp, err := doRequest(task, requester, status, req)
     if err != nil {
         *networkErrors++
         task.logger().Debugf("Request for segment %d failed with %v", segment, err)
+        metrics.Error = err
         return false, false
     }
     defer resp.Body.Close()
+    metrics.Host = resp.Request.URL.Host
+    metrics.StatusCode = resp.StatusCode
 
     if resp.StatusCode != 200 {
         task.logger().Debugf("Non-200 status code %d for segment %d", resp.StatusCode, segment)
-        req, err = http.NewRequest("GET", task.Url, nil)
-        if err == nil {
-            resp, err = doRequest(task, requester, req)
-            if resp != nil {
-                defer resp.Body.Close()
-            }
+        metrics.Error = fmt.Errorf("Status code %d", resp.StatusCode)
+        if resp.StatusCode == http.StatusForbidden {
+            task.urlForbidden(urlGeneration)
+        } else {
+            task.urlWorked()
+        }
+        if task.Live && resp.StatusCode == http.StatusNotFound {
+            task.liveNotFound(status, segment)
         }
         return false, false
     }
 
-    file, err := os.OpenFile(segmentDownloadPath, os.O_RDWR|os.O_CREATE, 0644)
+    task.urlWorked()
+
+    //with transparent decompression, the ranges wouldn't match what's read
+    if task.RangeResume && !resp.Uncompressed {
+        rr := &resumingReader {
+            task:      task,
+            requester: requester,
+            status:    status,
+            req:       req,
+            segment:   segment,
+            body:      resp.Body,
+        }
+        resp.Body = rr
+        defer rr.Close()
+    }
+
+    body, err := decodedBody(resp)
+    if err != nil {
+        task.logger().Debugf("Unable to decode segment %d: %v", segment, err)
+        metrics.Error = err
+        return false, false
+    }
+    if task.VerifyMedia {
+        br := bufio.NewReader(body)
+        head, _ := br.Peek(util.MediaSniffLen)
+        metrics.Container = util.SniffMedia(head)
+        if metrics.Container == util.ContainerUnknown {
+            //peek further to show what the server said
+            start, _ := br.Peek(errorBodyPeekLen)
+            if line, ok := errorBodyLine(start); ok {
+                task.logger().Debugf("Segment %d is an error page instead of media: %s", segment, line)
+                metrics.Error = fmt.Errorf("Response is an error page: %s", line)
+            } else {
+                task.logger().Debugf("Segment %d doesn't look like media, starts with %q", segment, head)
+                metrics.Error = fmt.Errorf("Response is not media")
+            }
+            return false, false
+        }
+        body = br
+    }
+    if segment == 0 {
+        br := bufio.NewReader(body)
+        head, _ := br.Peek(util.MediaSniffLen)
+        task.checkFirstSegment(head)
+        body = br
+    }
+    if task.MaxSegmentBytes > 0 {
+        //one byte over the limit is enough to tell it's too large
+        body = io.LimitReader(body, task.MaxSegmentBytes + 1)
+    }
+
+    w, err := task.store().Create(segment)
     if err != nil {
         task.logger().Warnf("Unable to create temp file for segment %d: %v", segment, err)
+        metrics.Error = err
+        task.checkDiskFull(err)
         return false, false
     }
-    defer file.Close()
 
-    if _, err = io.Copy(file, resp.Body); err != nil {
-        os.Remove(file.Name())
+    written, err := io.Copy(w, body)
+    metrics.Bytes = written
+    if err != nil {
+        w.Abort()
         task.logger().Errorf("Unable to write segment %d: %v", segment, err)
+        metrics.Error = err
+        task.checkDiskFull(err)
         return false, false
     }
-
-    if task.Fsync {
-        if err = file.Sync(); err != nil {
-            os.Remove(file.Name())
-            task.logger().Errorf("Unable to sync segment %d: %v", segment, err)
-            return false, false
-        }
+    if task.MaxSegmentBytes > 0 && written > task.MaxSegmentBytes {
+        w.Abort()
+        task.logger().Warnf("Segment %d is too large (over %d bytes), rejecting it", segment, task.MaxSegmentBytes)
+        metrics.Error = fmt.Errorf("Segment too large (over %d bytes)", task.MaxSegmentBytes)
+        return false, false
     }
-    if err = file.Close(); err != nil {
-        os.Remove(file.Name())
-        task.logger().Errorf("Unable to close file for segment %d: %v", segment, err)
+    if written < task.MinSegmentBytes {
+        w.Abort()
+        task.logger().Debugf("Segment %d is too small (%d bytes, minimum %d), rejecting it", segment, written, task.MinSegmentBytes)
+        metrics.Error = fmt.Errorf("Segment too small (%d bytes)", written)
         return false, false
     }
 
-    if err = os.Rename(segmentDownloadPath, segmentDonePath); err != nil {
-        os.Remove(segmentDownloadPath)
-        task.logger().Errorf("Unable to rename segment %d: %v", segment, err)
+    filename, err := w.Commit(task.Fsync)
+    if err != nil {
+        task.logger().Errorf("Unable to save segment %d: %v", segment, err)
+        metrics.Error = err
+        task.checkDiskFull(err)
         return false, false
     }
-    task.logger().Debugf("Downloaded segment %d", segment)
+    if task.logger().Enabled(log.LevelDebug) {
+        task.logger().Debugf("Downloaded segment %d", segment)
+    }
+    task.Progress.addBytes(written)
+    task.addTotalBytes(written)
+    if task.Live {
+        task.liveOk(segment)
+    }
 
     status.Downloaded(segment, segments.SegmentResult {
         Ok: true,
-        Filename: segmentDonePath,
+        Filename: filename,
     })
 
     return true, false
 }
 
-func doRequest(task *DownloadTask, requester *util.HttpRequester, req *http.Request) (*http.Response, error) {
-    var errors []error
-    for i := uint(0); i < task.RetryThreshold; i++ {
+// how much of a response that isn't media is read to find an error message
+const errorBodyPeekLen = 512
+
+// returns the first non empty line of a body that looks like an HTML page
+// or JSON, as served with a 200 status when throttling
+func errorBodyLine(head []byte) (string, bool) {
+    trimmed := bytes.TrimSpace(head)
+    if len(trimmed) == 0 || (trimmed[0] != '<' && trimmed[0] != '{') {
+        return "", false
+    }
+    for _, line := range bytes.Split(trimmed, []byte { '\n' }) {
+        if line = bytes.TrimSpace(line); len(line) > 0 {
+            return string(line), true
+        }
+    }
+    return "", false
+}
+
+// retries transient network failures according to RequestRetryPolicy, until
+// status is stopped. the returned error is a *RequestError with the failure
+// of every attempt.
+func doRequest(task *DownloadTask, requester *util.HttpRequester, status *segments.SegmentStatus, req *http.Request) (*http.Response, error) {
+    policy := task.requestRetryPolicy()
+    reqErr := &RequestError {}
+    for i := 1; ; i++ {
         resp, err := requester.Do(req)
         if err == nil {
             return resp, nil
         }
-        errors = append(errors, err)
+        reqErr.Attempts = append(reqErr.Attempts, err)
+        if !retryableError(err) {
+            return nil, reqErr
+        }
+        retry, delay := policy.ShouldRetry(i, 0, err)
+        if !retry {
+            return nil, reqErr
+        }
+        task.logger().Debugf("Request failed with %v, retrying", err)
+        select {
+        case <-time.After(delay):
+        case <-status.StopChan():
+            return nil, reqErr
+        }
     }
-    return nil, fmt.Errorf("All requests failed: %v", errors)
 }
 
@@ -0,0 +1,163 @@
+package download
+
+import (
+    "bytes"
+    "compress/gzip"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "os"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/HoloArchivists/ytarchive-raw-go/log"
+    "github.com/HoloArchivists/ytarchive-raw-go/util"
+)
+
+const testURL = "https://rr1---sn-test.googlevideo.com/videoplayback?noclen=1&id=abc.1&itag=140&expire=9999999999&sq=0"
+
+// a fragmented MP4 segment start, enough for util.SniffMedia
+var testSegment = []byte { 0, 0, 0, 16, 'm', 'o', 'o', 'f', 0, 0, 0, 0, 0, 0, 0, 0 }
+
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+    return f(req)
+}
+
+// a one segment stream where every request gets a 200 response with body
+// and the given headers
+func testResponses(body []byte, header http.Header) http.RoundTripper {
+    return roundTripFunc(func(req *http.Request) (*http.Response, error) {
+        h := http.Header {}
+        for k, v := range header {
+            h[k] = append([]string(nil), v...)
+        }
+        h.Set("X-Head-Seqnum", "1")
+        return &http.Response {
+            StatusCode: 200,
+            Header:     h,
+            Body:       io.NopCloser(bytes.NewReader(body)),
+            Request:    req,
+        }, nil
+    })
+}
+
+// downloads the stream served by rt, only keeping the segment files
+func runTestTask(t *testing.T, rt http.RoundTripper, setup func(task *DownloadTask)) *DownloadResult {
+    dir := t.TempDir()
+    client := util.NewClient(&util.HttpClientConfig { Transport: rt })
+    defer client.Close()
+
+    task := &DownloadTask {
+        Client:        client,
+        FailThreshold: 2,
+        Logger:        log.Discard,
+        NoMerge:       true,
+        Progress:      NewProgress().Video(),
+        RetryDelay:    time.Millisecond,
+        SegmentDir:    dir,
+        Threads:       1,
+        Url:           testURL,
+    }
+    if setup != nil {
+        setup(task)
+    }
+    task.Start()
+    res := task.Wait()
+    task.Close()
+    return res
+}
+
+func TestVerifyMediaRejectsErrorPage(t *testing.T) {
+    page := []byte("<html><body>Error 403 (Forbidden)</body></html>")
+    res := runTestTask(t, testResponses(page, nil), func(task *DownloadTask) {
+        task.VerifyMedia = true
+    })
+    if len(res.LostSegments) != 1 || res.LostSegments[0] != 0 {
+        t.Fatalf("Error page wasn't rejected, lost segments: %v", res.LostSegments)
+    }
+    if len(res.SegmentFiles) != 1 || res.SegmentFiles[0] != "" {
+        t.Errorf("Error page was stored as %v", res.SegmentFiles)
+    }
+}
+
+func TestVerifyMediaAcceptsMedia(t *testing.T) {
+    res := runTestTask(t, testResponses(testSegment, nil), func(task *DownloadTask) {
+        task.VerifyMedia = true
+    })
+    if !res.Success() {
+        t.Fatalf("Media segment was rejected: %v", res.Error)
+    }
+}
+
+func TestGzipEncodedSegmentIsDecoded(t *testing.T) {
+    var encoded bytes.Buffer
+    zw := gzip.NewWriter(&encoded)
+    zw.Write(testSegment)
+    zw.Close()
+
+    header := http.Header {}
+    header.Set("Content-Encoding", "gzip")
+    res := runTestTask(t, testResponses(encoded.Bytes(), header), nil)
+    if !res.Success() || len(res.SegmentFiles) != 1 {
+        t.Fatalf("Download failed: %v, segment files: %v", res.Error, res.SegmentFiles)
+    }
+    stored, err := os.ReadFile(res.SegmentFiles[0])
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !bytes.Equal(stored, testSegment) {
+        t.Errorf("Stored segment is %q instead of the decoded %q", stored, testSegment)
+    }
+}
+
+// a two segment stream where the second segment is forbidden
+func forbiddenSecondSegment() http.RoundTripper {
+    return roundTripFunc(func(req *http.Request) (*http.Response, error) {
+        resp := &http.Response {
+            StatusCode: 200,
+            Header:     http.Header {},
+            Body:       io.NopCloser(bytes.NewReader(testSegment)),
+            Request:    req,
+        }
+        if req.URL.Query().Get("sq") == "1" {
+            resp.StatusCode = 403
+            resp.Status = "403 Forbidden"
+            resp.Body = io.NopCloser(bytes.NewReader(nil))
+        }
+        resp.Header.Set("X-Head-Seqnum", "2")
+        return resp, nil
+    })
+}
+
+func TestForbiddenSegmentsReportExpiredURL(t *testing.T) {
+    res := runTestTask(t, forbiddenSecondSegment(), nil)
+    if !errors.Is(res.Error, ErrURLExpired) {
+        t.Fatalf("Expected an expired URL error, got %v", res.Error)
+    }
+    if !errors.Is(res.Error, ErrPartial) || res.Failed() {
+        t.Errorf("Download should be partial, got %v", res.Error)
+    }
+    if len(res.LostSegments) != 1 || res.LostSegments[0] != 1 {
+        t.Errorf("Expected segment 1 to be lost, lost segments: %v", res.LostSegments)
+    }
+}
+
+func TestFailedURLRefreshReportsExpiredURL(t *testing.T) {
+    res := runTestTask(t, forbiddenSecondSegment(), func(task *DownloadTask) {
+        //already expired, so the first 403 asks for a new URL
+        task.Url = strings.Replace(testURL, "expire=9999999999", "expire=1000000000", 1)
+        task.OnURLExpired = func(oldUrl string) (string, error) {
+            return "", fmt.Errorf("No new URL")
+        }
+    })
+    if !errors.Is(res.Error, ErrURLExpired) {
+        t.Fatalf("Expected an expired URL error, got %v", res.Error)
+    }
+    if !strings.Contains(res.Error.Error(), "Unable to refresh URL") {
+        t.Errorf("Error doesn't mention the failed refresh: %v", res.Error)
+    }
+}
@@ -0,0 +1,63 @@
+package download
+
+import (
+    "fmt"
+    "io"
+    "io/ioutil"
+    "net/http"
+
+    "github.com/HoloArchivists/ytarchive-raw-go/download/segments"
+    "github.com/HoloArchivists/ytarchive-raw-go/merge"
+)
+
+// plans the download of segmentCount segments without downloading them:
+// resolves the queue mode and requests the first and last segments, to check
+// the URL works and estimate the total size
+func (d *DownloadTask) dryRun(segmentCount int) {
+    if d.Merger != nil {
+        merge.MergeNothing(d.Merger)
+    }
+    status := segments.Create(segmentCount, int(d.Threads), d.QueueMode, d.RequeueDelay)
+    d.result.QueueMode = status.Mode()
+
+    probes := []int { 0 }
+    if segmentCount > 1 {
+        probes = append(probes, segmentCount - 1)
+    }
+    var total int64
+    for _, seg := range probes {
+        size, err := d.probeSegment(seg)
+        if err != nil {
+            d.result.Error = fmt.Errorf("Unable to download segment %d: %v", int(d.StartSegment) + seg, err)
+            return
+        }
+        total += size
+    }
+    d.result.EstimatedBytes = total / int64(len(probes)) * int64(segmentCount)
+
+    d.logger().Infof(
+        "Dry run: %d segment(s) in %v queue mode, about %.1f MiB",
+        segmentCount,
+        d.result.QueueMode,
+        float64(d.result.EstimatedBytes) / (1 << 20),
+    )
+}
+
+// returns the size of a segment in the range, reading it if the response
+// doesn't say
+func (d *DownloadTask) probeSegment(segment int) (int64, error) {
+    parsedUrl, _ := d.currentURL()
+    resp, err := d.client().GetRequester().Get(parsedUrl.SegmentURL(d.StartSegment + uint(segment), d.QueryParams))
+    if err != nil {
+        return 0, err
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode != http.StatusOK {
+        return 0, fmt.Errorf("Unexpected response status: %s", resp.Status)
+    }
+    if resp.ContentLength >= 0 {
+        return resp.ContentLength, nil
+    }
+    return io.Copy(ioutil.Discard, resp.Body)
+}
@@ -0,0 +1,70 @@
+package download
+
+import (
+    "errors"
+    "fmt"
+    "runtime"
+    "syscall"
+)
+
+// Categories of DownloadResult.Error, for use with errors.Is. The error
+// itself is a *DownloadError, which also unwraps to the cause.
+var (
+    // an option of the task is missing or invalid, eg no SegmentDir
+    ErrInvalidOption = fmt.Errorf("Invalid option")
+    // the URL is malformed or not a fragment URL
+    ErrInvalidURL    = fmt.Errorf("Invalid URL")
+    // the server refused the URL, most likely because it expired
+    ErrURLExpired    = fmt.Errorf("URL expired or forbidden")
+    // requests failed without a response
+    ErrNetwork       = fmt.Errorf("Network error")
+    // segments couldn't be written because the disk is full, the download
+    // is stopped as soon as it happens
+    ErrDiskFull      = fmt.Errorf("Disk full")
+)
+
+// A failure of one of the Err* categories, caused by Err.
+type DownloadError struct {
+    Kind error
+    Err  error
+}
+
+func (e *DownloadError) Error() string {
+    return fmt.Sprintf("%v: %v", e.Kind, e.Err)
+}
+
+func (e *DownloadError) Unwrap() error {
+    return e.Err
+}
+
+func (e *DownloadError) Is(target error) bool {
+    return target == e.Kind
+}
+
+func isDiskFull(err error) bool {
+    if errors.Is(err, syscall.ENOSPC) {
+        return true
+    }
+    //ERROR_HANDLE_DISK_FULL and ERROR_DISK_FULL
+    var errno syscall.Errno
+    return runtime.GOOS == "windows" && errors.As(err, &errno) && (errno == 39 || errno == 112)
+}
+
+// stops the download if a segment couldn't be saved because the disk is
+// full, as every other segment would fail the same way
+func (d *DownloadTask) checkDiskFull(err error) {
+    if !isDiskFull(err) {
+        return
+    }
+    d.resultMu.Lock()
+    abort := d.abortErr == nil
+    if abort {
+        d.abortErr = &DownloadError { Kind: ErrDiskFull, Err: err }
+    }
+    d.resultMu.Unlock()
+
+    if abort {
+        d.logger().Errorf("Disk full, aborting download: %v", err)
+        d.Stop()
+    }
+}
@@ -0,0 +1,62 @@
+package download
+
+import (
+    "sync"
+)
+
+type EventType int
+const (
+    // a segment was downloaded, or found already downloaded
+    EventSegmentDone EventType = iota
+    // a segment was given up on
+    EventSegmentLost
+    // the merger took a segment, all segments before it have been merged
+    EventSegmentMerged
+)
+
+type ProgressEvent struct {
+    Type    EventType
+    Segment int
+    // for EventSegmentDone, whether the segment was already downloaded
+    Cached  bool
+}
+
+// sends events to DownloadTask.Events without ever blocking the download
+type eventSender struct {
+    mu      sync.Mutex
+    ch      chan<- ProgressEvent
+    closed  bool
+    dropped int
+}
+
+func (e *eventSender) send(ev ProgressEvent) {
+    if e == nil {
+        return
+    }
+    e.mu.Lock()
+    defer e.mu.Unlock()
+
+    if e.closed {
+        return
+    }
+    select {
+    case e.ch <- ev:
+    default:
+        e.dropped++
+    }
+}
+
+// closes the channel, returns how many events were dropped
+func (e *eventSender) close() int {
+    if e == nil {
+        return 0
+    }
+    e.mu.Lock()
+    defer e.mu.Unlock()
+
+    if !e.closed {
+        e.closed = true
+        close(e.ch)
+    }
+    return e.dropped
+}
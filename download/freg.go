@@ -0,0 +1,33 @@
+package download
+
+import (
+    "github.com/HoloArchivists/ytarchive-raw-go/log"
+    "github.com/HoloArchivists/ytarchive-raw-go/util"
+)
+
+// Creates a task for the best audio and one for the best video format of an
+// info json (see util.LoadFregJson), preferring the given itags if not nil.
+// A track without URLs gets a nil task. setup is called with each task and
+// its track ("audio" or "video") to fill in the rest of the settings, such
+// as Merger and SegmentDir, before the task is started.
+func TasksFromFreg(freg *util.FregJson, preferredAudio, preferredVideo []int, setup func(task *DownloadTask, track string)) (audio, video *DownloadTask) {
+    if len(freg.Audio) > 0 {
+        audio = &DownloadTask {
+            Logger: log.New("download.audio"),
+            Url:    freg.BestAudio(preferredAudio),
+        }
+        if setup != nil {
+            setup(audio, "audio")
+        }
+    }
+    if len(freg.Video) > 0 {
+        video = &DownloadTask {
+            Logger: log.New("download.video"),
+            Url:    freg.BestVideo(preferredVideo),
+        }
+        if setup != nil {
+            setup(video, "video")
+        }
+    }
+    return audio, video
+}
@@ -0,0 +1,77 @@
+package download
+
+import (
+    "time"
+
+    "github.com/HoloArchivists/ytarchive-raw-go/util"
+)
+
+// Details about a single attempt at downloading a segment, passed to
+// DownloadTask.OnSegment.
+type SegmentMetrics struct {
+    Segment    int
+    // the host that served the segment, after following redirects. empty
+    // if the request didn't get a response.
+    Host       string
+    // 0 if the request didn't get a response
+    StatusCode int
+    // bytes written to the segment file
+    Bytes      int64
+    // only detected with VerifyMedia
+    Container  util.Container
+    Duration   time.Duration
+    Ok         bool
+    Error      error
+}
+
+// Receives the state of a download for monitoring, see the
+// download/prometheus package for an implementation. Methods are called
+// from the download's goroutines, without any locks held.
+type MetricsSink interface {
+    // the segment count is known, or changed (live streams)
+    SetTotalSegments(n int)
+    // called after each attempt at downloading a segment
+    SegmentAttempt(m SegmentMetrics)
+    SegmentLost()
+    // a download thread started (1) or finished (-1)
+    ThreadActive(delta int)
+}
+
+func (d *DownloadTask) setTotalMetric(n int) {
+    if d.Metrics != nil {
+        d.Metrics.SetTotalSegments(n)
+    }
+}
+
+// counts the segment in DownloadResult.HostCounts or HostFailures
+func (d *DownloadTask) countHost(m *SegmentMetrics) {
+    if m.Host == "" {
+        return
+    }
+    d.resultMu.Lock()
+    defer d.resultMu.Unlock()
+
+    counts := &d.result.HostCounts
+    if !m.Ok {
+        counts = &d.result.HostFailures
+    }
+    if *counts == nil {
+        *counts = make(map[string]int)
+    }
+    (*counts)[m.Host]++
+}
+
+// counts an attempt at a segment in DownloadResult.SegmentAttempts. a
+// successful attempt is only counted after failed ones.
+func (d *DownloadTask) countAttempt(segment int, ok bool) {
+    d.resultMu.Lock()
+    defer d.resultMu.Unlock()
+
+    if ok && d.result.SegmentAttempts[segment] == 0 {
+        return
+    }
+    if d.result.SegmentAttempts == nil {
+        d.result.SegmentAttempts = make(map[int]int)
+    }
+    d.result.SegmentAttempts[segment]++
+}
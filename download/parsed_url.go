@@ -3,6 +3,7 @@ package download
 import (
     "fmt"
     "net/url"
+    "sort"
     "strconv"
     "strings"
     "time"
@@ -16,11 +17,35 @@ const (
 )
 
 type parsedURL struct {
-    raw     string
-    expire  *time.Time
-    id      string
-    itag    int
-    typ     urlType
+    raw       string
+    expire    *time.Time
+    host      string
+    id        string
+    itag      int
+    // the URL had no sq parameter for the segment number, one was added
+    missingSq bool
+    typ       urlType
+}
+
+// checks that the URL is absolute, so a malformed one is caught before any
+// request is made
+func validateURL(rawUrl string) error {
+    parsed, err := url.Parse(rawUrl)
+    if err != nil {
+        return fmt.Errorf("Malformed URL: %v", err)
+    }
+    if parsed.Scheme != "http" && parsed.Scheme != "https" {
+        return fmt.Errorf("URL scheme must be http or https, got '%s'", parsed.Scheme)
+    }
+    if parsed.Hostname() == "" {
+        return fmt.Errorf("URL '%s' has no host", rawUrl)
+    }
+    return nil
+}
+
+func isGoogleVideoHost(host string) bool {
+    host = strings.ToLower(host)
+    return host == "googlevideo.com" || strings.HasSuffix(host, ".googlevideo.com")
 }
 
 func parseDownloadURL(rawUrl string) (*parsedURL, error) {
@@ -35,12 +60,14 @@ func parseDownloadURL(rawUrl string) (*parsedURL, error) {
     }
 
     p := &parsedURL {
-        raw: rawUrl,
-        typ: urlTypeInvalid,
+        raw:  rawUrl,
+        host: parsed.Hostname(),
+        typ:  urlTypeInvalid,
     }
     var findField func(string) string
     if query.Get("noclen") != "" {
         p.typ = urlTypeQuery
+        p.missingSq = !query.Has("sq")
         findField = query.Get
     } else if strings.HasPrefix(parsed.EscapedPath(), "/videoplayback/") {
         if strings.HasSuffix(p.raw, "/") {
@@ -80,6 +107,7 @@ func parseDownloadURL(rawUrl string) (*parsedURL, error) {
             }
         } else {
             p.raw = p.raw + "/sq"
+            p.missingSq = true
         }
     }
 
@@ -118,7 +146,10 @@ func parseDownloadURL(rawUrl string) (*parsedURL, error) {
     return p, nil
 }
 
-func (p *parsedURL) SegmentURL(seg uint) string {
+// the URL of a segment, with the parameters of extra set on it (see
+// DownloadTask.QueryParams). a parameter of extra replaces the one with the
+// same key in the URL, except for sq which is always the segment number.
+func (p *parsedURL) SegmentURL(seg uint, extra url.Values) string {
     switch(p.typ) {
     case urlTypeQuery:
         url, err := url.Parse(p.raw)
@@ -127,14 +158,65 @@ func (p *parsedURL) SegmentURL(seg uint) string {
         }
 
         q := url.Query()
+        for key, values := range extra {
+            q[key] = values
+        }
         q.Set("sq", fmt.Sprintf("%d", seg))
         url.RawQuery = q.Encode()
 
         return url.String()
     case urlTypePath:
-        return fmt.Sprintf("%s/%d", p.raw, seg)
+        raw := p.raw
+        if len(extra) > 0 {
+            raw = setPathParams(raw, extra)
+        }
+        return fmt.Sprintf("%s/%d", raw, seg)
     default:
         panic("unreachable")
     }
 }
 
+// sets the parameters of extra on a path style URL, ending in /sq. path
+// parameters have a single value, so only the first value of each key is
+// used. keys not in the URL yet are added before sq.
+func setPathParams(raw string, extra url.Values) string {
+    parsed, err := url.Parse(raw)
+    if err != nil {
+        panic(fmt.Sprintf("unreachable, %v", err))
+    }
+    //videoplayback, the key/value pairs, then sq
+    fields := strings.Split(strings.Trim(parsed.EscapedPath(), "/"), "/")
+
+    keys := make([]string, 0, len(extra))
+    for key := range extra {
+        keys = append(keys, key)
+    }
+    //so segment URLs are the same on every call
+    sort.Strings(keys)
+    for _, key := range keys {
+        if key == "sq" {
+            continue
+        }
+        escapedKey := url.PathEscape(key)
+        value := url.PathEscape(extra.Get(key))
+        found := false
+        for i := 1; i + 1 < len(fields) - 1; i += 2 {
+            if fields[i] == escapedKey {
+                fields[i + 1] = value
+                found = true
+                break
+            }
+        }
+        if !found {
+            last := len(fields) - 1
+            fields = append(fields[:last], escapedKey, value, fields[last])
+        }
+    }
+
+    parsed.RawPath = "/" + strings.Join(fields, "/")
+    if parsed.Path, err = url.PathUnescape(parsed.RawPath); err != nil {
+        panic(fmt.Sprintf("unreachable, %v", err))
+    }
+    return parsed.String()
+}
+
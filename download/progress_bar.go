@@ -3,6 +3,7 @@ package download
 import (
     "fmt"
     "math"
+    "strings"
     "sync"
     "time"
 
@@ -17,13 +18,67 @@ const (
     colorYellow  = "\033[93m"
 )
 
+// how many segments are used to estimate the average segment size for
+// byte based progress
+const byteEstimateSegments = 20
+
+// how often the progress is redrawn while it's indeterminate (during setup
+// or on a live stream), to animate the spinner
+const spinnerInterval = 250 * time.Millisecond
+const spinnerFrames = `|/-\`
+
+// How the bar in front of the progress percentage is drawn, see
+// TotalProgress.SetBarStyle.
+type BarStyle struct {
+    // characters between the edges, 0 to only show the percentage
+    Width int
+    Fill  string
+    Empty string
+    Left  string
+    Right string
+}
+
+var (
+    // only the percentage, the default
+    NoBar      = BarStyle {}
+    // for terminals without good unicode support
+    ASCIIBar   = BarStyle { Width: 20, Fill: "#", Empty: "-", Left: "[", Right: "]" }
+    UnicodeBar = BarStyle { Width: 20, Fill: "█", Empty: "░", Left: "▕", Right: "▏" }
+)
+
+// the bar for a fraction between 0 and 1, followed by a space. empty
+// without a bar.
+func (s BarStyle) render(fraction float64) string {
+    if s.Width <= 0 {
+        return ""
+    }
+    filled := int(math.Round(fraction * float64(s.Width)))
+    if filled < 0 {
+        filled = 0
+    } else if filled > s.Width {
+        filled = s.Width
+    }
+    return s.Left + strings.Repeat(s.Fill, filled) + strings.Repeat(s.Empty, s.Width - filled) + s.Right + " "
+}
+
 type Progress struct {
     parent     *TotalProgress
     cached     int
     downloaded int
     failed     int
     total      int
+    live       bool
+    // byte based progress, see setByteMode
+    byteMode   bool
+    bytes      int64
+    // size of the first byteEstimateSegments segments
+    sampled    int
+    sampledSum int64
     requeues   map[int]struct{}
+    // when the task started fetching the segment count, zero once done
+    setupStart time.Time
+    spinning   bool
+    spinnerPos int
     start      time.Time
     end        time.Time
     expire     *time.Time
@@ -34,11 +89,134 @@ func (p *Progress) init(totalSegments int, expire *time.Time) {
     defer p.parent.mu.Unlock()
 
     p.total = totalSegments
+    p.setupStart = time.Time {}
     p.start = time.Now()
     p.expire = expire
     p.updated()
 }
 
+// shows a spinner with the elapsed time until init is called, so the
+// download doesn't look stuck while the segment count is fetched
+func (p *Progress) setup() {
+    p.parent.mu.Lock()
+    defer p.parent.mu.Unlock()
+
+    p.setupStart = time.Now()
+    p.updated()
+    p.startSpinner()
+}
+
+// stops the setup spinner if init was never called, eg because fetching
+// the segment count failed
+func (p *Progress) endSetup() {
+    p.parent.mu.Lock()
+    defer p.parent.mu.Unlock()
+
+    if p.setupStart.IsZero() {
+        return
+    }
+    p.setupStart = time.Time {}
+    p.updated()
+}
+
+//NOT thread safe, should NOT acquire locks
+func (p *Progress) indeterminate() bool {
+    return p.live || (p.total == -1 && !p.setupStart.IsZero())
+}
+
+//NOT thread safe, should NOT acquire locks
+//redraws the progress regularly for as long as it's indeterminate. only
+//done for text logs, in JSON each redraw would be another record.
+func (p *Progress) startSpinner() {
+    if p.spinning || log.CurrentFormat() != log.FormatText {
+        return
+    }
+    p.spinning = true
+    go func() {
+        ticker := time.NewTicker(spinnerInterval)
+        defer ticker.Stop()
+        for range ticker.C {
+            p.parent.mu.Lock()
+            if !p.indeterminate() {
+                p.spinning = false
+                p.parent.mu.Unlock()
+                return
+            }
+            p.spinnerPos = (p.spinnerPos + 1) % len(spinnerFrames)
+            p.updated()
+            p.parent.mu.Unlock()
+        }
+    }()
+}
+
+//NOT thread safe, should NOT acquire locks
+func (p *Progress) spinner() byte {
+    return spinnerFrames[p.spinnerPos]
+}
+
+// the URL was replaced with one expiring at a different time
+func (p *Progress) setExpire(expire *time.Time) {
+    p.parent.mu.Lock()
+    defer p.parent.mu.Unlock()
+
+    p.expire = expire
+    p.updated()
+}
+
+func (p *Progress) setLive() {
+    p.parent.mu.Lock()
+    defer p.parent.mu.Unlock()
+
+    p.live = true
+    p.updated()
+    p.startSpinner()
+}
+
+// bases the progress percentage on the downloaded bytes instead of the
+// segment count, once enough segments are done to estimate the total size
+// from their average size. segments vary a lot in size, so this is smoother
+// than counting them.
+func (p *Progress) setByteMode() {
+    p.parent.mu.Lock()
+    defer p.parent.mu.Unlock()
+
+    p.byteMode = true
+}
+
+// a segment of n bytes was downloaded or found already downloaded. must be
+// called before done for that segment.
+func (p *Progress) addBytes(n int64) {
+    p.parent.mu.Lock()
+    defer p.parent.mu.Unlock()
+
+    p.bytes += n
+    if p.sampled < byteEstimateSegments {
+        p.sampled++
+        p.sampledSum += n
+    }
+}
+
+// new segments are available on a live stream
+func (p *Progress) grow(totalSegments int) {
+    p.parent.mu.Lock()
+    defer p.parent.mu.Unlock()
+
+    if totalSegments > p.total {
+        p.total = totalSegments
+    }
+    p.updated()
+}
+
+// a live stream ended, the total is final from now on
+func (p *Progress) liveEnded(totalSegments int) {
+    p.parent.mu.Lock()
+    defer p.parent.mu.Unlock()
+
+    p.live = false
+    p.total = totalSegments
+    p.updated()
+}
+
 func (p *Progress) lost() {
     p.parent.mu.Lock()
     defer p.parent.mu.Unlock()
@@ -71,23 +249,66 @@ func (p *Progress) done(segment int, cached bool) {
 }
 
 func (p *Progress) updated() {
-    if p.cached + p.downloaded + p.failed == p.total {
+    finished := !p.live && p.cached + p.downloaded + p.failed == p.total
+    if finished {
         p.end = time.Now()
     }
 
     //we hold the lock, safe to call
-    p.parent.printProgress()
+    p.parent.update(finished)
 }
 
 //NOT thread safe, should NOT acquire locks
 func (p *Progress) pct() float64 {
+    return p.fraction() * 100
+}
+
+//NOT thread safe, should NOT acquire locks
+//estimated size of a segment, 0 if unknown
+func (p *Progress) averageSegmentBytes() int64 {
+    if !p.byteMode || p.sampled < byteEstimateSegments {
+        return 0
+    }
+    return p.sampledSum / int64(p.sampled)
+}
+
+//NOT thread safe, should NOT acquire locks
+func (p *Progress) fraction() float64 {
     finished := p.cached + p.downloaded + p.failed
-    return float64(finished) / float64(p.total) * 100
+    if finished == p.total {
+        return 1
+    }
+    avg := p.averageSegmentBytes()
+    if avg == 0 {
+        return float64(finished) / float64(p.total)
+    }
+    //lost segments count as average sized, so they don't stall the progress
+    done := float64(p.bytes) + float64(p.failed) * float64(avg)
+    //the estimate can be too low, don't show 100% before it's done
+    return math.Min(done / (float64(avg) * float64(p.total)), 0.9999)
+}
+
+//NOT thread safe, should NOT acquire locks
+func (p *Progress) bytesString() string {
+    avg := p.averageSegmentBytes()
+    if avg == 0 {
+        return ""
+    }
+    return fmt.Sprintf(", %s/~%s", formatBytes(p.bytes), formatBytes(avg * int64(p.total)))
 }
 
 //NOT thread safe, should NOT acquire locks
 func (p *Progress) fmt() string {
     if p.total == -1 {
+        if !p.setupStart.IsZero() {
+            return fmt.Sprintf(
+                "%s%c fetching segment count (%v)%s",
+                colorYellow,
+                p.spinner(),
+                time.Since(p.setupStart).Round(time.Second),
+                colorReset,
+            )
+        }
         return fmt.Sprintf("%s0%% (0/???, not started yet)%s", colorYellow, colorReset)
     }
 
@@ -107,6 +328,20 @@ func (p *Progress) fmt() string {
         return fmt.Sprintf(", %srequeued %d%s", colorMagenta, len(p.requeues), color)
     }
 
+    if p.live {
+        return fmt.Sprintf(
+            "%s%c %d/%d%s%s, live for %v%s",
+            colorYellow,
+            p.spinner(),
+            successful,
+            p.total,
+            requeuedString(colorYellow),
+            lostString(colorYellow),
+            time.Since(p.start).Round(time.Second),
+            colorReset,
+        )
+    }
+
     if finished == p.total {
         color := colorGreen
         if p.failed > 0 {
@@ -123,7 +358,7 @@ func (p *Progress) fmt() string {
         )
     }
 
-    progress := float64(finished) / float64(p.total)
+    progress := p.fraction()
 
     //don't include eta without downloading a bit
     if p.downloaded > 100 {
@@ -138,11 +373,13 @@ func (p *Progress) fmt() string {
             color = colorRed
         }
         return fmt.Sprintf(
-            "%s%.2f%% (%d/%d%s%s, eta %s)%s",
+            "%s%s%.2f%% (%d/%d%s%s%s, eta %s)%s",
             color,
+            p.parent.bar.render(progress),
             progress * 100,
             successful,
             p.total,
+            p.bytesString(),
             requeuedString(color),
             lostString(color),
             formatDuration(eta),
@@ -150,11 +387,13 @@ func (p *Progress) fmt() string {
         )
     } else {
         return fmt.Sprintf(
-            "%s%.2f%% (%d/%d%s%s, eta unknown)%s",
+            "%s%s%.2f%% (%d/%d%s%s%s, eta unknown)%s",
             colorYellow,
+            p.parent.bar.render(progress),
             progress * 100,
             successful,
             p.total,
+            p.bytesString(),
             requeuedString(colorYellow),
             lostString(colorYellow),
             colorReset,
@@ -163,9 +402,15 @@ func (p *Progress) fmt() string {
 }
 
 type TotalProgress struct {
-    mu      sync.Mutex
-    audio   *Progress
-    video   *Progress
+    mu        sync.Mutex
+    audio     *Progress
+    video     *Progress
+    // see SetInterval
+    interval  time.Duration
+    lastPrint time.Time
+    // a print was skipped and is scheduled for the end of the interval
+    pending   bool
+    bar       BarStyle
 }
 
 func NewProgress() *TotalProgress {
@@ -191,8 +436,53 @@ func (p *TotalProgress) Video() *Progress {
     return p.video
 }
 
+// Limits how often the progress is redrawn, coalescing the updates in
+// between: with many threads, segments finish many times per second. The
+// latest progress is still shown at the end of each interval, and right
+// away once a download finishes. 0, the default, redraws on every update.
+func (p *TotalProgress) SetInterval(interval time.Duration) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+
+    p.interval = interval
+}
+
+// Sets how the progress bar is drawn, NoBar by default.
+func (p *TotalProgress) SetBarStyle(style BarStyle) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+
+    p.bar = style
+}
+
+//NOT thread safe, should NOT acquire locks
+func (p *TotalProgress) update(force bool) {
+    if p.interval <= 0 || force {
+        p.printProgress()
+        return
+    }
+    wait := p.interval - time.Since(p.lastPrint)
+    if wait <= 0 {
+        p.printProgress()
+        return
+    }
+    if p.pending {
+        return
+    }
+    p.pending = true
+    time.AfterFunc(wait, func() {
+        p.mu.Lock()
+        defer p.mu.Unlock()
+        if p.pending {
+            p.printProgress()
+        }
+    })
+}
+
 //NOT thread safe, should NOT acquire locks
 func (p *TotalProgress) printProgress() {
+    p.lastPrint = time.Now()
+    p.pending = false
     log.Progress(log.ProgressAudioDownload, fmt.Sprintf("%.1f%%", p.audio.pct()), p.audio.fmt())
     log.Progress(log.ProgressVideoDownload, fmt.Sprintf("%.1f%%", p.video.pct()), p.video.fmt())
 }
@@ -213,6 +503,19 @@ func formatDuration(d time.Duration) string {
     }
 }
 
+func formatBytes(n int64) string {
+    const unit = 1024
+    if n < unit {
+        return fmt.Sprintf("%dB", n)
+    }
+    div, exp := int64(unit), 0
+    for v := n / unit; v >= unit; v /= unit {
+        div *= unit
+        exp++
+    }
+    return fmt.Sprintf("%.1f%ciB", float64(n) / float64(div), "KMGTPE"[exp])
+}
+
 func significantFigures(v float64, n int) float64 {
     exp := math.Pow(10, math.Floor(math.Log10(math.Abs(v))) - float64(n - 1))
     return exp * math.Round(v / exp)
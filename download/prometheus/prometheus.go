@@ -0,0 +1,91 @@
+//go:build prometheus
+
+// Exposes download metrics to Prometheus. Kept behind the prometheus build
+// tag so the rest of the program doesn't depend on the client library:
+// add it with `go get github.com/prometheus/client_golang` and build with
+// `-tags prometheus`.
+package prometheus
+
+import (
+    "strconv"
+
+    "github.com/prometheus/client_golang/prometheus"
+
+    "github.com/HoloArchivists/ytarchive-raw-go/download"
+)
+
+// Implements download.MetricsSink. All tasks sharing a Sink add up to the
+// same metrics.
+type Sink struct {
+    bytes      prometheus.Counter
+    downloaded prometheus.Counter
+    lost       prometheus.Counter
+    requests   *prometheus.CounterVec
+    threads    prometheus.Gauge
+    total      prometheus.Gauge
+}
+
+var _ download.MetricsSink = (*Sink)(nil)
+
+// Creates the metrics and registers them to reg, prometheus.DefaultRegisterer
+// if nil.
+func NewSink(reg prometheus.Registerer) (*Sink, error) {
+    if reg == nil {
+        reg = prometheus.DefaultRegisterer
+    }
+    s := &Sink {
+        bytes: prometheus.NewCounter(prometheus.CounterOpts {
+            Name: "ytarchive_raw_downloaded_bytes_total",
+            Help: "Bytes of segment data downloaded.",
+        }),
+        downloaded: prometheus.NewCounter(prometheus.CounterOpts {
+            Name: "ytarchive_raw_segments_downloaded_total",
+            Help: "Segments downloaded successfully.",
+        }),
+        lost: prometheus.NewCounter(prometheus.CounterOpts {
+            Name: "ytarchive_raw_segments_lost_total",
+            Help: "Segments given up on.",
+        }),
+        requests: prometheus.NewCounterVec(prometheus.CounterOpts {
+            Name: "ytarchive_raw_requests_total",
+            Help: "Segment requests by HTTP status code, 0 if no response was received.",
+        }, []string{"code"}),
+        threads: prometheus.NewGauge(prometheus.GaugeOpts {
+            Name: "ytarchive_raw_active_threads",
+            Help: "Download threads currently running.",
+        }),
+        total: prometheus.NewGauge(prometheus.GaugeOpts {
+            Name: "ytarchive_raw_segments",
+            Help: "Total segment count of the download.",
+        }),
+    }
+    collectors := []prometheus.Collector {
+        s.bytes, s.downloaded, s.lost, s.requests, s.threads, s.total,
+    }
+    for _, c := range collectors {
+        if err := reg.Register(c); err != nil {
+            return nil, err
+        }
+    }
+    return s, nil
+}
+
+func (s *Sink) SetTotalSegments(n int) {
+    s.total.Set(float64(n))
+}
+
+func (s *Sink) SegmentAttempt(m download.SegmentMetrics) {
+    s.requests.WithLabelValues(strconv.Itoa(m.StatusCode)).Inc()
+    s.bytes.Add(float64(m.Bytes))
+    if m.Ok {
+        s.downloaded.Inc()
+    }
+}
+
+func (s *Sink) SegmentLost() {
+    s.lost.Inc()
+}
+
+func (s *Sink) ThreadActive(delta int) {
+    s.threads.Add(float64(delta))
+}
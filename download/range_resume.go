@@ -0,0 +1,86 @@
+package download
+
+import (
+    "fmt"
+    "io"
+    "net/http"
+    "strconv"
+    "strings"
+
+    "github.com/HoloArchivists/ytarchive-raw-go/download/segments"
+    "github.com/HoloArchivists/ytarchive-raw-go/util"
+)
+
+// how many times reading a segment body is resumed with a range request
+// within one attempt, before it counts as failed
+const maxRangeResumes = 3
+
+// reads a segment response body, continuing with a range request from where
+// it stopped if reading fails. used with DownloadTask.RangeResume.
+type resumingReader struct {
+    task      *DownloadTask
+    requester *util.HttpRequester
+    status    *segments.SegmentStatus
+    req       *http.Request
+    segment   int
+    body      io.ReadCloser
+    read      int64
+    resumes   int
+}
+
+func (r *resumingReader) Read(p []byte) (int, error) {
+    n, err := r.body.Read(p)
+    r.read += int64(n)
+    if err == nil || err == io.EOF || r.resumes >= maxRangeResumes {
+        return n, err
+    }
+    if resumeErr := r.resume(); resumeErr != nil {
+        r.task.logger().Debugf("Unable to resume segment %d at byte %d: %v", r.segment, r.read, resumeErr)
+        return n, err
+    }
+    return n, nil
+}
+
+func (r *resumingReader) Close() error {
+    return r.body.Close()
+}
+
+// requests the rest of the body. a server ignoring the range fails the
+// resume, so the segment is downloaded again from the start.
+func (r *resumingReader) resume() error {
+    r.resumes++
+    r.task.logger().Debugf("Resuming segment %d at byte %d", r.segment, r.read)
+
+    req := r.req.Clone(r.req.Context())
+    req.Header.Set("Range", fmt.Sprintf("bytes=%d-", r.read))
+    resp, err := doRequest(r.task, r.requester, r.status, req)
+    if err != nil {
+        return err
+    }
+    if resp.StatusCode != http.StatusPartialContent {
+        resp.Body.Close()
+        return fmt.Errorf("Range not supported, status code %d", resp.StatusCode)
+    }
+    start, err := contentRangeStart(resp.Header.Get("Content-Range"))
+    if err != nil || start != r.read {
+        resp.Body.Close()
+        return fmt.Errorf("Unexpected Content-Range '%s'", resp.Header.Get("Content-Range"))
+    }
+
+    r.body.Close()
+    r.body = resp.Body
+    return nil
+}
+
+// parses the first byte of a "bytes start-end/size" Content-Range
+func contentRangeStart(header string) (int64, error) {
+    rng := strings.TrimPrefix(header, "bytes ")
+    if rng == header {
+        return -1, fmt.Errorf("Unsupported unit")
+    }
+    idx := strings.IndexByte(rng, '-')
+    if idx < 0 {
+        return -1, fmt.Errorf("Missing range end")
+    }
+    return strconv.ParseInt(rng[:idx], 10, 64)
+}
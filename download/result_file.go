@@ -0,0 +1,118 @@
+package download
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "os"
+    "path/filepath"
+)
+
+// Version of the ResultFile format, increased on incompatible changes.
+// Fields may be added without changing it.
+const ResultFileVersion = 1
+
+// inclusive, like segments.Range
+type resultRange struct {
+    Start int `json:"start"`
+    End   int `json:"end"`
+}
+
+type resultFile struct {
+    Version             int            `json:"version"`
+    Success             bool           `json:"success"`
+    Partial             bool           `json:"partial"`
+    Error               string         `json:"error,omitempty"`
+    Complete            bool           `json:"complete"`
+    IncompleteReason    string         `json:"incomplete_reason,omitempty"`
+    TotalSegments       int            `json:"total_segments"`
+    LostSegments        []int          `json:"lost_segments"`
+    LostRanges          []resultRange  `json:"lost_ranges"`
+    FailedSegments      []int          `json:"failed_segments"`
+    UnattemptedSegments []int          `json:"unattempted_segments"`
+    FailedAttempts      uint           `json:"failed_attempts"`
+    TotalBytes          int64          `json:"total_bytes"`
+    StoredBytes         int64          `json:"stored_bytes,omitempty"`
+    EstimatedBytes      int64          `json:"estimated_bytes,omitempty"`
+    ElapsedSeconds      float64        `json:"elapsed_seconds"`
+    QueueMode           string         `json:"queue_mode"`
+    HostCounts          map[string]int `json:"host_counts,omitempty"`
+    HostFailures        map[string]int `json:"host_failures,omitempty"`
+    SegmentAttempts     map[int]int    `json:"segment_attempts,omitempty"`
+    SegmentFiles        []string       `json:"segment_files,omitempty"`
+}
+
+// writes the result to ResultFile, if set. the file is replaced atomically,
+// so readers never see a partial one.
+func (d *DownloadTask) writeResultFile() {
+    if d.ResultFile == "" {
+        return
+    }
+    r := &d.result
+    out := resultFile {
+        Version:             ResultFileVersion,
+        Success:             r.Success(),
+        Partial:             errors.Is(r.Error, ErrPartial),
+        TotalSegments:       r.TotalSegments,
+        LostSegments:        r.LostSegments,
+        FailedSegments:      r.FailedSegments,
+        UnattemptedSegments: r.UnattemptedSegments,
+        FailedAttempts:      r.FailedAttempts,
+        TotalBytes:          r.TotalBytes,
+        StoredBytes:         r.StoredBytes,
+        EstimatedBytes:      r.EstimatedBytes,
+        ElapsedSeconds:      r.Elapsed.Seconds(),
+        QueueMode:           r.QueueMode.String(),
+        HostCounts:          r.HostCounts,
+        HostFailures:        r.HostFailures,
+        SegmentAttempts:     r.SegmentAttempts,
+        SegmentFiles:        r.SegmentFiles,
+    }
+    if r.Error != nil {
+        out.Error = r.Error.Error()
+    }
+    out.Complete, out.IncompleteReason = r.Complete()
+    //empty lists instead of null, so readers don't need to special case them
+    if out.LostSegments == nil {
+        out.LostSegments = []int {}
+    }
+    if out.FailedSegments == nil {
+        out.FailedSegments = []int {}
+    }
+    if out.UnattemptedSegments == nil {
+        out.UnattemptedSegments = []int {}
+    }
+    out.LostRanges = make([]resultRange, 0, len(r.LostRanges))
+    for _, rng := range r.LostRanges {
+        out.LostRanges = append(out.LostRanges, resultRange { Start: rng.Start, End: rng.End })
+    }
+
+    if err := writeFileAtomic(d.ResultFile, out); err != nil {
+        d.logger().Errorf("Unable to write result file: %v", err)
+    }
+}
+
+func writeFileAtomic(path string, v interface{}) error {
+    data, err := json.MarshalIndent(v, "", "  ")
+    if err != nil {
+        return err
+    }
+    tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path) + ".tmp*")
+    if err != nil {
+        return err
+    }
+    if _, err = tmp.Write(append(data, '\n')); err == nil {
+        err = tmp.Sync()
+    }
+    if closeErr := tmp.Close(); err == nil {
+        err = closeErr
+    }
+    if err == nil {
+        err = os.Rename(tmp.Name(), path)
+    }
+    if err != nil {
+        os.Remove(tmp.Name())
+        return fmt.Errorf("Unable to write '%s': %v", path, err)
+    }
+    return nil
+}
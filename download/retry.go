@@ -0,0 +1,140 @@
+package download
+
+import (
+    "context"
+    "crypto/x509"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "strings"
+    "syscall"
+    "time"
+)
+
+// Decides whether a failed request is retried, and after how long.
+type RetryPolicy interface {
+    // attempt is the number of failed attempts so far, starting at 1.
+    // statusCode is 0 if the request didn't get a response, err describes
+    // the failure.
+    ShouldRetry(attempt int, statusCode int, err error) (retry bool, delay time.Duration)
+}
+
+// Retries up to MaxAttempts attempts in total, regardless of the failure.
+// The delay starts at twice BaseDelay and doubles with each attempt, up to
+// MaxDelay.
+type DefaultRetryPolicy struct {
+    MaxAttempts uint
+    BaseDelay   time.Duration
+    MaxDelay    time.Duration
+}
+
+func (p DefaultRetryPolicy) ShouldRetry(attempt int, statusCode int, err error) (bool, time.Duration) {
+    if attempt < 1 || uint(attempt) >= p.MaxAttempts {
+        return false, 0
+    }
+    delay := p.BaseDelay
+    for i := 0; i < attempt && delay < p.MaxDelay; i++ {
+        delay *= 2
+    }
+    if delay > p.MaxDelay {
+        delay = p.MaxDelay
+    }
+    return true, delay
+}
+
+// the policy for retrying a segment, see DownloadTask.RetryPolicy
+func (d *DownloadTask) segmentRetryPolicy(last bool) RetryPolicy {
+    if d.RetryPolicy != nil {
+        return d.RetryPolicy
+    }
+    fails := d.FailThreshold
+    //the last segment often isn't available, so use less retries for it
+    if last {
+        //at least 5
+        fails = d.FailThreshold / 4
+        if fails < 5 {
+            fails = 5
+        }
+    }
+    return DefaultRetryPolicy {
+        MaxAttempts: fails,
+        BaseDelay:   d.RetryDelay,
+        MaxDelay:    4 * d.RetryDelay,
+    }
+}
+
+// the policy for retrying a request, see DownloadTask.RequestRetryPolicy
+func (d *DownloadTask) requestRetryPolicy() RetryPolicy {
+    if d.RequestRetryPolicy != nil {
+        return d.RequestRetryPolicy
+    }
+    return DefaultRetryPolicy {
+        MaxAttempts: d.RetryThreshold,
+    }
+}
+
+// Returned when a request failed without a response, after all attempts
+// at it. Unwraps to the last failure, so errors.Is and errors.As see the
+// final cause.
+type RequestError struct {
+    // the failure of each attempt, in order
+    Attempts []error
+}
+
+func (e *RequestError) Error() string {
+    if len(e.Attempts) == 1 {
+        return fmt.Sprintf("Request failed: %v", e.Attempts[0])
+    }
+    var b strings.Builder
+    fmt.Fprintf(&b, "Request failed after %d attempts: ", len(e.Attempts))
+    for i, err := range e.Attempts {
+        if i > 0 {
+            b.WriteString("; ")
+        }
+        fmt.Fprintf(&b, "%d: %v", i + 1, err)
+    }
+    return b.String()
+}
+
+func (e *RequestError) Unwrap() error {
+    if len(e.Attempts) == 0 {
+        return nil
+    }
+    return e.Attempts[len(e.Attempts) - 1]
+}
+
+// whether a request that failed without a response is worth retrying right
+// away. only transient network failures are, anything else (a cancelled
+// request, bad certificates, unknown hosts, ...) would fail the same way
+// again. the segment itself can still be retried later.
+func retryableError(err error) bool {
+    if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+        return false
+    }
+    var netErr net.Error
+    if errors.As(err, &netErr) && netErr.Timeout() {
+        return true
+    }
+    if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNABORTED) ||
+        errors.Is(err, syscall.EPIPE) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+        return true
+    }
+
+    var dnsErr *net.DNSError
+    if errors.As(err, &dnsErr) {
+        return dnsErr.IsTimeout || dnsErr.IsTemporary
+    }
+    var unknownAuthority x509.UnknownAuthorityError
+    var invalidCert x509.CertificateInvalidError
+    var hostname x509.HostnameError
+    if errors.As(err, &unknownAuthority) || errors.As(err, &invalidCert) || errors.As(err, &hostname) {
+        return false
+    }
+    if strings.Contains(err.Error(), "unsupported protocol scheme") {
+        return false
+    }
+    //other connection level failures, eg refused connections or QUIC errors
+    var opErr *net.OpError
+    return errors.As(err, &opErr)
+}
@@ -0,0 +1,42 @@
+package segments
+
+import (
+    "fmt"
+    "sort"
+)
+
+// An inclusive range of segment numbers.
+type Range struct {
+    Start int
+    End   int
+}
+
+func (r Range) String() string {
+    if r.Start == r.End {
+        return fmt.Sprintf("%d", r.Start)
+    }
+    return fmt.Sprintf("%d-%d", r.Start, r.End)
+}
+
+// Groups segment numbers into ranges of consecutive ones. The input doesn't
+// need to be sorted, duplicates are ignored.
+func Ranges(numbers []int) []Range {
+    if len(numbers) == 0 {
+        return nil
+    }
+    sorted := append([]int(nil), numbers...)
+    sort.Ints(sorted)
+
+    ranges := []Range { { Start: sorted[0], End: sorted[0] } }
+    for _, n := range sorted[1:] {
+        last := &ranges[len(ranges) - 1]
+        if n <= last.End + 1 {
+            if n > last.End {
+                last.End = n
+            }
+            continue
+        }
+        ranges = append(ranges, Range { Start: n, End: n })
+    }
+    return ranges
+}
@@ -1,6 +1,7 @@
 package segments
 
 import (
+    "fmt"
     "sync"
     "time"
 )
@@ -9,15 +10,73 @@ type QueueMode int
 const (
     QueueSequential QueueMode = iota
     QueueOutOfOrder
+    // picks one of the other modes when the status is created, see
+    // resolveQueueMode
+    QueueAuto
+    // lowest numbered segments first, retrying failed ones as soon as
+    // possible, so the output can be merged (and played) progressively
+    QueueEarliestFirst
 )
 
+// out of order mode needs at least this many segments per thread to be
+// picked by QueueAuto
+const autoMinSegmentsPerThread = 4
+
+func (m QueueMode) String() string {
+    switch m {
+    case QueueSequential:
+        return "sequential"
+    case QueueOutOfOrder:
+        return "out-of-order"
+    case QueueAuto:
+        return "auto"
+    case QueueEarliestFirst:
+        return "earliest-first"
+    default:
+        return fmt.Sprintf("QueueMode(%d)", int(m))
+    }
+}
+
+// QueueAuto uses sequential mode with a single thread, where both modes
+// behave the same, or when there are too few segments per thread for the
+// batches of out of order mode to be worth it. otherwise out of order mode
+// is used, as it spreads requests over a larger part of the stream.
+func resolveQueueMode(mode QueueMode, segmentCount int, threads int) QueueMode {
+    if mode != QueueAuto {
+        return mode
+    }
+    if threads <= 1 || segmentCount < threads * autoMinSegmentsPerThread {
+        return QueueSequential
+    }
+    return QueueOutOfOrder
+}
+
 type SegmentStatus struct {
-    mu           sync.Mutex
-    end          int
-    mergedCount  int
-    scheduler    workScheduler
-    segments     map[int]SegmentResult
-    missed       []int
+    mu            sync.Mutex
+    cond          *sync.Cond
+    end           int
+    mergedCount   int
+    onMerge       func(int)
+    scheduler     workScheduler
+    mode          QueueMode
+    segments      map[int]SegmentResult
+    reported      []bool
+    missed        []int
+    // segments a request was made for, see Attempted
+    attempted     map[int]bool
+    // missed segments that were never attempted
+    unattempted   []int
+    live          bool
+    stopped       bool
+    // closed by Stop
+    stopCh        chan struct{}
+    finished      bool
+    // see SetReorderWindow
+    window        int
+    // workers whose queue isn't exhausted yet, and how many of them are
+    // waiting for the merge to catch up
+    activeWorkers int
+    windowWaiting int
 }
 
 type SegmentResult struct {
@@ -27,44 +86,253 @@ type SegmentResult struct {
 
 // each worker has it's own queue of segments to download
 func (s *SegmentStatus) CreateQueue(worker int) WorkQueue {
-    return s.scheduler.CreateQueue(worker)
+    s.mu.Lock()
+    s.activeWorkers++
+    s.mu.Unlock()
+    return &statusQueue {
+        inner:  s.scheduler.CreateQueue(worker),
+        status: s,
+    }
+}
+
+// The queue mode in use, never QueueAuto.
+func (s *SegmentStatus) Mode() QueueMode {
+    return s.mode
 }
 
 func (s *SegmentStatus) IsLast(segment int) bool {
+    s.mu.Lock()
+    defer s.mu.Unlock()
     return segment == s.end - 1
 }
 
 func (s *SegmentStatus) MissedSegments() []int {
+    s.mu.Lock()
+    defer s.mu.Unlock()
     return s.missed
 }
 
+// Segments no request was ever made for (see Attempted), only marked as
+// missed by Finish. Segments that failed and were abandoned when the
+// download stopped aren't included. Also included in MissedSegments.
+func (s *SegmentStatus) UnattemptedSegments() []int {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.unattempted
+}
+
+// The current segment count. Safe to call while downloading, it grows as
+// Extend is called on live streams.
 func (s *SegmentStatus) Total() int {
+    s.mu.Lock()
+    defer s.mu.Unlock()
     return s.end
 }
 
+// marks this as the status of a stream that's still live. the segment count
+// is allowed to grow with Extend, and workers wait for new segments instead
+// of finishing until Stop is called.
+func (s *SegmentStatus) SetLive() {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.live = true
+}
+
+// Limits how far ahead of the merge position segments are handed out to
+// workers: a worker getting a segment window or more segments past the next
+// one to merge waits until merging catches up. This bounds the number of
+// downloaded segments waiting to be merged when an early one is slow, at
+// the cost of throughput, as threads sit idle instead of downloading ahead.
+// One worker always keeps going, so a segment the merge is waiting for can
+// still be retried. 0 disables the limit, which is the default.
+func (s *SegmentStatus) SetReorderWindow(window int) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.window = window
+    s.cond.Broadcast()
+}
+
+//blocks while segment is too far ahead of the merge position, returns
+//false if the status was stopped in the meantime
+func (s *SegmentStatus) waitForWindow(segment int) bool {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    for !s.stopped && s.window > 0 && segment >= s.mergedCount + s.window && s.windowWaiting + 1 < s.activeWorkers {
+        s.windowWaiting++
+        s.cond.Wait()
+        s.windowWaiting--
+    }
+    return !s.stopped
+}
+
+//a worker's queue is exhausted
+func (s *SegmentStatus) workerDone() {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.activeWorkers--
+    s.cond.Broadcast()
+}
+
+// the segment count of a live stream won't grow anymore. workers finish
+// the remaining segments instead of waiting for new ones, unlike with Stop.
+func (s *SegmentStatus) EndLive() {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.live = false
+    s.cond.Broadcast()
+}
+
+func (s *SegmentStatus) IsLive() bool {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.live
+}
+
+// grows the segment count to end, no-op if end isn't bigger than the
+// current segment count
+func (s *SegmentStatus) Extend(end int) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if end <= s.end || s.stopped {
+        return
+    }
+    s.scheduler.extend(end)
+    s.reported = append(s.reported, make([]bool, end - s.end)...)
+    s.end = end
+    s.cond.Broadcast()
+}
+
+// stops handing out new segments to workers. segments currently being
+// downloaded are not affected.
+func (s *SegmentStatus) Stop() {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if !s.stopped {
+        s.stopped = true
+        close(s.stopCh)
+    }
+    s.cond.Broadcast()
+}
+
+// A channel closed once Stop is called, to interrupt waits.
+func (s *SegmentStatus) StopChan() <-chan struct{} {
+    return s.stopCh
+}
+
+func (s *SegmentStatus) Stopped() bool {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.stopped
+}
+
+// called once all workers are done. for live streams, segments after the
+// last reported one are dropped, any other segment that was never reported
+// (eg because the download was stopped) is marked as missed so merging
+// doesn't wait for it forever. returns the segments newly marked as missed.
+func (s *SegmentStatus) Finish() []int {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if s.live {
+        end := s.mergedCount
+        for i := len(s.reported) - 1; i >= end; i-- {
+            if s.reported[i] {
+                end = i + 1
+                break
+            }
+        }
+        s.end = end
+        s.reported = s.reported[:end]
+    }
+    var missed []int
+    for i := s.mergedCount; i < s.end; i++ {
+        if !s.reported[i] {
+            s.reported[i] = true
+            s.missed = append(s.missed, i)
+            if !s.attempted[i] {
+                s.unattempted = append(s.unattempted, i)
+            }
+            s.segments[i] = SegmentResult { Ok: false }
+            missed = append(missed, i)
+        }
+    }
+    s.finished = true
+    s.cond.Broadcast()
+    return missed
+}
+
+//blocks until the segment count changes from end, the status is stopped
+//or the stream isn't live anymore
+func (s *SegmentStatus) waitForSegments(end int) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    for !s.stopped && s.live && s.end == end {
+        s.cond.Wait()
+    }
+}
+
 // retrieves the next segment to be merged, if available
 // and advances the merge position (so the next call will attempt
 // to fetch the next segment)
 func (s *SegmentStatus) NextToMerge() (SegmentResult, int, bool) {
     s.mu.Lock()
-    defer s.mu.Unlock()
-
     number := s.mergedCount
     r, ok := s.segments[number]
     if ok {
         delete(s.segments, number)
         s.mergedCount++
+        //workers might be waiting on the reorder window
+        s.cond.Broadcast()
+    }
+    onMerge := s.onMerge
+    s.mu.Unlock()
+
+    if ok && onMerge != nil {
+        onMerge(number)
     }
     return r, number, ok
 }
 
+// Sets a function called with each segment returned by NextToMerge. Called
+// without holding any locks, on the merger's goroutine.
+func (s *SegmentStatus) SetMergeCallback(f func(segment int)) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.onMerge = f
+}
+
+// The reported result of a segment that wasn't merged yet, if any.
+func (s *SegmentStatus) Result(number int) (SegmentResult, bool) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    r, ok := s.segments[number]
+    return r, ok
+}
+
+// Records that a request is about to be made for a segment, so it isn't
+// reported as unattempted if it's still missing once Finish is called.
+func (s *SegmentStatus) Attempted(number int) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.attempted[number] = true
+}
+
 // download task done downloading a segment
 func (s *SegmentStatus) Downloaded(number int, result SegmentResult) {
     s.mu.Lock()
     defer s.mu.Unlock()
+    if number >= s.end {
+        //stream ended before this segment
+        return
+    }
     if !result.Ok {
         s.missed = append(s.missed, number)
     }
+    s.reported[number] = true
     s.segments[number] = result
 }
 
@@ -72,25 +340,77 @@ func (s *SegmentStatus) Downloaded(number int, result SegmentResult) {
 func (s *SegmentStatus) Done() bool {
     s.mu.Lock()
     defer s.mu.Unlock()
-    return s.mergedCount == s.end
+    return s.mergedCount == s.end && (!s.live || s.finished)
 }
 
 func Create(segmentCount int, threads int, mode QueueMode, requeueDelay time.Duration) *SegmentStatus {
+    mode = resolveQueueMode(mode, segmentCount, threads)
+
+    stopCh := make(chan struct{})
     var scheduler workScheduler
     switch mode {
     case QueueOutOfOrder:
-        scheduler = makeBatchedScheduler(segmentCount, requeueDelay, threads)
+        scheduler = makeBatchedScheduler(segmentCount, requeueDelay, threads, stopCh)
     case QueueSequential:
-        scheduler = makeSequentialScheduler(segmentCount, requeueDelay)
+        scheduler = makeSequentialScheduler(segmentCount, requeueDelay, stopCh)
+    case QueueEarliestFirst:
+        scheduler = makeEarliestFirstScheduler(segmentCount, requeueDelay, stopCh)
     }
 
     ret := &SegmentStatus {
         end:         segmentCount,
         mergedCount: 0,
         scheduler:   scheduler,
+        mode:        mode,
         segments:    make(map[int]SegmentResult),
+        attempted:   make(map[int]bool),
+        reported:    make([]bool, segmentCount),
+        stopCh:      stopCh,
     }
+    ret.cond = sync.NewCond(&ret.mu)
 
     return ret
 }
 
+// wraps the scheduler queues so stopping and live streams are handled
+// the same way regardless of queue mode
+var _ WorkQueue = &statusQueue {}
+type statusQueue struct {
+    inner  WorkQueue
+    status *SegmentStatus
+    done   bool
+}
+
+func (q *statusQueue) NextSegment() (int, uint, bool) {
+    seg, fails, ok := q.next()
+    if ok && !q.status.waitForWindow(seg) {
+        ok = false
+    }
+    if !ok && !q.done {
+        q.done = true
+        q.status.workerDone()
+    }
+    if !ok {
+        return -1, 0, false
+    }
+    return seg, fails, true
+}
+
+func (q *statusQueue) next() (int, uint, bool) {
+    for {
+        if q.status.Stopped() {
+            return -1, 0, false
+        }
+        end := q.status.Total()
+        seg, fails, ok := q.inner.NextSegment()
+        if ok || !q.status.IsLive() {
+            return seg, fails, ok
+        }
+        q.status.waitForSegments(end)
+    }
+}
+
+func (q *statusQueue) RequeueFailed(seg int, fails uint) {
+    q.inner.RequeueFailed(seg, fails)
+}
+
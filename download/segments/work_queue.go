@@ -18,12 +18,24 @@ func (f failedSeg) isReady() bool {
     return time.Now().After(f.timestamp)
 }
 
-func (f failedSeg) wait() {
+// waits until the segment can be retried. returns false if stop was closed
+// in the meantime.
+func (f failedSeg) wait(stop <-chan struct{}) bool {
     delay := f.timestamp.Sub(time.Now())
+    if delay <= 0 {
+        return true
+    }
     if delay.Seconds() > 1 {
         log.Debugf("Waiting %v before retrying segment %d", delay.Round(time.Second), f.seg)
     }
-    time.Sleep(delay)
+    timer := time.NewTimer(delay)
+    defer timer.Stop()
+    select {
+    case <-timer.C:
+        return true
+    case <-stop:
+        return false
+    }
 }
 
 func makeFailedSeg(seg int, fails uint, delay time.Duration) failedSeg {
@@ -41,6 +53,8 @@ type WorkQueue interface {
 
 type workScheduler interface {
     CreateQueue(worker int) WorkQueue
+    // adds segments up to end (exclusive) to the work to be done
+    extend(end int)
 }
 
 // Simple, sequential scheduler. Workers get the next segment from a shared counter
@@ -51,13 +65,16 @@ type sequentialScheduler struct {
     next         int
     failed       []failedSeg
     requeueDelay time.Duration
+    // closed on SegmentStatus.Stop, interrupts waits for failed segments
+    stop         <-chan struct{}
 }
 
-func makeSequentialScheduler(totalSegments int, requeueDelay time.Duration) workScheduler {
+func makeSequentialScheduler(totalSegments int, requeueDelay time.Duration, stop <-chan struct{}) workScheduler {
     return &sequentialScheduler {
         max:          totalSegments,
         next:         0,
         requeueDelay: requeueDelay,
+        stop:         stop,
     }
 }
 
@@ -65,6 +82,12 @@ func (s *sequentialScheduler) CreateQueue(_ int) WorkQueue {
     return &sequentialQueue { sched: s }
 }
 
+func (s *sequentialScheduler) extend(end int) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.max = end
+}
+
 var _ WorkQueue = &sequentialQueue {}
 type sequentialQueue struct {
     sched *sequentialScheduler
@@ -98,7 +121,9 @@ func (s *sequentialQueue) NextSegment() (int, uint, bool) {
     if seg >= 0 {
         return seg, 0, true
     }
-    f.wait()
+    if !f.wait(s.sched.stop) {
+        return -1, 0, false
+    }
     return f.seg, f.fails, true
 }
 
@@ -109,18 +134,136 @@ func (s *sequentialQueue) RequeueFailed(seg int, fails uint) {
     s.sched.failed = append(s.sched.failed, makeFailedSeg(seg, fails, s.sched.requeueDelay))
 }
 
+// Always hands out the lowest numbered segment available, including requeued
+// ones once their delay is up, so the start of the stream can be merged as
+// early as possible. Requests are concentrated on a small part of the stream
+// at a time though, unlike the batched scheduler.
+var _ workScheduler = &earliestFirstScheduler {}
+type earliestFirstScheduler struct {
+    mu           sync.Mutex
+    max          int
+    next         int
+    failed       []failedSeg
+    requeueDelay time.Duration
+    // closed on SegmentStatus.Stop, interrupts waits for failed segments
+    stop         <-chan struct{}
+}
+
+func makeEarliestFirstScheduler(totalSegments int, requeueDelay time.Duration, stop <-chan struct{}) workScheduler {
+    return &earliestFirstScheduler {
+        max:          totalSegments,
+        next:         0,
+        requeueDelay: requeueDelay,
+        stop:         stop,
+    }
+}
+
+func (s *earliestFirstScheduler) CreateQueue(_ int) WorkQueue {
+    return &earliestFirstQueue { sched: s }
+}
+
+func (s *earliestFirstScheduler) extend(end int) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.max = end
+}
+
+//requires lock to be held before calling
+//index of the lowest numbered failed segment, only considering ready ones
+//if readyOnly is set. -1 if there's none.
+func (s *earliestFirstScheduler) earliestFailed(readyOnly bool) int {
+    idx := -1
+    for i, f := range s.failed {
+        if readyOnly && !f.isReady() {
+            continue
+        }
+        if idx < 0 || f.seg < s.failed[idx].seg {
+            idx = i
+        }
+    }
+    return idx
+}
+
+//requires lock to be held before calling
+func (s *earliestFirstScheduler) takeFailed(idx int) failedSeg {
+    f := s.failed[idx]
+    s.failed = append(s.failed[:idx], s.failed[idx + 1:]...)
+    return f
+}
+
+var _ WorkQueue = &earliestFirstQueue {}
+type earliestFirstQueue struct {
+    sched *earliestFirstScheduler
+}
+
+func (q *earliestFirstQueue) nextInternal() (failedSeg, int, bool) {
+    s := q.sched
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if idx := s.earliestFailed(true); idx >= 0 && (s.failed[idx].seg < s.next || s.next >= s.max) {
+        return s.takeFailed(idx), -1, true
+    }
+
+    if s.next < s.max {
+        seg := s.next
+        s.next++
+        return failedSeg{}, seg, true
+    }
+
+    //nothing else left, wait for the earliest one
+    if idx := s.earliestFailed(false); idx >= 0 {
+        return s.takeFailed(idx), -1, true
+    }
+
+    return failedSeg{}, 0, false
+}
+
+func (q *earliestFirstQueue) NextSegment() (int, uint, bool) {
+    //don't hold lock while waiting for a failed segment
+    f, seg, ok := q.nextInternal()
+    if !ok {
+        return -1, 0, false
+    }
+    if seg >= 0 {
+        return seg, 0, true
+    }
+    if !f.wait(q.sched.stop) {
+        return -1, 0, false
+    }
+    return f.seg, f.fails, true
+}
+
+func (q *earliestFirstQueue) RequeueFailed(seg int, fails uint) {
+    q.sched.mu.Lock()
+    defer q.sched.mu.Unlock()
+
+    q.sched.failed = append(q.sched.failed, makeFailedSeg(seg, fails, q.sched.requeueDelay))
+}
+
 // Splits the work in batches, each worker goes through it's own batch, but if it's
 // done it can steal from other workers.
 var _ workScheduler = &batchedScheduler {}
 type batchedScheduler struct {
     batches      []*batchRange
+    // segments added after creation (live streams). always consumed from
+    // the start, so extending it only has to move the end
+    tail         *batchRange
     requeueDelay time.Duration
+    // closed on SegmentStatus.Stop, interrupts waits for failed segments
+    stop         <-chan struct{}
 }
 
-func makeBatchedScheduler(segments int, requeueDelay time.Duration, threads int) workScheduler {
+func makeBatchedScheduler(segments int, requeueDelay time.Duration, threads int, stop <-chan struct{}) workScheduler {
     s := &batchedScheduler {
         batches:      make([]*batchRange, 0),
         requeueDelay: requeueDelay,
+        stop:         stop,
+    }
+    s.tail = &batchRange {
+        sched: s,
+        start: segments,
+        end:   segments - 1,
     }
     lastSeg := -1
     interval := segments / threads
@@ -169,6 +312,12 @@ func (s *batchedScheduler) CreateQueue(worker int) WorkQueue {
     return b
 }
 
+func (s *batchedScheduler) extend(end int) {
+    s.tail.mu.Lock()
+    defer s.tail.mu.Unlock()
+    s.tail.end = end - 1
+}
+
 var _ WorkQueue = &batchRange {}
 type batchRange struct {
     sched    *batchedScheduler
@@ -225,11 +374,47 @@ func (b *batchRange) trySteal() (failedSeg, int, bool) {
     return failedSeg{}, seg, true
 }
 
+// segments left in this batch, including requeued ones
+func (b *batchRange) remaining() int {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    n := b.end - b.start + 1
+    if n < 0 {
+        n = 0
+    }
+    return n + len(b.failed)
+}
+
+// the other batch with the most segments left, nil if all are empty
+func (b *batchRange) mostLoaded() *batchRange {
+    var best *batchRange
+    bestRemaining := 0
+    for _, v := range b.sched.batches {
+        if v == b {
+            continue
+        }
+        if n := v.remaining(); n > bestRemaining {
+            best = v
+            bestRemaining = n
+        }
+    }
+    return best
+}
+
 func (b *batchRange) nextInternal() (failedSeg, int, bool) {
     f, seg, ok := b.tryGetNext()
     if ok {
         return f, seg, true
     }
+    //steal from the batch with the most work left, so a slow worker's
+    //batch doesn't end up being the only one still running at the end
+    if v := b.mostLoaded(); v != nil {
+        f, seg, ok = v.trySteal()
+        if ok {
+            return f, seg, true
+        }
+    }
+    //it got emptied in the meantime, take anything that's left
     for _, v := range b.sched.batches {
         if v != b {
             f, seg, ok = v.trySteal()
@@ -238,7 +423,7 @@ func (b *batchRange) nextInternal() (failedSeg, int, bool) {
             }
         }
     }
-    return failedSeg {}, -1, false
+    return b.sched.tail.tryGetNext()
 }
 
 func (b *batchRange) NextSegment() (int, uint, bool) {
@@ -250,7 +435,9 @@ func (b *batchRange) NextSegment() (int, uint, bool) {
     if seg >= 0 {
         return seg, 0, true
     }
-    f.wait()
+    if !f.wait(b.sched.stop) {
+        return -1, 0, false
+    }
     return f.seg, f.fails, true
 }
 
@@ -0,0 +1,76 @@
+package download
+
+import (
+    "os"
+    "os/signal"
+    "sync"
+    "syscall"
+
+    "github.com/HoloArchivists/ytarchive-raw-go/log"
+)
+
+// Stops download tasks on SIGINT/SIGTERM, so everything downloaded so far
+// still gets merged. Not installed by default, as library users might handle
+// signals themselves.
+type SignalHandler struct {
+    mu          sync.Mutex
+    ch          chan os.Signal
+    done        chan struct{}
+    tasks       []*DownloadTask
+    interrupted bool
+}
+
+// Installs a handler that calls Stop on the tasks on the first SIGINT or
+// SIGTERM. The tasks then finish like after a Stop call or a Deadline:
+// segments being downloaded are finished, the rest are reported as lost,
+// and the merger gets every segment that's done. A second signal exits
+// immediately. nil tasks are ignored.
+func InstallSignalHandler(tasks ...*DownloadTask) *SignalHandler {
+    h := &SignalHandler {
+        ch:   make(chan os.Signal, 2),
+        done: make(chan struct{}),
+    }
+    for _, t := range tasks {
+        if t != nil {
+            h.tasks = append(h.tasks, t)
+        }
+    }
+    signal.Notify(h.ch, os.Interrupt, syscall.SIGTERM)
+    go h.run()
+    return h
+}
+
+func (h *SignalHandler) run() {
+    for {
+        select {
+        case <-h.done:
+            return
+        case sig := <-h.ch:
+            h.mu.Lock()
+            again := h.interrupted
+            h.interrupted = true
+            h.mu.Unlock()
+
+            if again {
+                log.Fatalf("Received %v again, exiting without merging", sig)
+            }
+            log.Warnf("Received %v, stopping downloads and merging what's done. Repeat to exit immediately.", sig)
+            for _, t := range h.tasks {
+                t.Stop()
+            }
+        }
+    }
+}
+
+// Whether a signal was received.
+func (h *SignalHandler) Interrupted() bool {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    return h.interrupted
+}
+
+// Restores the default signal behavior.
+func (h *SignalHandler) Remove() {
+    signal.Stop(h.ch)
+    close(h.done)
+}
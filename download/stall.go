@@ -0,0 +1,68 @@
+package download
+
+import (
+    "time"
+)
+
+// records that a segment finished downloading, for StallTimeout
+func (d *DownloadTask) segmentProgressed() {
+    d.threadsMu.Lock()
+    defer d.threadsMu.Unlock()
+    d.lastProgress = time.Now()
+}
+
+func (d *DownloadTask) sinceProgress() time.Duration {
+    d.threadsMu.Lock()
+    defer d.threadsMu.Unlock()
+    return time.Since(d.lastProgress)
+}
+
+// whether a thread is trying to download a segment. threads waiting for
+// new live segments or for the breaker don't make a download stalled.
+func (d *DownloadTask) threadsBusy() bool {
+    for _, s := range d.ThreadStatuses() {
+        if s.State == ThreadDownloading || s.State == ThreadRetrying {
+            return true
+        }
+    }
+    return false
+}
+
+// warns when no segment was downloaded for StallTimeout while threads are
+// busy, then again after each further StallTimeout, until done is closed.
+// each warning calls OnStall and asks OnURLExpired for a new URL, as a
+// stall is most often an expired URL.
+func (d *DownloadTask) watchStalls(done <-chan struct{}) {
+    if d.StallTimeout <= 0 {
+        return
+    }
+    d.segmentProgressed()
+
+    ticker := time.NewTicker(d.StallTimeout / 4)
+    defer ticker.Stop()
+    var lastWarn time.Time
+    for {
+        select {
+        case <-done:
+            return
+        case <-ticker.C:
+        }
+        stalled := d.sinceProgress()
+        if stalled < d.StallTimeout {
+            if !lastWarn.IsZero() {
+                d.logger().Info("Segments are being downloaded again")
+                lastWarn = time.Time {}
+            }
+            continue
+        }
+        if !d.threadsBusy() || time.Since(lastWarn) < d.StallTimeout {
+            continue
+        }
+        lastWarn = time.Now()
+        d.logger().Warnf("No segment downloaded for %v, the download seems stuck", stalled.Round(time.Second))
+        if d.OnStall != nil {
+            d.OnStall(stalled)
+        }
+        d.forceURLRefresh()
+    }
+}
@@ -0,0 +1,85 @@
+package download
+
+import (
+    "io"
+    "os"
+)
+
+// Where downloaded segments are written. The default stores them as files
+// in SegmentDir, tests can replace it to run downloadSegment without
+// touching the disk layout.
+type SegmentStore interface {
+    // returns the file of a segment downloaded by a previous run, if any
+    Existing(segment int) (filename string, size int64, ok bool)
+    // starts writing a segment, which only becomes visible on Commit
+    Create(segment int) (SegmentWriter, error)
+}
+
+type SegmentWriter interface {
+    io.Writer
+    // finishes the segment, returning the file given to the merger. the
+    // data is synced to disk first if fsync is set.
+    Commit(fsync bool) (filename string, err error)
+    // discards the partial segment
+    Abort()
+}
+
+// stores segments as files in the task's SegmentDir, downloading to a
+// .incomplete file renamed to .done once finished. both are in SegmentDir,
+// so the rename can't cross filesystems.
+type fileStore struct {
+    task *DownloadTask
+}
+
+func (s fileStore) Existing(segment int) (string, int64, bool) {
+    path := segmentBaseFileName(s.task, segment) + ".done"
+    info, err := os.Stat(path)
+    if err != nil || info.Size() == 0 {
+        return "", 0, false
+    }
+    return path, info.Size(), true
+}
+
+func (s fileStore) Create(segment int) (SegmentWriter, error) {
+    base := segmentBaseFileName(s.task, segment)
+    file, err := os.OpenFile(base + ".incomplete", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+    if err != nil {
+        return nil, err
+    }
+    return &fileSegmentWriter {
+        file:     file,
+        donePath: base + ".done",
+    }, nil
+}
+
+type fileSegmentWriter struct {
+    file     *os.File
+    donePath string
+}
+
+func (w *fileSegmentWriter) Write(p []byte) (int, error) {
+    return w.file.Write(p)
+}
+
+func (w *fileSegmentWriter) Commit(fsync bool) (string, error) {
+    if fsync {
+        if err := w.file.Sync(); err != nil {
+            w.Abort()
+            return "", err
+        }
+    }
+    if err := w.file.Close(); err != nil {
+        os.Remove(w.file.Name())
+        return "", err
+    }
+    if err := os.Rename(w.file.Name(), w.donePath); err != nil {
+        os.Remove(w.file.Name())
+        return "", err
+    }
+    return w.donePath, nil
+}
+
+func (w *fileSegmentWriter) Abort() {
+    w.file.Close()
+    os.Remove(w.file.Name())
+}
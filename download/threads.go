@@ -0,0 +1,128 @@
+package download
+
+import (
+    "fmt"
+    "time"
+
+    "github.com/HoloArchivists/ytarchive-raw-go/log"
+)
+
+// how often the state of the threads is logged at debug level
+const threadDiagnosticsInterval = 30 * time.Second
+
+type ThreadState int
+const (
+    // waiting for its RampUp delay
+    ThreadStarting ThreadState = iota
+    // waiting for a segment to download
+    ThreadIdle
+    ThreadDownloading
+    // waiting before retrying a failed segment
+    ThreadRetrying
+    // waiting for the circuit breaker to close, see BreakerThreshold
+    ThreadPaused
+    ThreadDone
+)
+
+func (s ThreadState) String() string {
+    switch s {
+    case ThreadStarting:
+        return "starting"
+    case ThreadIdle:
+        return "idle"
+    case ThreadDownloading:
+        return "downloading"
+    case ThreadRetrying:
+        return "retrying"
+    case ThreadPaused:
+        return "paused"
+    case ThreadDone:
+        return "done"
+    }
+    return fmt.Sprintf("ThreadState(%d)", int(s))
+}
+
+type ThreadStatus struct {
+    Thread   uint
+    State    ThreadState
+    // the segment being worked on, -1 if none
+    Segment  int
+    // failed attempts at Segment so far
+    Attempts int
+    // when State or Segment last changed
+    Since    time.Time
+}
+
+func (s ThreadStatus) String() string {
+    elapsed := time.Since(s.Since).Round(time.Second)
+    if s.Segment < 0 {
+        return fmt.Sprintf("thread %d %v for %v", s.Thread, s.State, elapsed)
+    }
+    return fmt.Sprintf("thread %d %v segment %d (%d failed attempt(s)) for %v", s.Thread, s.State, s.Segment, s.Attempts, elapsed)
+}
+
+// Returns what each download thread is currently doing, eg to show a per
+// thread view or find out why a download is stuck. Empty before the
+// download started.
+func (d *DownloadTask) ThreadStatuses() []ThreadStatus {
+    d.threadsMu.Lock()
+    defer d.threadsMu.Unlock()
+
+    statuses := make([]ThreadStatus, len(d.threadStatus))
+    copy(statuses, d.threadStatus)
+    return statuses
+}
+
+func (d *DownloadTask) initThreadStatus(threads uint) {
+    d.threadsMu.Lock()
+    defer d.threadsMu.Unlock()
+
+    now := time.Now()
+    d.threadStatus = make([]ThreadStatus, threads)
+    for i := range d.threadStatus {
+        d.threadStatus[i] = ThreadStatus {
+            Thread:  uint(i),
+            State:   ThreadStarting,
+            Segment: -1,
+            Since:   now,
+        }
+    }
+}
+
+func (d *DownloadTask) setThreadState(thread uint, state ThreadState, segment int, attempts int) {
+    d.threadsMu.Lock()
+    defer d.threadsMu.Unlock()
+
+    if int(thread) >= len(d.threadStatus) {
+        return
+    }
+    s := &d.threadStatus[thread]
+    if s.State != state || s.Segment != segment {
+        s.Since = time.Now()
+    }
+    s.State = state
+    s.Segment = segment
+    s.Attempts = attempts
+}
+
+// logs the state of the threads regularly at debug level, until done is
+// closed
+func (d *DownloadTask) logThreadStatus(done <-chan struct{}) {
+    ticker := time.NewTicker(threadDiagnosticsInterval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-done:
+            return
+        case <-ticker.C:
+        }
+        if !d.logger().Enabled(log.LevelDebug) {
+            continue
+        }
+        for _, s := range d.ThreadStatuses() {
+            if s.State != ThreadDone {
+                d.logger().Debugf("Status: %v", s)
+            }
+        }
+    }
+}
@@ -0,0 +1,142 @@
+package download
+
+import (
+    "fmt"
+    "sync/atomic"
+    "time"
+)
+
+// 403s in a row, on any thread, after which the URL is considered expired
+// even if its expire time hasn't passed
+const urlExpiredForbiddenThreshold = 10
+
+// how long to wait before calling OnURLExpired again after it failed
+const urlRefreshRetryDelay = 30 * time.Second
+
+// the URL currently used for requests, and how many times it was replaced
+func (d *DownloadTask) currentURL() (*parsedURL, uint64) {
+    d.urlMu.RLock()
+    defer d.urlMu.RUnlock()
+    return d.parsedUrl, d.urlGeneration
+}
+
+// a request got a response other than 403
+func (d *DownloadTask) urlWorked() {
+    atomic.StoreInt32(&d.forbiddenCount, 0)
+}
+
+// a request made with the URL of the given generation got a 403. refreshes
+// the URL if it looks expired and OnURLExpired is set. returns whether the
+// URL was replaced, either by this call or by another thread in the
+// meantime.
+func (d *DownloadTask) urlForbidden(generation uint64) bool {
+    forbidden := atomic.AddInt32(&d.forbiddenCount, 1)
+    if d.OnURLExpired == nil {
+        return false
+    }
+
+    current, _ := d.currentURL()
+    expired := current.expire != nil && time.Now().After(*current.expire)
+    if !expired && forbidden < urlExpiredForbiddenThreshold {
+        return false
+    }
+
+    //only one refresh at a time, threads that got a 403 in the meantime
+    //wait here and then use the new URL
+    d.refreshMu.Lock()
+    defer d.refreshMu.Unlock()
+
+    if _, gen := d.currentURL(); gen != generation {
+        return true
+    }
+    if time.Since(d.refreshFailedAt) < urlRefreshRetryDelay {
+        return false
+    }
+
+    d.logger().Info("URL seems to have expired, requesting a new one")
+    if err := d.replaceURL(current); err != nil {
+        d.urlExpired(fmt.Errorf("Unable to refresh URL: %v", err))
+        return false
+    }
+    return true
+}
+
+// records why segments are failing because of the URL, reported with
+// ErrURLExpired if segments end up lost. the first cause is kept, eg a
+// failed refresh over the 403s that follow it.
+func (d *DownloadTask) urlExpired(err error) {
+    d.resultMu.Lock()
+    defer d.resultMu.Unlock()
+    if d.expiredErr == nil {
+        d.expiredErr = err
+    }
+}
+
+func (d *DownloadTask) urlExpiredErr() error {
+    d.resultMu.Lock()
+    defer d.resultMu.Unlock()
+    return d.expiredErr
+}
+
+// asks OnURLExpired for a new URL even though requests aren't getting 403s,
+// eg because the download stalled. does nothing if OnURLExpired isn't set or
+// the last refresh failed less than urlRefreshRetryDelay ago.
+func (d *DownloadTask) forceURLRefresh() {
+    if d.OnURLExpired == nil {
+        return
+    }
+    d.refreshMu.Lock()
+    defer d.refreshMu.Unlock()
+
+    if time.Since(d.refreshFailedAt) < urlRefreshRetryDelay {
+        return
+    }
+    current, _ := d.currentURL()
+    d.logger().Info("Requesting a new URL")
+    d.replaceURL(current)
+}
+
+// replaces current with a URL from OnURLExpired. requires refreshMu to be
+// held. returns why the URL couldn't be replaced, if it wasn't.
+func (d *DownloadTask) replaceURL(current *parsedURL) error {
+    newUrl, err := d.refreshURL(current)
+    if err != nil {
+        d.logger().Warnf("Unable to refresh URL: %v", err)
+        d.refreshFailedAt = time.Now()
+        return err
+    }
+
+    d.urlMu.Lock()
+    d.Url = newUrl.raw
+    d.parsedUrl = newUrl
+    d.urlGeneration++
+    d.urlMu.Unlock()
+
+    atomic.StoreInt32(&d.forbiddenCount, 0)
+    d.Progress.setExpire(newUrl.expire)
+    d.logger().Info("Using refreshed URL")
+    return nil
+}
+
+func (d *DownloadTask) refreshURL(current *parsedURL) (*parsedURL, error) {
+    d.urlMu.RLock()
+    oldUrl := d.Url
+    d.urlMu.RUnlock()
+
+    rawUrl, err := d.OnURLExpired(oldUrl)
+    if err != nil {
+        return nil, err
+    }
+    if err = validateURL(rawUrl); err != nil {
+        return nil, err
+    }
+    p, err := parseDownloadURL(rawUrl)
+    if err != nil {
+        return nil, err
+    }
+    //segment files are named after these, so they can't change
+    if p.id != current.id || p.itag != current.itag {
+        return nil, fmt.Errorf("New URL is for %s/%d instead of %s/%d", p.id, p.itag, current.id, current.itag)
+    }
+    return p, nil
+}
@@ -0,0 +1,93 @@
+package download
+
+import (
+    "fmt"
+    "io"
+    "os"
+    "time"
+
+    "github.com/HoloArchivists/ytarchive-raw-go/download/segments"
+    "github.com/HoloArchivists/ytarchive-raw-go/util"
+)
+
+// checks every downloaded segment file of status again, see
+// VerifyBeforeMerge. bad segments are downloaded again, or lost if that
+// fails too. must only be called once no workers are running.
+func (d *DownloadTask) verifySegments(status *segments.SegmentStatus) {
+    total := status.Total()
+    d.logger().Infof("Verifying %d segment(s) before merging", total)
+
+    var requester *util.HttpRequester
+    bad := 0
+    for seg := 0; seg < total; seg++ {
+        result, ok := status.Result(seg)
+        if !ok || !result.Ok {
+            continue
+        }
+        err := checkSegmentFile(result.Filename)
+        if err == nil {
+            continue
+        }
+        bad++
+        d.logger().Warnf("Segment %d failed verification: %v", seg, err)
+        os.Remove(result.Filename)
+
+        if status.Stopped() {
+            status.Downloaded(seg, segments.SegmentResult { Ok: false })
+            d.segmentLost(seg)
+            continue
+        }
+        if requester == nil {
+            requester = d.client().GetRequester()
+        }
+        if !d.redownloadSegment(requester, status, seg) {
+            d.logger().Warnf("Unable to download segment %d again, giving up", seg)
+            status.Downloaded(seg, segments.SegmentResult { Ok: false })
+            d.segmentLost(seg)
+        }
+    }
+    if bad > 0 {
+        d.logger().Infof("%d segment(s) failed verification", bad)
+    }
+}
+
+// downloads a segment again with the usual retry policy, ignoring
+// MaxLostSegments and the retry budget
+func (d *DownloadTask) redownloadSegment(requester *util.HttpRequester, status *segments.SegmentStatus, seg int) bool {
+    var networkErrors uint
+    var attempt SegmentMetrics
+    policy := d.segmentRetryPolicy(status.IsLast(seg))
+    for fails := 1; ; fails++ {
+        if ok, _ := downloadSegment(d, requester, status, seg, &networkErrors, &attempt); ok {
+            return true
+        }
+        retry, delay := policy.ShouldRetry(fails, attempt.StatusCode, attempt.Error)
+        if !retry {
+            return false
+        }
+        select {
+        case <-time.After(delay):
+        case <-status.StopChan():
+            return false
+        }
+    }
+}
+
+// a segment file is fine if it can be read and isn't empty. no checksums
+// are recorded for segments, so the content itself can't be checked.
+func checkSegmentFile(filename string) error {
+    f, err := os.Open(filename)
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+
+    var b [1]byte
+    if _, err := f.Read(b[:]); err != nil {
+        if err == io.EOF {
+            return fmt.Errorf("Segment file is empty")
+        }
+        return err
+    }
+    return nil
+}
@@ -0,0 +1,151 @@
+package download
+
+import (
+    "errors"
+    "fmt"
+    "os"
+
+    "github.com/HoloArchivists/ytarchive-raw-go/log"
+    "github.com/HoloArchivists/ytarchive-raw-go/merge"
+    "github.com/HoloArchivists/ytarchive-raw-go/util"
+)
+
+type VideoOptions struct {
+    // makes the requests of both tracks, defaults to a client with the
+    // default config
+    Client         *util.HttpClient
+    Freg           *util.FregJson
+    // FinalFileBase is a template (see util.FregJson.FormatTemplate), FregData
+    // is set to Freg and IgnoreAudio/IgnoreVideo are set for missing tracks.
+    // Without a TempDir, a temporary one is created and removed once done.
+    Muxer          merge.MuxerOptions
+    // itags to prefer, see util.FregJson.BestAudio and BestVideo
+    PreferredAudio []int
+    PreferredVideo []int
+    // called with each task and its track ("audio" or "video") before it's
+    // started, to change the download settings, eg Threads
+    Setup          func(task *DownloadTask, track string)
+}
+
+type VideoResult struct {
+    // nil if the track wasn't downloaded
+    Audio   *DownloadResult
+    Video   *DownloadResult
+    // files written by the muxer, empty if muxing failed
+    Outputs []string
+}
+
+// Downloads the audio and video of opts.Freg at the same time, with one
+// progress display for both, then muxes them. Segment files are removed as
+// set by Muxer.DeleteSegments, a temp dir created here is removed with
+// everything in it.
+//
+// The error is the first of: a track failing completely, muxing failing, or
+// an error matching ErrPartial (with errors.Is) if segments were lost but
+// the output was still written. The result is returned in all cases, with
+// what's known so far.
+func DownloadVideo(opts *VideoOptions) (*VideoResult, error) {
+    res := &VideoResult {}
+    if opts.Freg == nil {
+        return res, fmt.Errorf("Missing info json")
+    }
+    muxOpts := opts.Muxer
+    muxOpts.FregData = opts.Freg
+    if muxOpts.Logger == nil {
+        muxOpts.Logger = log.New("muxer")
+    }
+    output, err := opts.Freg.FormatTemplate(muxOpts.FinalFileBase, true)
+    if err != nil {
+        return res, fmt.Errorf("Invalid output template: %v", err)
+    }
+    muxOpts.FinalFileBase = output
+
+    if muxOpts.TempDir == "" {
+        dir, err := os.MkdirTemp("", fmt.Sprintf("ytarchive-%s-", opts.Freg.Metadata.Id))
+        if err != nil {
+            return res, fmt.Errorf("Unable to create temp dir: %v", err)
+        }
+        defer os.RemoveAll(dir)
+        muxOpts.TempDir = dir
+    }
+
+    progress := NewProgress()
+    client := opts.Client
+    audioTask, videoTask := TasksFromFreg(opts.Freg, opts.PreferredAudio, opts.PreferredVideo, nil)
+    if audioTask == nil {
+        muxOpts.IgnoreAudio = true
+    }
+    if videoTask == nil {
+        muxOpts.IgnoreVideo = true
+    }
+
+    muxer, err := merge.CreateBestMuxer(&muxOpts)
+    if err != nil {
+        return res, fmt.Errorf("Unable to create muxer: %v", err)
+    }
+    if audioTask == nil {
+        merge.MergeNothing(muxer.AudioMerger())
+    }
+    if videoTask == nil {
+        merge.MergeNothing(muxer.VideoMerger())
+    }
+
+    tasks := []*DownloadTask { audioTask, videoTask }
+    for i, task := range tasks {
+        if task == nil {
+            continue
+        }
+        track := "audio"
+        task.Merger = muxer.AudioMerger()
+        task.Progress = progress.Audio()
+        if i == 1 {
+            track = "video"
+            task.Merger = muxer.VideoMerger()
+            task.Progress = progress.Video()
+        }
+        if client == nil {
+            //shared by both tracks, closed once done
+            client = util.NewClient(&util.HttpClientConfig {})
+            defer client.Close()
+        }
+        task.Client = client
+        task.DeleteSegments = muxOpts.DeleteSegments
+        task.SegmentDir = muxOpts.TempDir
+        if opts.Setup != nil {
+            opts.Setup(task, track)
+        }
+        task.Start()
+    }
+
+    muxerResult := make(chan error, 1)
+    go func() {
+        muxerResult <- muxer.Mux()
+    }()
+
+    if audioTask != nil {
+        res.Audio = audioTask.Wait()
+        audioTask.Close()
+    }
+    if videoTask != nil {
+        res.Video = videoTask.Wait()
+        videoTask.Close()
+    }
+    muxErr := <-muxerResult
+
+    if res.Audio != nil && res.Audio.Failed() {
+        return res, fmt.Errorf("Audio download failed: %w", res.Audio.Error)
+    }
+    if res.Video != nil && res.Video.Failed() {
+        return res, fmt.Errorf("Video download failed: %w", res.Video.Error)
+    }
+    if muxErr != nil {
+        return res, fmt.Errorf("Muxing failed: %w", muxErr)
+    }
+    res.Outputs = muxer.OutputFiles()
+    for _, r := range []*DownloadResult { res.Audio, res.Video } {
+        if r != nil && errors.Is(r.Error, ErrPartial) {
+            return res, r.Error
+        }
+    }
+    return res, nil
+}
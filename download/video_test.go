@@ -0,0 +1,98 @@
+package download
+
+import (
+    "bytes"
+    "errors"
+    "io"
+    "net/http"
+    "os"
+    "path/filepath"
+    "runtime"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/HoloArchivists/ytarchive-raw-go/log"
+    "github.com/HoloArchivists/ytarchive-raw-go/merge"
+    "github.com/HoloArchivists/ytarchive-raw-go/util"
+)
+
+// an executable that passes the FFmpeg check of merge.CreateBestMuxer,
+// enough for the download-only merger which doesn't run it otherwise
+func fakeFfmpeg(t *testing.T) string {
+    if runtime.GOOS == "windows" {
+        t.Skip("Fake FFmpeg is a shell script")
+    }
+    path := filepath.Join(t.TempDir(), "ffmpeg")
+    if err := os.WriteFile(path, []byte("#!/bin/sh\nexit 0\n"), 0755); err != nil {
+        t.Fatal(err)
+    }
+    return path
+}
+
+func TestDownloadVideoTrackWithoutSegmentCount(t *testing.T) {
+    //the audio URL is forbidden, the video one has a single segment
+    rt := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+        resp := &http.Response {
+            StatusCode: 200,
+            Header:     http.Header {},
+            Body:       io.NopCloser(bytes.NewReader(testSegment)),
+            Request:    req,
+        }
+        if strings.Contains(req.URL.RawQuery, "itag=140") {
+            resp.StatusCode = 403
+            resp.Status = "403 Forbidden"
+            resp.Body = io.NopCloser(bytes.NewReader(nil))
+        }
+        resp.Header.Set("X-Head-Seqnum", "1")
+        return resp, nil
+    })
+    client := util.NewClient(&util.HttpClientConfig { Transport: rt })
+    defer client.Close()
+
+    dir := t.TempDir()
+    freg := &util.FregJson {
+        Audio:    map[int]string { 140: testURL },
+        Video:    map[int]string { 299: strings.Replace(testURL, "itag=140", "itag=299", 1) },
+        Metadata: util.FregMetadata {
+            ChannelURL: "https://www.youtube.com/channel/UCabc",
+            Id:         "abc",
+        },
+    }
+    opts := &VideoOptions {
+        Client: client,
+        Freg:   freg,
+        Muxer:  merge.MuxerOptions {
+            FfmpegPath:    fakeFfmpeg(t),
+            FinalFileBase: filepath.Join(dir, "out"),
+            Logger:        log.Discard,
+            Merger:        "download-only",
+            TempDir:       dir,
+        },
+        Setup: func(task *DownloadTask, track string) {
+            task.Logger = log.Discard
+            task.RetryDelay = time.Millisecond
+        },
+    }
+
+    type result struct {
+        res *VideoResult
+        err error
+    }
+    done := make(chan result, 1)
+    go func() {
+        res, err := DownloadVideo(opts)
+        done <- result { res, err }
+    }()
+    select {
+    case r := <-done:
+        if !errors.Is(r.err, ErrURLExpired) {
+            t.Fatalf("Expected an expired URL error, got %v", r.err)
+        }
+        if r.res.Video == nil || !r.res.Video.Success() {
+            t.Errorf("Video track should have succeeded: %+v", r.res.Video)
+        }
+    case <-time.After(time.Minute):
+        t.Fatal("DownloadVideo didn't return")
+    }
+}
@@ -6,6 +6,8 @@ require (
 	github.com/gofrs/flock v0.8.1
 	github.com/lucas-clemente/quic-go v0.31.1
 	github.com/mattn/go-colorable v0.1.13
+	github.com/mattn/go-isatty v0.0.16
+	golang.org/x/sys v0.3.0
 	inet.af/netaddr v0.0.0-20220811202034-502d2d690317
 )
 
@@ -17,7 +19,6 @@ require (
 	github.com/marten-seemann/qpack v0.3.0 // indirect
 	github.com/marten-seemann/qtls-go1-18 v0.1.3 // indirect
 	github.com/marten-seemann/qtls-go1-19 v0.1.1 // indirect
-	github.com/mattn/go-isatty v0.0.16 // indirect
 	github.com/onsi/ginkgo/v2 v2.6.0 // indirect
 	go4.org/intern v0.0.0-20220617035311-6925f38cc365 // indirect
 	go4.org/unsafe/assume-no-moving-gc v0.0.0-20220617031537-928513b29760 // indirect
@@ -25,7 +26,6 @@ require (
 	golang.org/x/exp v0.0.0-20221212164502-fae10dda9338 // indirect
 	golang.org/x/mod v0.7.0 // indirect
 	golang.org/x/net v0.4.0 // indirect
-	golang.org/x/sys v0.3.0 // indirect
 	golang.org/x/text v0.5.0 // indirect
 	golang.org/x/tools v0.4.0 // indirect
 )
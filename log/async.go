@@ -0,0 +1,238 @@
+package log
+
+import (
+    "fmt"
+    "io"
+    "sync"
+    "sync/atomic"
+)
+
+// A reasonable queue size for SetAsync.
+const DefaultAsyncQueueSize = 4096
+
+// most records written with a single Write call in async mode
+const maxBatchSize = 256
+
+type record struct {
+    // nil for the package output
+    w     io.Writer
+    data  []byte
+    // set for Flush markers, closed once everything before it is written
+    flush chan struct{}
+}
+
+var async struct {
+    // held for reading while queueing, so Close can't close the queue
+    // in the middle of a send
+    mu      sync.RWMutex
+    queue   chan record
+    // wakes the writer to redraw the progress lines, see requestRedraw
+    redraw  chan struct{}
+    stopped chan struct{}
+    dropped uint64
+}
+
+// Enables asynchronous logging: records are queued and written in batches
+// by a background goroutine instead of by the logging goroutine, which then
+// never waits on the output. A size of 0 or less disables it again.
+//
+// Records are written in the order they were queued, with the progress
+// lines redrawn after each batch. Progress updates don't wait in the queue,
+// the lines are redrawn with the latest status between batches, so they
+// stay current even behind a backlog of records. When the queue is full,
+// new debug, info and warn records are dropped, and a line with the number
+// of dropped records is written once there's room again. Error and fatal
+// records are never dropped, logging them waits for room instead.
+//
+// Flush waits for all queued records to be written, Close also stops the
+// goroutine. Fatal calls Flush before exiting.
+func SetAsync(queueSize int) {
+    Close()
+    if queueSize <= 0 {
+        return
+    }
+    async.mu.Lock()
+    defer async.mu.Unlock()
+    async.queue = make(chan record, queueSize)
+    async.redraw = make(chan struct{}, 1)
+    async.stopped = make(chan struct{})
+    go asyncWriter(async.queue, async.redraw, async.stopped)
+}
+
+// Waits for all records queued so far to be written. Does nothing if async
+// logging is disabled.
+func Flush() {
+    async.mu.RLock()
+    if async.queue == nil {
+        async.mu.RUnlock()
+        return
+    }
+    done := make(chan struct{})
+    async.queue <- record { flush: done }
+    async.mu.RUnlock()
+    <-done
+}
+
+// Writes all queued records and goes back to synchronous logging.
+func Close() {
+    async.mu.Lock()
+    queue, stopped := async.queue, async.stopped
+    async.queue = nil
+    async.mu.Unlock()
+
+    if queue == nil {
+        return
+    }
+    close(queue)
+    <-stopped
+}
+
+// Queues a record if async logging is enabled, returns false otherwise.
+// data is copied, so callers may reuse it.
+func enqueue(w io.Writer, data []byte, mustWrite bool) bool {
+    async.mu.RLock()
+    defer async.mu.RUnlock()
+    if async.queue == nil {
+        return false
+    }
+    r := record {
+        w: w,
+    }
+    if data != nil {
+        r.data = append([]byte(nil), data...)
+    }
+    if mustWrite {
+        async.queue <- r
+        return true
+    }
+    select {
+    case async.queue <- r:
+    default:
+        atomic.AddUint64(&async.dropped, 1)
+    }
+    return true
+}
+
+// asks the async writer to redraw the progress lines, returns false if
+// async logging is disabled. requests made before the writer gets to them
+// are merged into one.
+func requestRedraw() bool {
+    async.mu.RLock()
+    defer async.mu.RUnlock()
+    if async.queue == nil {
+        return false
+    }
+    select {
+    case async.redraw <- struct{}{}:
+    default:
+    }
+    return true
+}
+
+func asyncWriter(queue <-chan record, redraw <-chan struct{}, stopped chan<- struct{}) {
+    defer close(stopped)
+
+    batch := make([]record, 0, maxBatchSize)
+    for {
+        select {
+        case <-redraw:
+            //only the progress lines, with their latest status
+            writeBatch(nil)
+            continue
+        case r, ok := <-queue:
+            if !ok {
+                return
+            }
+            batch = append(batch[:0], r)
+        }
+        //take whatever else is already queued without waiting for more
+    fill:
+        for len(batch) < maxBatchSize {
+            select {
+            case r, ok := <-queue:
+                if !ok {
+                    break fill
+                }
+                batch = append(batch, r)
+            default:
+                break fill
+            }
+        }
+        writeBatch(batch)
+    }
+}
+
+// Writes the records to their writers. Log lines going to the package
+// output are written together, with the progress lines redrawn once after
+// them.
+func writeBatch(batch []record) {
+    progress.mu.Lock()
+    defer func() {
+        progress.mu.Unlock()
+        for _, r := range batch {
+            if r.flush != nil {
+                close(r.flush)
+            }
+        }
+    }()
+
+    progress.buf = progress.buf[:0]
+    text := progress.format == FormatText
+    //progress is redrawn in place below the logs only on a terminal
+    redraw := text && !progress.plain
+    separate := progress.progressOut != nil
+    //log lines overwrite the progress lines on the same writer
+    erase := redraw && !separate
+
+    if erase && progress.lines > 0 {
+        //go back to the start of the progress lines so they get overwritten
+        moveCursorUp(&progress.buf, progress.lines)
+    }
+    if n := atomic.SwapUint64(&async.dropped, 0); n > 0 {
+        appendLine([]byte(fmt.Sprintf("%d log records dropped, queue full", n)), erase)
+    }
+    for _, r := range batch {
+        if r.flush != nil || len(r.data) == 0 {
+            continue
+        }
+        if r.w != nil {
+            //no progress handling on other writers
+            line := append(append([]byte(nil), r.data...), '\n')
+            r.w.Write(line)
+            continue
+        }
+        appendLine(r.data, erase)
+    }
+    if separate {
+        //the progress lines go to their own writer, reuse the buffer for them
+        if len(progress.buf) > 0 {
+            progress.output.Write(progress.buf)
+        }
+        progress.buf = progress.buf[:0]
+        if redraw && progress.lines > 0 {
+            moveCursorUp(&progress.buf, progress.lines)
+        }
+    }
+    if redraw {
+        appendProgressLines()
+    } else if text {
+        appendPlainProgress(false)
+    }
+    if len(progress.buf) > 0 {
+        if separate {
+            progress.progressOut.Write(progress.buf)
+        } else {
+            progress.output.Write(progress.buf)
+        }
+    }
+}
+
+// appends a log line to progress.buf, erasing what's left of the progress
+// line it overwrites if erase is set. requires progress.mu to be held.
+func appendLine(data []byte, erase bool) {
+    progress.buf = append(progress.buf, data...)
+    if erase {
+        progress.buf = append(progress.buf, eraseRestOfLine...)
+    }
+    progress.buf = append(progress.buf, '\n')
+}
@@ -0,0 +1,64 @@
+package log
+
+import (
+    "bytes"
+    "sync"
+)
+
+// a buffer the async writer can write to while the logging goroutine
+// reads it
+type lockedBuffer struct {
+    mu  sync.Mutex
+    buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) Bytes() []byte {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return append([]byte(nil), b.buf.Bytes()...)
+}
+
+// Runs f with this logger's output redirected to a buffer, and returns what
+// was logged. The previous output is restored afterwards, even if f panics.
+// Useful in tests, or to attach the logs of an operation to an error report.
+//
+// Only records logged through this logger itself and its WithField loggers
+// without their own Output are captured: sub loggers keep their own output.
+// Records logged through this logger by other goroutines while f runs are
+// captured too. Captures on the same logger are serialized, so concurrent
+// calls wait for each other. Progress is never captured, and in async mode
+// records dropped because the queue was full are missing from the result.
+func (l *Logger) CaptureOutput(f func()) []byte {
+    l.captureMu.Lock()
+    defer l.captureMu.Unlock()
+
+    buf := &lockedBuffer {}
+    l.mu.Lock()
+    prev := l.Output
+    l.Output = buf
+    l.mu.Unlock()
+
+    func() {
+        defer func() {
+            l.mu.Lock()
+            l.Output = prev
+            l.mu.Unlock()
+        }()
+        f()
+    }()
+
+    //in async mode, captured records may still be queued
+    Flush()
+    return buf.Bytes()
+}
+
+// Captures the output of DefaultLogger, see Logger.CaptureOutput.
+func CaptureOutput(f func()) []byte {
+    return DefaultLogger.CaptureOutput(f)
+}
@@ -0,0 +1,8 @@
+//go:build !windows
+// +build !windows
+
+package log
+
+func enableVirtualTerminal() bool {
+    return true
+}
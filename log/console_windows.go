@@ -0,0 +1,39 @@
+//go:build windows
+// +build windows
+
+package log
+
+import (
+    "os"
+    "syscall"
+    "unsafe"
+)
+
+const (
+    cENABLE_VIRTUAL_TERMINAL_PROCESSING = uint32(0x0004)
+)
+
+var (
+    kernel32           = syscall.NewLazyDLL("kernel32.dll")
+    procGetConsoleMode = kernel32.NewProc("GetConsoleMode")
+    procSetConsoleMode = kernel32.NewProc("SetConsoleMode")
+)
+
+// escape sequences are printed literally by the windows console unless
+// virtual terminal processing is enabled. returns false if the output is
+// a console that doesn't support it.
+func enableVirtualTerminal() bool {
+    var mode uint32
+    h := os.Stderr.Fd()
+    if r, _, _ := procGetConsoleMode.Call(h, uintptr(unsafe.Pointer(&mode))); r == 0 {
+        //not a console
+        return true
+    }
+    if mode & cENABLE_VIRTUAL_TERMINAL_PROCESSING != 0 {
+        return true
+    }
+    mode |= cENABLE_VIRTUAL_TERMINAL_PROCESSING
+
+    r, _, _ := procSetConsoleMode.Call(h, uintptr(mode))
+    return r != 0
+}
@@ -0,0 +1,24 @@
+package log
+
+// A logger that writes nothing and doesn't exit on Fatal, for embedding
+// without any output. Sub loggers and WithField loggers created from it
+// discard too.
+var Discard = NewDiscard(false)
+
+// Creates a logger that writes nothing, not even to hooks. Fatal messages
+// only exit (see SetExitFunc) if exitOnFatal is set, otherwise they return
+// like any other level and the caller keeps running.
+func NewDiscard(exitOnFatal bool) *Logger {
+    return &Logger {
+        discard:     true,
+        exitOnFatal: exitOnFatal,
+        minLevel:    levelInherit,
+    }
+}
+
+// handles a message for a discarding logger
+func (l *Logger) discardMessage(level Level) {
+    if level == LevelFatal && l.exitOnFatal {
+        exitFatal()
+    }
+}
@@ -0,0 +1,115 @@
+package log
+
+import (
+    "encoding/json"
+    "fmt"
+    "strconv"
+    "strings"
+)
+
+type field struct {
+    key   string
+    value interface{}
+}
+
+// keys used by the JSON records themselves, fields with these names get
+// prefixed so they don't overwrite them
+var reservedJSONKeys = map[string]bool {
+    "time":   true,
+    "level":  true,
+    "prefix": true,
+    "tag":    true,
+    "file":   true,
+    "line":   true,
+    "title":  true,
+    "msg":    true,
+}
+
+// Returns a logger that adds key=value to every message, after the text in
+// the text format and as a separate field in the JSON format. It follows
+// this logger's level and settings, and is cheap enough to create for a
+// single segment or request. Setting a key again replaces its value. Fields
+// aren't passed to hooks. Unless its own Output is set, it writes wherever
+// this logger writes at the time, including during CaptureOutput.
+func (l *Logger) WithField(key string, value interface{}) *Logger {
+    fields := make([]field, 0, len(l.fields) + 1)
+    for _, f := range l.fields {
+        if f.key != key {
+            fields = append(fields, f)
+        }
+    }
+    fields = append(fields, field { key: key, value: value })
+
+    l.mu.Lock()
+    timeFormat := l.timeFormat
+    l.mu.Unlock()
+
+    return &Logger {
+        discard:      l.discard,
+        exitOnFatal:  l.exitOnFatal,
+        fields:       fields,
+        followOutput: true,
+        minLevel:     levelInherit,
+        parent:       l,
+        tag:          l.tag,
+        timeFormat:   timeFormat,
+    }
+}
+
+func fieldString(v interface{}) string {
+    switch v := v.(type) {
+    case string:
+        return v
+    case error:
+        return v.Error()
+    case fmt.Stringer:
+        return v.String()
+    }
+    return fmt.Sprint(v)
+}
+
+func appendTextFields(buf *[]byte, fields []field) {
+    for _, f := range fields {
+        *buf = append(*buf, ' ')
+        *buf = append(*buf, f.key...)
+        *buf = append(*buf, '=')
+        s := fieldString(f.value)
+        if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+            *buf = strconv.AppendQuote(*buf, s)
+        } else {
+            *buf = append(*buf, s...)
+        }
+    }
+}
+
+// adds the fields to a JSON object that was just appended to buf
+func appendJSONFields(buf *[]byte, fields []field) {
+    if len(fields) == 0 {
+        return
+    }
+    //reopen the object
+    *buf = (*buf)[:len(*buf) - 1]
+    for _, f := range fields {
+        key := f.key
+        if reservedJSONKeys[key] {
+            key = "fields." + key
+        }
+        var value interface{}
+        switch v := f.value.(type) {
+        case error, fmt.Stringer:
+            value = fieldString(v)
+        default:
+            value = v
+        }
+        data, err := json.Marshal(value)
+        if err != nil {
+            data, _ = json.Marshal(fieldString(f.value))
+        }
+        keyData, _ := json.Marshal(key)
+        *buf = append(*buf, ',')
+        *buf = append(*buf, keyData...)
+        *buf = append(*buf, ':')
+        *buf = append(*buf, data...)
+    }
+    *buf = append(*buf, '}')
+}
@@ -1,6 +1,11 @@
 package log
 
-import "time"
+import (
+    "path"
+    "runtime"
+    "strings"
+    "time"
+)
 
 //code below is from https://cs.opensource.google/go/go/+/refs/tags/go1.17.2:src/log/log.go;l=103;drc=refs%2Ftags%2Fgo1.17.2
 
@@ -21,7 +26,31 @@ func itoa(buf *[]byte, i int, wid int) {
     *buf = append(*buf, b[bp:]...)
 }
 
-func formatTime(buf *[]byte, t time.Time) {
+// Time format presets, any other time.Format layout can also be used.
+// The JSON format always uses RFC3339 with nanoseconds, regardless of the
+// configured layout.
+const (
+    // date and time with microseconds, the default
+    TimeFull  = "2006/01/02 15:04:05.000000"
+    // only the time of day
+    TimeShort = "15:04:05"
+    // no timestamp at all
+    TimeNone  = ""
+)
+
+func formatTime(buf *[]byte, t time.Time, layout string) {
+    switch layout {
+    case TimeNone:
+        return
+    case TimeFull:
+        formatTimeFull(buf, t)
+    default:
+        *buf = t.AppendFormat(*buf, layout)
+        *buf = append(*buf, ' ')
+    }
+}
+
+func formatTimeFull(buf *[]byte, t time.Time) {
     //Ldate
     year, month, day := t.Date()
     itoa(buf, year, 4)
@@ -40,24 +69,76 @@ func formatTime(buf *[]byte, t time.Time) {
     itoa(buf, sec, 2)
     *buf = append(*buf, '.')
     itoa(buf, t.Nanosecond()/1e3, 6)
+
+    //UTC timestamps don't show the offset, for compatibility with older logs
+    if t.Location() != time.UTC {
+        _, offset := t.Zone()
+        sign := byte('+')
+        if offset < 0 {
+            sign = '-'
+            offset = -offset
+        }
+        *buf = append(*buf, ' ', sign)
+        itoa(buf, offset / 3600, 2)
+        *buf = append(*buf, ':')
+        itoa(buf, offset % 3600 / 60, 2)
+    }
     *buf = append(*buf, ' ')
 }
 
 func formatHeader(buf *[]byte, tag string, file string, line int) {
-    if len(tag) == 0 {
-        //Lshortfile
-        for i := len(file) - 1; i > 0; i-- {
-            if file[i] == '/' {
-                file = file[i+1:]
-                break
-            }
-        }
+    if len(tag) > 0 {
+        *buf = append(*buf, tag...)
+        *buf = append(*buf, ": "...)
+    }
+    if len(file) > 0 {
         *buf = append(*buf, file...)
         *buf = append(*buf, ':')
         itoa(buf, line, -1)
         *buf = append(*buf, ": "...)
-    } else {
-        *buf = append(*buf, tag...)
-        *buf = append(*buf, ": "...)
     }
 }
+
+// the directory of the module this package is in, with a trailing slash.
+// caller paths always use forward slashes, and with -trimpath they start
+// with the module path instead, which works the same.
+var moduleRoot = func() string {
+    _, file, _, ok := runtime.Caller(0)
+    if !ok {
+        return ""
+    }
+    //file is <root>/log/fmt.go
+    return path.Dir(path.Dir(file)) + "/"
+}()
+
+// the caller file as shown in logs, see SetRelativePaths
+func callerFile(file string, relative bool) string {
+    if !relative {
+        return shortFile(file)
+    }
+    return relativeFile(file)
+}
+
+// file relative to the module root, eg download/download.go. files of other
+// modules keep their directory, eg http/transport.go.
+func relativeFile(file string) string {
+    if moduleRoot != "" && strings.HasPrefix(file, moduleRoot) {
+        return file[len(moduleRoot):]
+    }
+    if i := strings.LastIndexByte(file, '/'); i > 0 {
+        if j := strings.LastIndexByte(file[:i], '/'); j >= 0 {
+            return file[j + 1:]
+        }
+    }
+    return file
+}
+
+//Lshortfile
+func shortFile(file string) string {
+    for i := len(file) - 1; i > 0; i-- {
+        if file[i] == '/' {
+            return file[i+1:]
+        }
+    }
+    return file
+}
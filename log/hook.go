@@ -0,0 +1,94 @@
+package log
+
+import (
+    "bytes"
+    "fmt"
+    "runtime"
+    "strconv"
+    "sync"
+)
+
+// Receives every record that passes level filtering, after it's written.
+// Hooks are called without any logger locks held. Records a hook logs
+// itself are written but don't call any hook again, so a hook logging
+// through the same logger doesn't recurse. Records logged meanwhile by
+// other goroutines still call the hooks.
+type Hook func(level Level, tag string, msg string)
+
+type hookEntry struct {
+    hook Hook
+}
+
+var hooks struct {
+    mu      sync.Mutex
+    entries []*hookEntry
+    // ids of the goroutines running hooks, see runHooks
+    running sync.Map
+}
+
+// Registers a hook called for each emitted log record. Returns a function
+// that removes the hook again.
+func RegisterHook(hook Hook) func() {
+    e := &hookEntry { hook: hook }
+
+    hooks.mu.Lock()
+    defer hooks.mu.Unlock()
+    //copy on write, so runHooks can iterate without holding the lock
+    entries := make([]*hookEntry, len(hooks.entries), len(hooks.entries) + 1)
+    copy(entries, hooks.entries)
+    hooks.entries = append(entries, e)
+
+    return func() {
+        hooks.mu.Lock()
+        defer hooks.mu.Unlock()
+        entries := make([]*hookEntry, 0, len(hooks.entries))
+        for _, v := range hooks.entries {
+            if v != e {
+                entries = append(entries, v)
+            }
+        }
+        hooks.entries = entries
+    }
+}
+
+func runHooks(level Level, tag string, msg string) {
+    hooks.mu.Lock()
+    entries := hooks.entries
+    hooks.mu.Unlock()
+    if len(entries) == 0 {
+        return
+    }
+
+    //records logged by a hook are skipped, or it'd be called again forever
+    id := goroutineID()
+    if _, nested := hooks.running.LoadOrStore(id, true); nested {
+        return
+    }
+    defer hooks.running.Delete(id)
+
+    for _, e := range entries {
+        runHook(e.hook, level, tag, msg)
+    }
+}
+
+func runHook(hook Hook, level Level, tag string, msg string) {
+    defer func() {
+        if r := recover(); r != nil {
+            //don't go through the logger, the hooks would be called again
+            doWrite(false, []byte(fmt.Sprintf("Log hook panicked: %v", r)))
+        }
+    }()
+    hook(level, tag, msg)
+}
+
+// the id of the calling goroutine, from the "goroutine N [...]" header of its
+// stack trace. Go doesn't expose it otherwise.
+func goroutineID() uint64 {
+    var buf [64]byte
+    header := bytes.TrimPrefix(buf[:runtime.Stack(buf[:], false)], []byte("goroutine "))
+    if i := bytes.IndexByte(header, ' '); i >= 0 {
+        header = header[:i]
+    }
+    id, _ := strconv.ParseUint(string(header), 10, 64)
+    return id
+}
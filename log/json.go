@@ -0,0 +1,60 @@
+package log
+
+import (
+    "encoding/json"
+    "time"
+)
+
+type Format int
+const (
+    // human readable lines, with progress shown at the bottom of the output
+    FormatText Format = iota
+    // one JSON object per line. progress updates are written as discrete
+    // events with level "progress" instead of being redrawn in place.
+    FormatJSON
+)
+
+type jsonRecord struct {
+    Time   string `json:"time"`
+    Level  string `json:"level"`
+    Prefix string `json:"prefix,omitempty"`
+    Tag    string `json:"tag,omitempty"`
+    File   string `json:"file,omitempty"`
+    Line   int    `json:"line,omitempty"`
+    Title  string `json:"title,omitempty"`
+    Msg    string `json:"msg"`
+}
+
+// Sets the format used for all log output. Defaults to FormatText.
+func SetFormat(format Format) {
+    progress.mu.Lock()
+    defer progress.mu.Unlock()
+    progress.format = format
+    progress.lines = 0
+}
+
+// The format set with SetFormat.
+func CurrentFormat() Format {
+    progress.mu.Lock()
+    defer progress.mu.Unlock()
+    return progress.format
+}
+
+func logTime() time.Time {
+    progress.mu.Lock()
+    defer progress.mu.Unlock()
+    return time.Now().In(progress.location)
+}
+
+func appendJSON(buf *[]byte, r *jsonRecord) {
+    data, err := json.Marshal(r)
+    if err != nil {
+        //only strings and ints, can't fail
+        panic(err)
+    }
+    *buf = append(*buf, data...)
+}
+
+func formatJSONTime(t time.Time) string {
+    return t.Format(time.RFC3339Nano)
+}
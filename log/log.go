@@ -1,13 +1,19 @@
 package log
 
 import (
+    "bytes"
     "fmt"
+    "io"
     "os"
     "runtime"
     stdlog "log"
+    "strconv"
     "strings"
     "sync"
+    "sync/atomic"
     "time"
+
+    "github.com/mattn/go-isatty"
 )
 
 type Level int
@@ -20,23 +26,6 @@ const (
 )
 const EndColor = "\033[0m"
 
-type ProgressCategory int
-const (
-    ProgressAudioDownload ProgressCategory = iota
-    ProgressVideoDownload
-    ProgressMerge
-)
-var progressOrder = []ProgressCategory {
-    ProgressAudioDownload,
-    ProgressVideoDownload,
-    ProgressMerge,
-}
-var progressNames = map[ProgressCategory]string {
-    ProgressAudioDownload: "audio",
-    ProgressVideoDownload: "video",
-    ProgressMerge:         "merge",
-}
-
 type levelInfo struct {
     name  string
     color string
@@ -50,42 +39,104 @@ var levels = map[Level]levelInfo {
 }
 const eraseRestOfLine  = "\033[K"
 
+const levelInherit = -1
+
+type colorMode int
+const (
+    colorAuto colorMode = iota
+    colorOn
+    colorOff
+)
+
 func moveCursorUp(buf *[]byte, lines int) {
     *buf = append(*buf, "\033["...)
     itoa(buf, lines, -1)
     *buf = append(*buf, 'A')
 }
 
+var levelAliases = map[string]Level {
+    "warning":     LevelWarn,
+    "err":         LevelError,
+    "information": LevelInfo,
+}
+
+// Parses a level name (case insensitive, eg "warn"), one of the aliases
+// "warning", "err" and "information", or a level number (0 for debug to 4
+// for fatal). Surrounding whitespace is ignored.
 func ParseLevel(name string) (Level, error) {
-    name = strings.ToLower(name)
+    name = strings.ToLower(strings.TrimSpace(name))
     for level, info := range levels {
         if name == info.name {
             return level, nil
         }
     }
+    if level, ok := levelAliases[name]; ok {
+        return level, nil
+    }
+    if n, err := strconv.Atoi(name); err == nil && n >= int(LevelDebug) && n <= int(LevelFatal) {
+        return Level(n), nil
+    }
     return LevelFatal, fmt.Errorf("Invalid log level '%s'", name)
 }
 
 type Logger struct {
-    buf         []byte
-    extraFrames int
-    mu          sync.Mutex
-    minLevel    Level
-    tag         string
-}
-
-type progressStatus struct {
-    title   string
-    message string
+    // where to write logs to, nil uses the writer set with SetOutput.
+    // progress is only shown on the package output.
+    Output       io.Writer
+    buf          []byte
+    // serializes CaptureOutput calls
+    captureMu    sync.Mutex
+    // see NewDiscard
+    discard      bool
+    exitOnFatal  bool
+    extraFrames  int
+    // key/value context added with WithField
+    fields       []field
+    // without an Output, write to the parent's output, for WithField
+    followOutput bool
+    mu           sync.Mutex
+    // minimum level to log, levelInherit uses the parent's level
+    minLevel     int32
+    parent       *Logger
+    // shown before the tag, nil uses the parent's
+    prefix       *string
+    tag          string
+    // overrides the package time format if set
+    timeFormat   *string
 }
 
 var progress struct {
     mu          sync.Mutex
+    output      io.Writer
+    // see SetProgressOutput, nil to show progress on output
+    progressOut io.Writer
+    // whether colors and the window title are used for the progress lines
+    progColor   bool
+    // the progress writer isn't a terminal, so progress is written as
+    // occasional plain lines instead of being redrawn in place
+    plain       bool
+    lastPlain   time.Time
     buf         []byte
     titleBuf    []byte
+    // whether the window title was changed, see ResetTerminal
+    titleSet    bool
     status      map[ProgressCategory]progressStatus
     windowName  string
-    wroteStatus bool
+    // progress categories, in the order they're shown
+    order       []ProgressCategory
+    names       map[ProgressCategory]string
+    // how many progress lines are currently shown
+    lines       int
+    colorMode   colorMode
+    color       bool
+    format      Format
+    location    *time.Location
+    timeFormat  string
+    showCaller  bool
+    // see SetRelativePaths
+    relative    bool
+    // terminal width progress lines are cut to, 0 if unknown
+    width       int
 }
 
 var DefaultLogger *Logger
@@ -94,64 +145,236 @@ func init() {
     DefaultLogger = &Logger {
         extraFrames: 1,
     }
+    fatalExit.code = 1
+    fatalExit.exit = os.Exit
+    progress.output = os.Stderr
+    if !enableVirtualTerminal() {
+        progress.colorMode = colorOff
+    }
+    progress.location = time.UTC
+    progress.timeFormat = TimeFull
+    progress.color = useColor(progress.colorMode, progress.output)
+    updateProgressOutput()
     progress.status = make(map[ProgressCategory]progressStatus)
+    progress.names = make(map[ProgressCategory]string)
+    for _, name := range []string { "audio", "video", "merge" } {
+        RegisterProgress(name)
+    }
     stdlog.SetFlags(stdlog.Ldate | stdlog.Lmicroseconds | stdlog.Lshortfile)
     stdlog.SetOutput(stdLogProxy {})
 }
 
+func isTerminal(w io.Writer) bool {
+    f, ok := w.(*os.File)
+    if !ok {
+        return false
+    }
+    return isatty.IsTerminal(f.Fd()) || isatty.IsCygwinTerminal(f.Fd())
+}
+
+// colors are used when forced on, or in auto mode when writing to a
+// terminal and NO_COLOR isn't set (https://no-color.org)
+func useColor(mode colorMode, w io.Writer) bool {
+    switch mode {
+    case colorOn:
+        return true
+    case colorOff:
+        return false
+    }
+    if os.Getenv("NO_COLOR") != "" {
+        return false
+    }
+    return isTerminal(w)
+}
+
+// removes color escape sequences (ESC [ ... m) from s
+func stripColors(s string) string {
+    if strings.IndexByte(s, '\033') < 0 {
+        return s
+    }
+    var b strings.Builder
+    for i := 0; i < len(s); i++ {
+        if s[i] == '\033' && i + 1 < len(s) && s[i + 1] == '[' {
+            j := i + 2
+            for j < len(s) && (s[j] == ';' || (s[j] >= '0' && s[j] <= '9')) {
+                j++
+            }
+            if j < len(s) && s[j] == 'm' {
+                i = j
+                continue
+            }
+        }
+        b.WriteByte(s[i])
+    }
+    return b.String()
+}
+
+// Enables or disables colored output. By default, colors are only used when
+// the output is a terminal and the NO_COLOR environment variable isn't set.
+// Disabling colors also disables setting the window title.
+func SetColorEnabled(enabled bool) {
+    progress.mu.Lock()
+    defer progress.mu.Unlock()
+    if enabled {
+        progress.colorMode = colorOn
+    } else {
+        progress.colorMode = colorOff
+    }
+    progress.color = useColor(progress.colorMode, progress.output)
+    progress.progColor = useColor(progress.colorMode, progressWriter())
+}
+
 func doWrite(isProgress bool, data []byte) (int, error) {
+    var queued bool
+    if isProgress && data == nil {
+        //redraws skip the queue, so the progress doesn't lag behind
+        queued = requestRedraw()
+    } else {
+        queued = enqueue(nil, data, false)
+    }
+    if !queued {
+        writeBatch([]record { { data: data } })
+    }
+    return len(data), nil
+}
+
+// writes a log line to a writer other than the package output, without
+// any progress handling. still serialized with all other writes.
+func doWriteTo(w io.Writer, data []byte, mustWrite bool) (int, error) {
+    if enqueue(w, data, mustWrite) {
+        return len(data), nil
+    }
+
     progress.mu.Lock()
     defer progress.mu.Unlock()
 
-    progress.buf = progress.buf[:0]
-    progress.titleBuf = progress.titleBuf[:0]
+    progress.buf = append(progress.buf[:0], data...)
+    progress.buf = append(progress.buf, '\n')
+    if _, err := w.Write(progress.buf); err != nil {
+        return 0, err
+    }
+    return len(data), nil
+}
+
+type stdLogProxy struct {}
 
-    if progress.wroteStatus {
-        moveCursorUp(&progress.buf, len(progressOrder))
+func (_ stdLogProxy) Write(p []byte) (int, error) {
+    n := len(p)
+    progress.mu.Lock()
+    relative := progress.relative
+    progress.mu.Unlock()
+    if relative && moduleRoot != "" {
+        //Llongfile shows the full path, only keep the part in the module
+        p = bytes.Replace(p, []byte(moduleRoot), nil, 1)
     }
+    if CurrentFormat() == FormatJSON {
+        var buf []byte
+        appendJSON(&buf, &jsonRecord {
+            Time:  formatJSONTime(logTime()),
+            Level: levels[LevelInfo].name,
+            Tag:   "stdlog",
+            Msg:   strings.TrimSuffix(string(p), "\n"),
+        })
+        doWrite(false, buf)
+        return n, nil
+    }
+    if _, err := doWrite(false, p); err != nil {
+        return 0, err
+    }
+    return n, nil
+}
 
-    if len(data) > 0 {
-        progress.buf = append(progress.buf, data...)
-        progress.buf = append(progress.buf, eraseRestOfLine...)
-        progress.buf = append(progress.buf, '\n')
+// Sets where logs are written to, and progress too unless a separate writer
+// was set with SetProgressOutput. Defaults to os.Stderr.
+func SetOutput(w io.Writer) {
+    progress.mu.Lock()
+    defer progress.mu.Unlock()
+    progress.output = w
+    progress.color = useColor(progress.colorMode, w)
+    if progress.progressOut == nil {
+        updateProgressOutput()
+        //nothing has been written to the new output yet
+        progress.lines = 0
     }
+}
 
-    for i, c := range progressOrder {
-        if i > 0 {
-            progress.titleBuf = append(progress.titleBuf, '/')
-        }
+// Shows progress on w instead of the log output, eg to keep a terminal
+// progress display while logs go to a file. nil goes back to the log output.
+//
+// Progress is only redrawn in place when its writer is a terminal. Otherwise,
+// such as when redirected to a file, the progress lines are written as plain
+// lines every 30 seconds, and once more by ResetTerminal.
+func SetProgressOutput(w io.Writer) {
+    progress.mu.Lock()
+    defer progress.mu.Unlock()
+    progress.progressOut = w
+    updateProgressOutput()
+    progress.lines = 0
+}
 
-        progress.buf = append(progress.buf, progressNames[c]...)
-        progress.buf = append(progress.buf, ": "...)
-        s, ok := progress.status[c]
-        if !ok {
-            progress.buf = append(progress.buf, "???"...)
-            progress.titleBuf = append(progress.titleBuf, "???"...)
-        } else {
-            progress.buf = append(progress.buf, s.message...)
-            progress.titleBuf = append(progress.titleBuf, s.title...)
-        }
-        progress.buf = append(progress.buf, eraseRestOfLine...)
-        progress.buf = append(progress.buf, '\n')
+// where progress lines are written. requires progress.mu to be held.
+func progressWriter() io.Writer {
+    if progress.progressOut != nil {
+        return progress.progressOut
     }
-    progress.buf = append(progress.buf, "\033]0;"...)
-    progress.buf = append(progress.buf, progress.titleBuf...)
-    if progress.windowName != "" {
-        progress.buf = append(progress.buf, ' ')
-        progress.buf = append(progress.buf, progress.windowName...)
+    return progress.output
+}
+
+// updates what depends on the progress writer. requires progress.mu to be
+// held.
+func updateProgressOutput() {
+    w := progressWriter()
+    progress.progColor = useColor(progress.colorMode, w)
+    progress.plain = !isTerminal(w)
+    progress.lastPlain = time.Time {}
+    updateTerminalWidth()
+}
+
+// Sets the time zone used for log timestamps. Defaults to UTC.
+func SetTimeLocation(loc *time.Location) {
+    if loc == nil {
+        loc = time.UTC
     }
-    progress.buf = append(progress.buf, '\007')
-    progress.wroteStatus = true
+    progress.mu.Lock()
+    defer progress.mu.Unlock()
+    progress.location = loc
+}
 
-    os.Stderr.Write(progress.buf)
+// Sets the layout used for log timestamps (see time.Format), or one of
+// the TimeFull, TimeShort and TimeNone presets. Defaults to TimeFull.
+// Has no effect on the JSON format.
+func SetTimeFormat(layout string) {
+    progress.mu.Lock()
+    defer progress.mu.Unlock()
+    progress.timeFormat = layout
+}
 
-    return len(data), nil
+// Shows the caller's file:line for loggers with a tag too, not only for the
+// default logger. The JSON format always includes it.
+func SetShowCaller(show bool) {
+    progress.mu.Lock()
+    defer progress.mu.Unlock()
+    progress.showCaller = show
 }
 
-type stdLogProxy struct {}
+// Shows caller files relative to the module root, eg download/download.go,
+// instead of only their name, so files with the same name in different
+// packages can be told apart. Files of other modules are shown with their
+// directory. Also applies to the standard library logger.
+func SetRelativePaths(relative bool) {
+    progress.mu.Lock()
+    defer progress.mu.Unlock()
+    progress.relative = relative
+    if relative {
+        stdlog.SetFlags(stdlog.Ldate | stdlog.Lmicroseconds | stdlog.Llongfile)
+    } else {
+        stdlog.SetFlags(stdlog.Ldate | stdlog.Lmicroseconds | stdlog.Lshortfile)
+    }
+}
 
-func (_ stdLogProxy) Write(p []byte) (int, error) {
-    return doWrite(false, p)
+// Uses the local time zone for log timestamps.
+func SetLocalTime() {
+    SetTimeLocation(time.Local)
 }
 
 func SetWindowName(name string) {
@@ -160,84 +383,294 @@ func SetWindowName(name string) {
     progress.windowName = name
 }
 
-func Progress(category ProgressCategory, title string, message string) {
-    func() {
-        progress.mu.Lock()
-        defer progress.mu.Unlock()
-        progress.status[category] = progressStatus {
-            title:   title,
-            message: message,
-        }
-    }()
-    doWrite(true, nil)
+var fatalExit struct {
+    mu   sync.Mutex
+    code int
+    exit func(int)
+}
+
+// Sets the exit code used after logging at LevelFatal. Defaults to 1.
+func SetFatalExitCode(code int) {
+    fatalExit.mu.Lock()
+    defer fatalExit.mu.Unlock()
+    fatalExit.code = code
+}
+
+// Replaces the function called to exit after logging at LevelFatal, nil
+// restores os.Exit. Mostly useful for tests, the function is expected not
+// to return (eg by calling runtime.Goexit), otherwise the caller of Fatal
+// keeps running.
+func SetExitFunc(exit func(int)) {
+    if exit == nil {
+        exit = os.Exit
+    }
+    fatalExit.mu.Lock()
+    defer fatalExit.mu.Unlock()
+    fatalExit.exit = exit
+}
+
+func exitFatal() {
+    ResetTerminal()
+
+    fatalExit.mu.Lock()
+    code, exit := fatalExit.code, fatalExit.exit
+    fatalExit.mu.Unlock()
+
+    exit(code)
 }
 
 func SetDefaultLevel(level Level) {
-    DefaultLogger.minLevel = level
+    DefaultLogger.SetLevel(level)
 }
 
+// Creates a logger that uses the default level unless SetLevel is called on it.
 func New(tag string) *Logger {
     return &Logger {
-        minLevel: DefaultLogger.minLevel,
+        minLevel: levelInherit,
         tag:      tag,
     }
 }
 
+// Sets the minimum level for this logger and any sub loggers that
+// don't have their own level set.
+func (l *Logger) SetLevel(level Level) {
+    atomic.StoreInt32(&l.minLevel, int32(level))
+}
+
+// Removes the level set with SetLevel, going back to the parent's level.
+func (l *Logger) ResetLevel() {
+    if l == DefaultLogger {
+        return
+    }
+    atomic.StoreInt32(&l.minLevel, levelInherit)
+}
+
+// The minimum level currently logged by this logger, at least LevelWarn
+// in quiet mode.
+func (l *Logger) Level() Level {
+    level := l.ownLevel()
+    if level < LevelWarn && isQuiet() {
+        return LevelWarn
+    }
+    return level
+}
+
+// Whether a record at level would be logged. Use it to skip building
+// expensive log arguments that would be thrown away:
+//
+//     if logger.Enabled(log.LevelDebug) {
+//         logger.Debugf("State: %s", dumpState())
+//     }
+//
+// Always false for discarding loggers. Hooks only see records that pass this
+// check too.
+func (l *Logger) Enabled(level Level) bool {
+    return !l.discard && level >= l.Level()
+}
+
+// Whether DefaultLogger logs records at level, see Logger.Enabled.
+func Enabled(level Level) bool {
+    return DefaultLogger.Enabled(level)
+}
+
+func (l *Logger) ownLevel() Level {
+    for ; l != nil; l = l.parent {
+        if level := atomic.LoadInt32(&l.minLevel); level != levelInherit {
+            return Level(level)
+        }
+    }
+    return Level(atomic.LoadInt32(&DefaultLogger.minLevel))
+}
+
+// Overrides the package time format (see SetTimeFormat) for this logger.
+func (l *Logger) SetTimeFormat(layout string) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    l.timeFormat = &layout
+}
+
+// Sets a prefix shown on every line of this logger and its sub loggers
+// that don't have their own, before the tag. Useful to tell apart the logs
+// of concurrent jobs. Loggers without a parent use the prefix of
+// DefaultLogger. In the JSON format, it's added as a "prefix" field.
+func (l *Logger) SetPrefix(prefix string) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    l.prefix = &prefix
+}
+
+// Removes the prefix set with SetPrefix, going back to the parent's.
+func (l *Logger) ResetPrefix() {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    l.prefix = nil
+}
+
+func (l *Logger) getPrefix() string {
+    for ; l != nil; l = l.parent {
+        l.mu.Lock()
+        prefix := l.prefix
+        l.mu.Unlock()
+        if prefix != nil {
+            return *prefix
+        }
+    }
+    DefaultLogger.mu.Lock()
+    defer DefaultLogger.mu.Unlock()
+    if DefaultLogger.prefix != nil {
+        return *DefaultLogger.prefix
+    }
+    return ""
+}
+
+// Creates a child logger. Unless SetLevel is called on the child, it follows
+// this logger's level, including later changes.
 func (l *Logger) SubLogger(tag string) *Logger {
-    return New(fmt.Sprintf("%s.%s", l.tag, tag))
+    sub := New(fmt.Sprintf("%s.%s", l.tag, tag))
+    sub.parent = l
+    sub.fields = l.fields
+    sub.discard = l.discard
+    sub.exitOnFatal = l.exitOnFatal
+    return sub
 }
 
 func (l *Logger) output(level Level, calldepth int, s string) {
-    now := time.Now().UTC()
-    var file string
-    var line int
-
-    if len(l.tag) == 0 {
-        var ok bool
-        _, file, line, ok = runtime.Caller(calldepth + l.extraFrames)
-        if !ok {
-            file = "???"
-            line = 0
-        }
+    now := time.Now()
+
+    //calldepth counts the frames of logf/log and output itself, so the
+    //caller of Debug/Info/etc is found. extraFrames accounts for the
+    //package level functions wrapping DefaultLogger.
+    _, file, line, ok := runtime.Caller(calldepth + l.extraFrames)
+    if !ok {
+        file = "???"
+        line = 0
     }
+    progress.mu.Lock()
+    format := progress.format
+    showCaller := progress.showCaller || len(l.tag) == 0
+    relative := progress.relative
+    now = now.In(progress.location)
+    timeFormat := progress.timeFormat
+    colorMode, color := progress.colorMode, progress.color
+    progress.mu.Unlock()
+
+    prefix := l.getPrefix()
+
     l.mu.Lock()
     defer l.mu.Unlock()
 
+    //Output is read under l.mu, as CaptureOutput swaps it
+    out := l.outputWriter()
+    if out != nil {
+        color = useColor(colorMode, out)
+    }
+
     l.buf = l.buf[:0]
 
     info := levels[level]
-    l.buf = append(l.buf, info.color...)
-    formatTime(&l.buf, now)
+    file = callerFile(file, relative)
+    if format == FormatJSON {
+        appendJSON(&l.buf, &jsonRecord {
+            Time:   formatJSONTime(now),
+            Level:  info.name,
+            Prefix: prefix,
+            Tag:    l.tag,
+            File:   file,
+            Line:   line,
+            Msg:    strings.TrimSuffix(s, "\n"),
+        })
+        appendJSONFields(&l.buf, l.fields)
+        l.write(level, out)
+        return
+    }
+
+    if color {
+        l.buf = append(l.buf, info.color...)
+    }
+    if l.timeFormat != nil {
+        timeFormat = *l.timeFormat
+    }
+    formatTime(&l.buf, now, timeFormat)
     l.buf = append(l.buf, info.name...)
     l.buf = append(l.buf, ": "...)
     for i := len(info.name); i < 5; i++ {
         l.buf = append(l.buf, ' ')
     }
 
+    if !showCaller {
+        file = ""
+    }
+    if prefix != "" {
+        l.buf = append(l.buf, '[')
+        l.buf = append(l.buf, prefix...)
+        l.buf = append(l.buf, "] "...)
+    }
     formatHeader(&l.buf, l.tag, file, line)
     l.buf = append(l.buf, s...)
     if len(s) > 0 && s[len(s)-1] == '\n' {
         l.buf = l.buf[:len(l.buf) - 1]
     }
-    l.buf = append(l.buf, EndColor...)
-    doWrite(false, l.buf)
+    appendTextFields(&l.buf, l.fields)
+    if color {
+        l.buf = append(l.buf, EndColor...)
+    }
+    l.write(level, out)
+}
+
+// where records of this logger are written, nil for the package output.
+// resolved at write time for WithField loggers, so they follow their
+// parent's Output as it changes. requires l.mu to be held.
+func (l *Logger) outputWriter() io.Writer {
+    if l.Output != nil || !l.followOutput || l.parent == nil {
+        return l.Output
+    }
+    l.parent.mu.Lock()
+    defer l.parent.mu.Unlock()
+    return l.parent.outputWriter()
+}
+
+//requires l.mu to be held
+func (l *Logger) write(level Level, out io.Writer) {
+    //errors are never dropped in async mode
+    mustWrite := level >= LevelError
+    if out != nil {
+        doWriteTo(out, l.buf, mustWrite)
+    } else if !enqueue(nil, l.buf, mustWrite) {
+        writeBatch([]record { { data: l.buf } })
+    }
 }
 
 func (l *Logger) logf(level Level, format string, v ...interface{}) {
-    if int(level) >= int(l.minLevel) {
-        l.output(level, 3, fmt.Sprintf(format, v...))
+    if l.discard {
+        l.discardMessage(level)
+        return
+    }
+    if level >= l.Level() {
+        msg := fmt.Sprintf(format, v...)
+        if !l.checkRepeat(level, msg) {
+            l.output(level, 3, msg)
+            runHooks(level, l.tag, msg)
+        }
     }
     if level == LevelFatal {
-        os.Exit(1)
+        exitFatal()
     }
 }
 
 func (l *Logger) log(level Level, v ...interface{}) {
-    if int(level) >= int(l.minLevel) {
-        l.output(level, 3, fmt.Sprint(v...))
+    if l.discard {
+        l.discardMessage(level)
+        return
+    }
+    if level >= l.Level() {
+        msg := fmt.Sprint(v...)
+        if !l.checkRepeat(level, msg) {
+            l.output(level, 3, msg)
+            runHooks(level, l.tag, msg)
+        }
     }
     if level == LevelFatal {
-        os.Exit(1)
+        exitFatal()
     }
 }
 
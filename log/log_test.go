@@ -0,0 +1,93 @@
+package log
+
+import (
+    "bytes"
+    "strings"
+    "testing"
+)
+
+func TestSetLevelIsIndependent(t *testing.T) {
+    parent := New("parent")
+    parent.SetLevel(LevelInfo)
+    child := parent.SubLogger("child")
+    sibling := parent.SubLogger("sibling")
+
+    child.SetLevel(LevelError)
+    if level := parent.Level(); level != LevelInfo {
+        t.Errorf("Parent level changed to %v by its child", level)
+    }
+    if level := sibling.Level(); level != LevelInfo {
+        t.Errorf("Sibling level changed to %v by another child", level)
+    }
+    if level := child.Level(); level != LevelError {
+        t.Errorf("Child level is %v instead of %v", level, LevelError)
+    }
+
+    //children without their own level still follow later parent changes
+    parent.SetLevel(LevelDebug)
+    if level := sibling.Level(); level != LevelDebug {
+        t.Errorf("Sibling level is %v instead of following the parent's %v", level, LevelDebug)
+    }
+    if level := child.Level(); level != LevelError {
+        t.Errorf("Child level changed to %v by its parent", level)
+    }
+}
+
+func TestResetLevelFollowsParent(t *testing.T) {
+    parent := New("parent")
+    parent.SetLevel(LevelWarn)
+    child := parent.SubLogger("child")
+
+    child.SetLevel(LevelDebug)
+    child.ResetLevel()
+    if level := child.Level(); level != LevelWarn {
+        t.Errorf("Child level is %v after reset instead of the parent's %v", level, LevelWarn)
+    }
+
+    parent.SetLevel(LevelError)
+    if level := child.Level(); level != LevelError {
+        t.Errorf("Child level is %v after reset instead of following the parent's %v", level, LevelError)
+    }
+}
+
+func TestWithFieldFollowsCapturedOutput(t *testing.T) {
+    var out bytes.Buffer
+    parent := New("parent")
+    parent.Output = &out
+    before := parent.WithField("when", "before")
+
+    var during *Logger
+    captured := parent.CaptureOutput(func() {
+        during = parent.WithField("when", "during")
+        before.Info("first")
+        during.Info("second")
+    })
+    during.Info("third")
+
+    if !bytes.Contains(captured, []byte("first")) || !bytes.Contains(captured, []byte("second")) {
+        t.Errorf("Records of WithField loggers weren't captured: %q", captured)
+    }
+    if bytes.Contains(captured, []byte("third")) || !strings.Contains(out.String(), "third") {
+        t.Errorf("Record after the capture went to %q instead of the restored output", captured)
+    }
+}
+
+func TestHookLoggingDoesNotRecurse(t *testing.T) {
+    logger := New("hook")
+    logger.Output = &bytes.Buffer {}
+    calls := 0
+    remove := RegisterHook(func(level Level, tag string, msg string) {
+        calls++
+        logger.Info("logged from the hook")
+    })
+    defer remove()
+
+    logger.Info("first")
+    if calls != 1 {
+        t.Errorf("Hook called %d times instead of once", calls)
+    }
+    logger.Info("second")
+    if calls != 2 {
+        t.Errorf("Hook not called again after returning, called %d times", calls)
+    }
+}
@@ -0,0 +1,182 @@
+package log
+
+import (
+    "time"
+)
+
+// Identifies a progress line. Each registered category is shown on its own
+// line below the regular log output, in registration order, once it has a
+// status set.
+type ProgressCategory int
+const (
+    ProgressAudioDownload ProgressCategory = iota
+    ProgressVideoDownload
+    ProgressMerge
+)
+
+const eraseDown = "\033[J"
+
+// how often progress is written when its writer isn't a terminal
+const plainProgressInterval = 30 * time.Second
+
+type progressStatus struct {
+    title   string
+    message string
+}
+
+// Registers a new progress line shown as "name: message". The audio, video
+// and merge categories are always registered.
+func RegisterProgress(name string) ProgressCategory {
+    progress.mu.Lock()
+    defer progress.mu.Unlock()
+
+    c := ProgressCategory(len(progress.names))
+    progress.names[c] = name
+    progress.order = append(progress.order, c)
+    return c
+}
+
+// Stops showing a progress line until its status is set again.
+func RemoveProgress(category ProgressCategory) {
+    func() {
+        progress.mu.Lock()
+        defer progress.mu.Unlock()
+        delete(progress.status, category)
+    }()
+    doWrite(true, nil)
+}
+
+func Progress(category ProgressCategory, title string, message string) {
+    if isQuiet() {
+        return
+    }
+    format, name := func() (Format, string) {
+        progress.mu.Lock()
+        defer progress.mu.Unlock()
+        progress.status[category] = progressStatus {
+            title:   title,
+            message: message,
+        }
+        return progress.format, progress.names[category]
+    }()
+    if format == FormatJSON {
+        var buf []byte
+        appendJSON(&buf, &jsonRecord {
+            Time:  formatJSONTime(logTime()),
+            Level: "progress",
+            Tag:   name,
+            Title: title,
+            Msg:   stripColors(message),
+        })
+        doWrite(false, buf)
+        return
+    }
+    doWrite(true, nil)
+}
+
+// appends the lines of all active categories and the window title to
+// progress.buf. requires progress.mu to be held.
+func appendProgressLines() {
+    progress.titleBuf = progress.titleBuf[:0]
+
+    lines := 0
+    for _, c := range progress.order {
+        s, ok := progress.status[c]
+        if !ok {
+            continue
+        }
+        if lines > 0 {
+            progress.titleBuf = append(progress.titleBuf, '/')
+        }
+        lines++
+
+        message := s.message
+        if !progress.progColor {
+            message = stripColors(message)
+        }
+        //a wrapped line would break redrawing the lines in place
+        appendTruncated(&progress.buf, progress.names[c] + ": " + message, progress.width, progress.progColor)
+        progress.titleBuf = append(progress.titleBuf, s.title...)
+        progress.buf = append(progress.buf, eraseRestOfLine...)
+        progress.buf = append(progress.buf, '\n')
+    }
+    //clear leftovers if there are less lines than last time
+    if lines < progress.lines {
+        progress.buf = append(progress.buf, eraseDown...)
+    }
+    progress.lines = lines
+
+    if progress.progColor && lines > 0 {
+        progress.buf = append(progress.buf, "\033]0;"...)
+        progress.buf = append(progress.buf, progress.titleBuf...)
+        if progress.windowName != "" {
+            progress.buf = append(progress.buf, ' ')
+            progress.buf = append(progress.buf, progress.windowName...)
+        }
+        progress.buf = append(progress.buf, '\007')
+        progress.titleSet = true
+    }
+}
+
+// appends the active categories as plain info lines, without colors or
+// escape sequences, if plainProgressInterval passed since they were last
+// written or force is set. requires progress.mu to be held.
+func appendPlainProgress(force bool) {
+    now := time.Now()
+    if !force && now.Sub(progress.lastPlain) < plainProgressInterval {
+        return
+    }
+    written := false
+    for _, c := range progress.order {
+        s, ok := progress.status[c]
+        if !ok {
+            continue
+        }
+        formatTime(&progress.buf, now.In(progress.location), progress.timeFormat)
+        progress.buf = append(progress.buf, "info:  "...)
+        progress.buf = append(progress.buf, progress.names[c]...)
+        progress.buf = append(progress.buf, ": "...)
+        progress.buf = append(progress.buf, stripColors(s.message)...)
+        progress.buf = append(progress.buf, '\n')
+        written = true
+    }
+    //wait for the next interval only once something was written, so the
+    //first status shows up right away
+    if written {
+        progress.lastPlain = now
+    }
+}
+
+// Erases the progress lines and resets the window title, so the terminal
+// is left clean. The progress statuses are cleared too, they're only shown
+// again once set again. If the progress writer isn't a terminal, the last
+// statuses are written once as plain lines instead. Should be called before
+// exiting, eg deferred in main. Fatal calls it before exiting.
+func ResetTerminal() {
+    Flush()
+
+    progress.mu.Lock()
+    defer progress.mu.Unlock()
+
+    progress.buf = progress.buf[:0]
+    if progress.format == FormatText && progress.plain {
+        appendPlainProgress(true)
+        progress.lastPlain = time.Time {}
+    }
+    progress.status = make(map[ProgressCategory]progressStatus)
+    if progress.format != FormatText {
+        return
+    }
+    if progress.lines > 0 {
+        moveCursorUp(&progress.buf, progress.lines)
+        progress.buf = append(progress.buf, eraseDown...)
+        progress.lines = 0
+    }
+    if progress.titleSet {
+        progress.buf = append(progress.buf, "\033]0;\007"...)
+        progress.titleSet = false
+    }
+    if len(progress.buf) > 0 {
+        progressWriter().Write(progress.buf)
+    }
+}
@@ -0,0 +1,88 @@
+package log
+
+import (
+    "fmt"
+    "sync"
+)
+
+// tracks the last emitted message, to collapse runs of identical ones
+var repeats struct {
+    mu        sync.Mutex
+    // how many identical messages in a row are shown, 0 disables collapsing
+    threshold int
+    logger    *Logger
+    level     Level
+    msg       string
+    count     int
+}
+
+// Collapses runs of identical messages (same logger, level and text): after
+// n of them are shown, the rest are dropped and a single "last message
+// repeated N times" line is written once a different message is logged or
+// FlushRepeats is called. 0 disables collapsing, which is the default.
+// Fatal messages are never dropped.
+func SetRepeatThreshold(n int) {
+    if n < 0 {
+        n = 0
+    }
+    repeats.mu.Lock()
+    defer repeats.mu.Unlock()
+    repeats.threshold = n
+    repeats.logger = nil
+    repeats.count = 0
+}
+
+// Writes the "last message repeated" line for the current run of identical
+// messages, if any of them were dropped.
+func FlushRepeats() {
+    repeats.mu.Lock()
+    prev, level, dropped := takeRepeats()
+    repeats.mu.Unlock()
+
+    if dropped > 0 {
+        prev.output(level, 2 - prev.extraFrames, repeatedMessage(dropped))
+    }
+}
+
+func repeatedMessage(n int) string {
+    if n == 1 {
+        return "last message repeated 1 time"
+    }
+    return fmt.Sprintf("last message repeated %d times", n)
+}
+
+//requires repeats.mu to be held
+func takeRepeats() (*Logger, Level, int) {
+    prev, level, dropped := repeats.logger, repeats.level, repeats.count - repeats.threshold
+    repeats.logger = nil
+    repeats.count = 0
+    return prev, level, dropped
+}
+
+// Returns whether msg should be dropped as a repeat of the previous message.
+// Called from logf/log, before the message is written.
+func (l *Logger) checkRepeat(level Level, msg string) bool {
+    repeats.mu.Lock()
+    if repeats.threshold == 0 || level == LevelFatal {
+        repeats.mu.Unlock()
+        return false
+    }
+    if repeats.logger == l && repeats.level == level && repeats.msg == msg {
+        repeats.count++
+        drop := repeats.count > repeats.threshold
+        repeats.mu.Unlock()
+        return drop
+    }
+    prev, prevLevel, dropped := takeRepeats()
+    repeats.logger = l
+    repeats.level = level
+    repeats.msg = msg
+    repeats.count = 1
+    repeats.mu.Unlock()
+
+    if dropped > 0 {
+        //reported at the location of the message ending the run
+        prev.output(prevLevel, 4 + l.extraFrames - prev.extraFrames, repeatedMessage(dropped))
+    }
+    return false
+}
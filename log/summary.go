@@ -0,0 +1,60 @@
+package log
+
+import (
+    "fmt"
+    "strings"
+    "sync/atomic"
+    "time"
+)
+
+var quiet int32
+
+// Hides progress lines and messages below LevelWarn from all loggers, for
+// scripted runs. Unlike raising the level, Summary lines are still written.
+func SetQuiet(enabled bool) {
+    var v int32
+    if enabled {
+        v = 1
+    }
+    atomic.StoreInt32(&quiet, v)
+    if enabled {
+        //remove lines that were already shown
+        progress.mu.Lock()
+        progress.status = make(map[ProgressCategory]progressStatus)
+        progress.mu.Unlock()
+        doWrite(true, nil)
+    }
+}
+
+func isQuiet() bool {
+    return atomic.LoadInt32(&quiet) != 0
+}
+
+// Writes the final outcome of a run. Always written regardless of the log
+// level and quiet mode, and never dropped in async mode. Not passed to
+// hooks.
+func Summary(format string, v ...interface{}) {
+    msg := strings.TrimSuffix(fmt.Sprintf(format, v...), "\n")
+
+    progress.mu.Lock()
+    jsonFormat := progress.format == FormatJSON
+    now := time.Now().In(progress.location)
+    timeFormat := progress.timeFormat
+    progress.mu.Unlock()
+
+    var buf []byte
+    if jsonFormat {
+        appendJSON(&buf, &jsonRecord {
+            Time:  formatJSONTime(now),
+            Level: "summary",
+            Msg:   msg,
+        })
+    } else {
+        formatTime(&buf, now, timeFormat)
+        buf = append(buf, "summary: "...)
+        buf = append(buf, msg...)
+    }
+    if !enqueue(nil, buf, true) {
+        writeBatch([]record { { data: buf } })
+    }
+}
@@ -0,0 +1,76 @@
+package log
+
+import (
+    "sync"
+    "unicode/utf8"
+)
+
+const ellipsis = "…"
+
+var resizeWatch sync.Once
+
+// The width of the terminal progress is written to, in columns. 0 if it
+// isn't a terminal or its size is unknown.
+func TerminalWidth() int {
+    progress.mu.Lock()
+    defer progress.mu.Unlock()
+    return progress.width
+}
+
+// queries the width of the progress writer, and starts watching for resizes
+// if it's a terminal. requires progress.mu to be held.
+func updateTerminalWidth() {
+    progress.width = terminalWidth(progressWriter())
+    if progress.width > 0 {
+        resizeWatch.Do(func() {
+            go watchResize(refreshTerminalWidth)
+        })
+    }
+}
+
+func refreshTerminalWidth() {
+    progress.mu.Lock()
+    defer progress.mu.Unlock()
+    progress.width = terminalWidth(progressWriter())
+}
+
+// appends s to buf, cut to at most width visible columns with an ellipsis
+// if it's longer. escape sequences don't count towards the width, runes
+// count as one column each. width <= 0 disables truncation.
+func appendTruncated(buf *[]byte, s string, width int, color bool) {
+    if width <= 0 {
+        *buf = append(*buf, s...)
+        return
+    }
+    columns := 0
+    for i := 0; i < len(s); {
+        if s[i] == '\033' && i + 1 < len(s) && s[i + 1] == '[' {
+            j := i + 2
+            for j < len(s) && (s[j] < 0x40 || s[j] > 0x7e) {
+                j++
+            }
+            if j < len(s) {
+                j++
+            }
+            *buf = append(*buf, s[i:j]...)
+            i = j
+            continue
+        }
+        _, size := utf8.DecodeRuneInString(s[i:])
+        if columns == width - 1 && visibleLen(s[i:]) > 1 {
+            *buf = append(*buf, ellipsis...)
+            if color {
+                *buf = append(*buf, EndColor...)
+            }
+            return
+        }
+        *buf = append(*buf, s[i:i + size]...)
+        columns++
+        i += size
+    }
+}
+
+// how many columns s takes, not counting escape sequences
+func visibleLen(s string) int {
+    return utf8.RuneCountInString(stripColors(s))
+}
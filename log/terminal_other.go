@@ -0,0 +1,12 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris && !windows
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris,!windows
+
+package log
+
+import "io"
+
+func terminalWidth(_ io.Writer) int {
+    return 0
+}
+
+func watchResize(_ func()) {}
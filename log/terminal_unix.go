@@ -0,0 +1,32 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package log
+
+import (
+    "io"
+    "os"
+    "os/signal"
+
+    "golang.org/x/sys/unix"
+)
+
+func terminalWidth(w io.Writer) int {
+    f, ok := w.(*os.File)
+    if !ok {
+        return 0
+    }
+    ws, err := unix.IoctlGetWinsize(int(f.Fd()), unix.TIOCGWINSZ)
+    if err != nil {
+        return 0
+    }
+    return int(ws.Col)
+}
+
+func watchResize(resized func()) {
+    ch := make(chan os.Signal, 1)
+    signal.Notify(ch, unix.SIGWINCH)
+    for range ch {
+        resized()
+    }
+}
@@ -0,0 +1,33 @@
+//go:build windows
+// +build windows
+
+package log
+
+import (
+    "io"
+    "os"
+    "time"
+
+    "golang.org/x/sys/windows"
+)
+
+// the console has no resize signal, so its size is polled instead
+const resizePollInterval = 2 * time.Second
+
+func terminalWidth(w io.Writer) int {
+    f, ok := w.(*os.File)
+    if !ok {
+        return 0
+    }
+    var info windows.ConsoleScreenBufferInfo
+    if err := windows.GetConsoleScreenBufferInfo(windows.Handle(f.Fd()), &info); err != nil {
+        return 0
+    }
+    return int(info.Window.Right - info.Window.Left + 1)
+}
+
+func watchResize(resized func()) {
+    for range time.Tick(resizePollInterval) {
+        resized()
+    }
+}
@@ -1,10 +1,13 @@
 package main
 
 import (
+    "crypto/tls"
     "fmt"
     "io/ioutil"
     "os"
     "path/filepath"
+    "strings"
+    "time"
 
     "github.com/mattn/go-colorable"
 
@@ -16,19 +19,220 @@ import (
 
 func printResult(logger *log.Logger, res *download.DownloadResult) {
     if len(res.LostSegments) > 0 {
-        logger.Warnf("Lost %d segment(s) %v out of %d", len(res.LostSegments), res.LostSegments, res.TotalSegments)
+        logger.Warnf("Lost %d segment(s) %v out of %d", len(res.LostSegments), res.LostRanges, res.TotalSegments)
     }
-    if res.Error != nil {
+    if len(res.UnattemptedSegments) > 0 {
+        logger.Warnf("%d of the lost segment(s) were never requested", len(res.UnattemptedSegments))
+    }
+    if len(res.HostFailures) > 0 {
+        logger.Debugf("Segments per host: %v, failures per host: %v", res.HostCounts, res.HostFailures)
+    }
+    //lost segments are already reported above
+    if complete, reason := res.Complete(); !complete && !res.Failed() && len(res.LostSegments) == 0 {
+        logger.Warnf("Output might not be playable: %s", reason)
+    }
+    if res.Failed() {
         logger.Errorf("Download task failed: %v", res.Error)
+    } else if !res.Success() {
+        logger.Warnf("Download finished with lost segments, %.1f MiB in %v", float64(res.TotalBytes) / (1 << 20), res.Elapsed.Round(time.Second))
     } else {
-        logger.Info("Download succeeded")
+        logger.Infof("Download succeeded, %.1f MiB in %v", float64(res.TotalBytes) / (1 << 20), res.Elapsed.Round(time.Second))
+    }
+    if res.StoredBytes > 0 {
+        logger.Debugf("Segments stored in %.1f MiB", float64(res.StoredBytes) / (1 << 20))
+    }
+}
+
+// checks that a merged file has the expected segments, for --verify-merged.
+// expected is 0 if unknown.
+func verifyMergedFile(path string, expected uint) {
+    container, count, err := util.CountMediaSegments(path)
+    if err != nil {
+        log.Fatalf("Unable to check '%s', %d segment(s) found before the error: %v", path, count, err)
+    }
+    log.Infof("'%s' is a %v file with %d segment(s)", path, container, count)
+    if expected == 0 {
+        return
+    }
+    if uint(count) < expected {
+        log.Fatalf("Missing %d segment(s), expected %d", expected - uint(count), expected)
+    }
+    if uint(count) > expected {
+        log.Warnf("Found more segments than the expected %d", expected)
     }
 }
 
+// where a stream's --result-file goes, empty if not set
+func resultFilePath(stream string) string {
+    if resultFile == "" {
+        return ""
+    }
+    return resultFile + "." + stream + ".json"
+}
+
+// one line with the outcome of the whole run, shown even in quiet mode
+func printSummary(outputs []string, results ...*download.DownloadResult) {
+    var downloaded, lost int
+    var bytes int64
+    var elapsed time.Duration
+    for _, res := range results {
+        if res == nil {
+            continue
+        }
+        downloaded += res.TotalSegments - len(res.LostSegments)
+        lost += len(res.LostSegments)
+        bytes += res.TotalBytes
+        if res.Elapsed > elapsed {
+            elapsed = res.Elapsed
+        }
+    }
+    output := "none"
+    if len(outputs) > 0 {
+        output = strings.Join(outputs, ", ")
+    }
+    log.Summary(
+        "%d segment(s) downloaded, %d lost, %.1f MiB in %v, output: %s",
+        downloaded,
+        lost,
+        float64(bytes) / (1 << 20),
+        elapsed.Round(time.Second),
+        output,
+    )
+}
+
+// checks the URLs and prints what would be downloaded, for --dry-run.
+// nothing is written to disk.
+func dryRun() {
+    client := createClient()
+    progress := download.NewProgress()
+    audioTask, videoTask := download.TasksFromFreg(fregData, preferredAudio, preferredVideo, func(task *download.DownloadTask, track string) {
+        task.Client = client
+        task.Progress = progress.Video()
+        if track == "audio" {
+            task.Progress = progress.Audio()
+        }
+        task.DryRun = true
+        task.EndSegment = endSegment
+        task.Live = live
+        task.QueueMode = queueMode
+        task.SegmentCount = segmentCount
+        task.StartSegment = startSegment
+        task.Threads = threads
+    })
+    if onlyAudio {
+        videoTask = nil
+    } else if onlyVideo {
+        audioTask = nil
+    }
+
+    failed := false
+    var total int64
+    for _, task := range []*download.DownloadTask { audioTask, videoTask } {
+        if task == nil {
+            continue
+        }
+        task.Start()
+        res := task.Wait()
+        if res.Error != nil {
+            task.Logger.Errorf("Dry run failed: %v", res.Error)
+            failed = true
+        }
+        total += res.EstimatedBytes
+    }
+    if failed {
+        log.Fatal("Dry run failed")
+    }
+    log.Infof("Output would be saved to %s, about %.1f MiB in total", output, float64(total) / (1 << 20))
+    log.ResetTerminal()
+}
+
+// tries several thread counts on the video track (or the audio one with
+// --only audio) and recommends one, for --benchmark. nothing is written to
+// disk.
+func benchmark() {
+    client := createClient()
+    defer client.Close()
+    url := fregData.BestVideo(preferredVideo)
+    if onlyAudio {
+        url = fregData.BestAudio(preferredAudio)
+    }
+
+    res, err := download.Benchmark(&download.BenchmarkOptions {
+        Client:       client,
+        Segments:     benchSegments,
+        Setup:        func(task *download.DownloadTask) {
+            task.FailThreshold = failThreshold
+            //the counts of each thread count start from 0
+            task.Progress = download.NewProgress().Video()
+            if onlyAudio {
+                task.Progress = download.NewProgress().Audio()
+            }
+            task.QueryParams = queryParams
+            task.RetryThreshold = retryThreshold
+        },
+        StartSegment: startSegment,
+        Url:          url,
+    })
+    log.ResetTerminal()
+    if err != nil {
+        log.Fatalf("%v", err)
+    }
+    for i := range res.Levels {
+        log.Info(res.Levels[i].String())
+    }
+    log.Summary("Recommended thread count: %d", res.Recommended)
+}
+
+// the client used by the downloads, from the network options
+func createClient() *util.HttpClient {
+    var ipPool *util.IPPool
+    if ipPoolFile != "" {
+        var err error
+        if ipPool, err = util.ParseIPPool(ipPoolFile); err != nil {
+            log.Fatalf("Failed to parse IP pool: %v", err)
+        }
+    }
+
+    var tlsConfig *tls.Config
+    if caFile != "" {
+        pool, err := util.LoadCertPool(caFile)
+        if err != nil {
+            log.Fatalf("Failed to load CA file: %v", err)
+        }
+        tlsConfig = &tls.Config {
+            RootCAs: pool,
+        }
+    }
+
+    return util.NewClient(&util.HttpClientConfig {
+        DisableKeepAlives:  noKeepAlives,
+        IdleConnTimeout:    idleTimeout,
+        InsecureSkipVerify: insecure,
+        IPPool:             ipPool,
+        MaxConnsPerHost:    maxConns,
+        MaxRedirects:       maxRedirects,
+        Network:            network,
+        TLSConfig:          tlsConfig,
+        UseQuic:            useQuic,
+    })
+}
+
 func main() {
     colorable.EnableColorsStdout(nil)
     disableQuickEditMode()
     parseArgs()
+    if verifyMerged != "" {
+        verifyMergedFile(verifyMerged, segmentCount)
+        return
+    }
+    if dryRunMode {
+        dryRun()
+        return
+    }
+    if benchmarkMode {
+        benchmark()
+        return
+    }
     increaseOpenFileLimit()
 
     latestVersion, printNewVersion := versionCheck()
@@ -44,7 +248,7 @@ func main() {
             log.Fatalf("Unable to create temp dir: %v", err)
         }
         log.Infof("Storing temporary files in %s", tempDir)
-        deleteTempDir = !keepFiles
+        deleteTempDir = !keepFiles && !keepMerged && !noMerge
     } else {
         if err := os.MkdirAll(tempDir, 0755); err != nil {
             log.Fatalf("Unable to create temp dir at '%s': %v", tempDir, err)
@@ -57,18 +261,25 @@ func main() {
     })()
 
     muxerOpts := &merge.MuxerOptions {
-        DeleteSegments:  !keepFiles,
-        DisableResume:   disableResume,
-        FinalFileBase:   output,
-        FregData:        &fregData,
+        ConcatList:       concatList,
+        DeleteSegments:   !keepFiles,
+        DisableResume:    disableResume,
+        FfmpegPath:       ffmpegPath,
+        FinalFileBase:    output,
+        FregData:         fregData,
+        Fsync:            fsync,
         // this looks wrong but is correct
-        IgnoreAudio:     onlyVideo,
-        IgnoreVideo:     onlyAudio,
-        Logger:          log.New("muxer"),
-        Merger:          merger,
-        MergerArguments: mergerArgs,
-        OverwriteTemp:   overwriteTemp,
-        TempDir:         tempDir,
+        IgnoreAudio:      onlyVideo,
+        IgnoreVideo:      onlyAudio,
+        KeepIntermediate: keepMerged,
+        Logger:           log.New("muxer"),
+        Merger:           merger,
+        MergerArguments:  mergerArgs,
+        OverwriteTemp:    overwriteTemp,
+        ReadAhead:        mergeAhead,
+        SkipInitDedup:    skipDedup,
+        SplitBySegments:  splitSegments,
+        TempDir:          tempDir,
     }
 
     if mergeOnlyFile != "" {
@@ -77,6 +288,7 @@ func main() {
             log.Fatalf("Failed to merge: %v", err)
         }
         log.Info("Success!")
+        log.ResetTerminal()
         return
     }
 
@@ -84,86 +296,138 @@ func main() {
         log.Warnf("Temporary files are configured to not be deleted. This will fill up your temporary storage over time.");
     }
 
-    var ipPool *util.IPPool
-    if ipPoolFile != "" {
+    client := createClient()
+
+    //nil with --no-merge, the segments are left in the temp dir
+    var muxer merge.Muxer
+    var audioMerger, videoMerger merge.Merger
+    if !noMerge {
         var err error
-        if ipPool, err = util.ParseIPPool(ipPoolFile); err != nil {
-            log.Fatalf("Failed to parse IP pool: %v", err)
+        muxer, err = merge.CreateBestMuxer(muxerOpts)
+        if err != nil {
+            log.Fatalf("Unable to create muxer: %v", err)
         }
-    }
-
-    client := util.NewClient(&util.HttpClientConfig {
-        IPPool:  ipPool,
-        Network: network,
-        UseQuic: useQuic,
-    })
 
-    muxer, err := merge.CreateBestMuxer(muxerOpts)
-    if err != nil {
-        log.Fatalf("Unable to create muxer: %v", err)
-    }
+        dir := filepath.Dir(muxer.OutputFilePath())
+        err = os.MkdirAll(dir, 0755)
+        if err != nil {
+            log.Fatalf("Unable to create parent directories for output file: %v", err)
+        }
 
-    dir := filepath.Dir(muxer.OutputFilePath())
-    err = os.MkdirAll(dir, 0755)
-    if err != nil {
-        log.Fatalf("Unable to create parent directories for output file: %v", err)
+        defer util.LockFile(muxer.OutputFilePath() + ".lock", func() {
+            log.Error("Another instance is already writing to this output file.")
+        })()
+        audioMerger, videoMerger = muxer.AudioMerger(), muxer.VideoMerger()
     }
 
-    defer util.LockFile(muxer.OutputFilePath() + ".lock", func() {
-        log.Error("Another instance is already writing to this output file.")
-    })()
-
     log.SetWindowName(windowName)
     progress := download.NewProgress()
+    progress.SetInterval(progressEvery)
+    progress.SetBarStyle(barStyle)
+
+    var deadline time.Time
+    if maxDuration > 0 {
+        deadline = time.Now().Add(maxDuration)
+    }
 
     var audioTask, videoTask *download.DownloadTask
     if !onlyVideo {
         audioTask = &download.DownloadTask {
-            Client:         client,
-            FailThreshold:  failThreshold,
-            Fsync:          fsync,
-            Logger:         log.New("download.audio"),
-            Merger:         muxer.AudioMerger(),
-            Progress:       progress.Audio(),
-            QueueMode:      queueMode,
-            RequeueDelay:   requeueDelay,
-            RequeueFailed:  requeueFailed,
-            RequeueLast:    requeueLast,
-            RetryThreshold: retryThreshold,
-            SegmentCount:   segmentCount,
-            SegmentDir:     tempDir,
-            StartSegment:   startSegment,
-            Threads:        threads,
-            Url:            fregData.BestAudio(preferredAudio),
+            BreakerCooldown:    breakerCool,
+            BreakerThreshold:   breakerRate,
+            ByteProgress:       byteProgress,
+            CompressSegments:   compressSegs,
+            Client:             client,
+            Deadline:           deadline,
+            DeleteSegments:     !keepFiles,
+            EndSegment:         endSegment,
+            FailThreshold:      failThreshold,
+            Fsync:              fsync,
+            GlobalRetryBudget:  retryBudget,
+            Live:               live,
+            LivePollInterval:   livePoll,
+            Logger:             log.New("download.audio"),
+            MaxLostSegments:    maxLost,
+            MaxReorderWindow:   maxReorder,
+            MaxSegmentBytes:    maxSegBytes,
+            MergeOnly:          mergeSegments,
+            MinRequestInterval: minInterval,
+            Merger:             audioMerger,
+            NoMerge:            noMerge,
+            Progress:           progress.Audio(),
+            QueryParams:        queryParams,
+            QueueMode:          queueMode,
+            RampUp:             rampUp,
+            RangeResume:        rangeResume,
+            RequeueDelay:       requeueDelay,
+            RequeueFailed:      requeueFailed,
+            RequeueLast:        requeueLast,
+            ResultFile:         resultFilePath("audio"),
+            RetryThreshold:     retryThreshold,
+            SegmentCount:       segmentCount,
+            SegmentDir:         tempDir,
+            StallTimeout:       stallTimeout,
+            StartSegment:       startSegment,
+            Threads:            threads,
+            Url:                fregData.BestAudio(preferredAudio),
+            VerifyBeforeMerge:  verifyBefore,
+            VerifyMedia:        verifyMedia,
         }
     }
     if !onlyAudio {
         videoTask = &download.DownloadTask {
-            Client:         client,
-            FailThreshold:  failThreshold,
-            Fsync:          fsync,
-            Logger:         log.New("download.video"),
-            Merger:         muxer.VideoMerger(),
-            Progress:       progress.Video(),
-            QueueMode:      queueMode,
-            RequeueDelay:   requeueDelay,
-            RequeueFailed:  requeueFailed,
-            RequeueLast:    requeueLast,
-            RetryThreshold: retryThreshold,
-            SegmentCount:   segmentCount,
-            SegmentDir:     tempDir,
-            StartSegment:   startSegment,
-            Threads:        threads,
-            Url:            fregData.BestVideo(preferredVideo),
+            BreakerCooldown:    breakerCool,
+            BreakerThreshold:   breakerRate,
+            ByteProgress:       byteProgress,
+            CompressSegments:   compressSegs,
+            Client:             client,
+            Deadline:           deadline,
+            DeleteSegments:     !keepFiles,
+            EndSegment:         endSegment,
+            FailThreshold:      failThreshold,
+            Fsync:              fsync,
+            GlobalRetryBudget:  retryBudget,
+            Live:               live,
+            LivePollInterval:   livePoll,
+            Logger:             log.New("download.video"),
+            MaxLostSegments:    maxLost,
+            MaxReorderWindow:   maxReorder,
+            MaxSegmentBytes:    maxSegBytes,
+            MergeOnly:          mergeSegments,
+            MinRequestInterval: minInterval,
+            Merger:             videoMerger,
+            NoMerge:            noMerge,
+            Progress:           progress.Video(),
+            QueryParams:        queryParams,
+            QueueMode:          queueMode,
+            RampUp:             rampUp,
+            RangeResume:        rangeResume,
+            RequeueDelay:       requeueDelay,
+            RequeueFailed:      requeueFailed,
+            RequeueLast:        requeueLast,
+            ResultFile:         resultFilePath("video"),
+            RetryThreshold:     retryThreshold,
+            SegmentCount:       segmentCount,
+            SegmentDir:         tempDir,
+            StallTimeout:       stallTimeout,
+            StartSegment:       startSegment,
+            Threads:            threads,
+            Url:                fregData.BestVideo(preferredVideo),
+            VerifyBeforeMerge:  verifyBefore,
+            VerifyMedia:        verifyMedia,
         }
     }
 
     if onlyAudio {
         videoTask = nil
-        merge.MergeNothing(muxer.VideoMerger())
+        if videoMerger != nil {
+            merge.MergeNothing(videoMerger)
+        }
     } else if onlyVideo {
         audioTask = nil
-        merge.MergeNothing(muxer.AudioMerger())
+        if audioMerger != nil {
+            merge.MergeNothing(audioMerger)
+        }
     }
 
     if audioTask != nil {
@@ -172,11 +436,16 @@ func main() {
     if videoTask != nil {
         videoTask.Start()
     }
+    sigHandler := download.InstallSignalHandler(audioTask, videoTask)
 
     //start muxer early so segments can be deleted if keep-files is disabled
     //for the tcp muxer
     muxerResult := make(chan error)
     go func() {
+        if muxer == nil {
+            muxerResult <- nil
+            return
+        }
         muxerResult <- muxer.Mux()
     }()
 
@@ -196,9 +465,17 @@ func main() {
         printResult(videoTask.Logger, videoRes)
     }
 
-    log.Info("Waiting for muxing to finish")
-    log.Info("This can take a while for long videos, do NOT restart or all muxing progress will be lost")
+    if muxer != nil {
+        log.Info("Waiting for muxing to finish")
+        log.Info("This can take a while for long videos, do NOT restart or all muxing progress will be lost")
+    }
     res := <-muxerResult
+    var outputs []string
+    if muxer != nil {
+        outputs = muxer.OutputFiles()
+    } else {
+        log.Infof("Segments were kept in %s without merging", tempDir)
+    }
 
     //print again once it's done so it doesn't get buried in newer logs
     if printNewVersion {
@@ -209,16 +486,28 @@ func main() {
     }
 
     if res != nil {
+        printSummary(nil, audioRes, videoRes)
         log.Fatalf("Muxing failed: %v", res)
     }
+    sigHandler.Remove()
+    if sigHandler.Interrupted() {
+        printSummary(outputs, audioRes, videoRes)
+        //keep temporary files so the download can be resumed
+        log.Fatalf("Download was interrupted, output only contains what was downloaded before")
+    }
 
     if deleteTempDir {
-        if err = os.RemoveAll(tempDir); err != nil {
+        if err := os.RemoveAll(tempDir); err != nil {
             log.Warnf("Failed to delete temp dir: %v", err)
         }
     }
 
+    if len(outputs) > 1 {
+        log.Infof("Output split into %d files: %v", len(outputs), outputs)
+    }
     log.Info("Success!")
-    fmt.Fprintf(os.Stderr, "\n")
+    log.ResetTerminal()
+    printSummary(outputs, audioRes, videoRes)
+    log.Close()
 }
 
@@ -0,0 +1,27 @@
+package merge
+
+import (
+    "bufio"
+    "bytes"
+    "compress/gzip"
+    "fmt"
+    "io"
+)
+
+var gzipMagic = []byte { 0x1f, 0x8b }
+
+// the content of a segment, decompressed if it was gzipped by
+// download.DownloadTask.CompressSegments. media segments never start like
+// a gzip stream, so they're told apart by their first bytes.
+func decompressed(r io.Reader) (io.Reader, error) {
+    br := bufio.NewReader(r)
+    head, _ := br.Peek(len(gzipMagic))
+    if !bytes.Equal(head, gzipMagic) {
+        return br, nil
+    }
+    zr, err := gzip.NewReader(br)
+    if err != nil {
+        return nil, fmt.Errorf("Invalid compressed segment: %v", err)
+    }
+    return zr, nil
+}
@@ -2,11 +2,12 @@ package merge
 
 import (
     "fmt"
-    "io"
     "os"
     "path/filepath"
+    "strings"
 
     "github.com/HoloArchivists/ytarchive-raw-go/download/segments"
+    "github.com/HoloArchivists/ytarchive-raw-go/log"
     "github.com/HoloArchivists/ytarchive-raw-go/util"
 )
 
@@ -16,6 +17,7 @@ type ConcatMuxer struct {
     progress    *mergeProgress
     audioMerger *concatTask
     videoMerger *concatTask
+    outputs     []string
 }
 
 func CreateConcatMuxer(options *MuxerOptions) (Muxer, error) {
@@ -47,29 +49,47 @@ func (m *ConcatMuxer) VideoMerger() Merger {
     return m.videoMerger
 }
 
-func (m *ConcatMuxer) Mux() error {
+func (m *ConcatMuxer) Mux() (err error) {
+    defer func() {
+        m.opts.completed(m.OutputFiles(), err)
+    }()
+
     // need to wait for merged files to be available before muxing
     m.audioMerger.wg.Wait()
     m.videoMerger.wg.Wait()
 
-    m.opts.Logger.Info("Merging into final file, progress won't be updated until it's done")
+    if m.opts.SplitBySegments > 0 {
+        if err := m.muxParts(); err != nil {
+            return err
+        }
+    } else {
+        m.opts.Logger.Info("Merging into final file, progress won't be updated until it's done")
 
-    if err := muxFfmpeg(m.opts, m.audioMerger.output(), m.videoMerger.output()); err != nil {
+        if err := muxFfmpeg(m.opts, m.audioMerger.output(), m.videoMerger.output()); err != nil {
+            return err
+        }
+        m.outputs = []string { m.OutputFilePath() }
+    }
+    if err := m.opts.syncFiles(m.outputs); err != nil {
+        return err
+    }
+    kept := !m.opts.DeleteSegments && !m.opts.DisableResume
+    if err := m.opts.writeConcatLists(kept, &m.audioMerger.taskCommon, &m.videoMerger.taskCommon); err != nil {
         return err
     }
     m.progress.done()
 
-    m.opts.Logger.Debug("Download succeeded, removing merged segments")
-    m.audioMerger.do(func() {
-        if err := os.Remove(m.audioMerger.output()); err != nil {
-            m.opts.Logger.Warnf("Failed to remove merged audio: %v", err)
-        }
-    })
-    m.videoMerger.do(func() {
-        if err := os.Remove(m.videoMerger.output()); err != nil {
-            m.opts.Logger.Warnf("Failed to remove merged video: %v", err)
-        }
-    })
+    if m.opts.KeepIntermediate {
+        m.opts.Logger.Debug("Download succeeded, keeping merged segments")
+    } else {
+        m.opts.Logger.Debug("Download succeeded, removing merged segments")
+        m.audioMerger.do(func() {
+            m.audioMerger.removeOutputs(m.opts.Logger)
+        })
+        m.videoMerger.do(func() {
+            m.videoMerger.removeOutputs(m.opts.Logger)
+        })
+    }
 
     if m.opts.DeleteSegments {
         deleteSegmentFiles(m.audioMerger.segments)
@@ -83,21 +103,69 @@ func (m *ConcatMuxer) OutputFilePath() string {
     return m.opts.FinalFileBase + ".mkv"
 }
 
+func (m *ConcatMuxer) OutputFiles() []string {
+    return m.outputs
+}
+
+// muxes each part of the split merged files into its own output file.
+// parts start at segment boundaries, and fragmented MP4/WebM segments are
+// self contained, so each part can be played on its own.
+func (m *ConcatMuxer) muxParts() error {
+    parts := m.audioMerger.parts
+    if m.videoMerger.parts > parts {
+        parts = m.videoMerger.parts
+    }
+    for part := 0; part < parts; part++ {
+        opts := *m.opts
+        opts.FinalFileBase = partName(m.opts.FinalFileBase, part)
+
+        m.opts.Logger.Infof("Merging part %d/%d, progress won't be updated until it's done", part + 1, parts)
+        if err := muxFfmpeg(&opts, m.audioMerger.partOutput(part), m.videoMerger.partOutput(part)); err != nil {
+            return fmt.Errorf("Unable to mux part %d: %v", part + 1, err)
+        }
+        m.outputs = append(m.outputs, opts.FinalFileBase + ".mkv")
+    }
+    return nil
+}
+
+func partName(base string, part int) string {
+    return fmt.Sprintf("%s.part%03d", base, part + 1)
+}
+
 var _ Merger = &concatTask {}
 type concatTask struct {
     taskCommon
     deleteSegments bool
+    dedup          initDedup
     segments       []string
+    // segments taken from the status so far, including lost ones
+    merged         int
+    // how many part files were written to, with SplitBySegments
+    parts          int
 }
 
 func createConcatTask(options *MuxerOptions, progress *mergeProgress, which string) (*concatTask, error) {
     file := filepath.Join(options.TempDir, fmt.Sprintf("merged-%s.%s", options.FregData.Metadata.Id, which))
-    if util.FileNotEmpty(file) {
+    if err := createParentDir(file); err != nil {
+        return nil, err
+    }
+    existing := []string { file }
+    if options.SplitBySegments > 0 {
+        parts, err := existingParts(file)
+        if err != nil {
+            return nil, err
+        }
+        existing = parts
+    }
+    for _, f := range existing {
+        if !util.FileNotEmpty(f) {
+            continue
+        }
         if !options.OverwriteTemp {
-            return nil, fmt.Errorf("Temporary merge file %s already exists and overwriting is disabled", file)
+            return nil, fmt.Errorf("Temporary merge file %s already exists and overwriting is disabled", f)
         }
-        if err := os.Remove(file); err != nil {
-            return nil, fmt.Errorf("Unable to delete temporary file %s: %v", file, err)
+        if err := os.Remove(f); err != nil {
+            return nil, fmt.Errorf("Unable to delete temporary file %s: %v", f, err)
         }
     }
 
@@ -109,35 +177,101 @@ func createConcatTask(options *MuxerOptions, progress *mergeProgress, which stri
             which:       which,
         },
         deleteSegments: options.DisableResume,
+        dedup:          initDedup { disabled: options.SkipInitDedup },
     }
     task.wg.Add(1)
     return task, nil
 }
 
-func copyFile(from string, to string) error {
-    in, err := os.Open(from)
+// part files of a previous run, named like partName(file, n)
+func existingParts(file string) ([]string, error) {
+    entries, err := os.ReadDir(filepath.Dir(file))
     if err != nil {
-        return fmt.Errorf("Unable to open input file: %v", err)
+        return nil, err
     }
-    defer in.Close()
+    prefix := filepath.Base(file) + ".part"
+    var parts []string
+    for _, e := range entries {
+        if !e.IsDir() && strings.HasPrefix(e.Name(), prefix) {
+            parts = append(parts, filepath.Join(filepath.Dir(file), e.Name()))
+        }
+    }
+    return parts, nil
+}
 
-    out, err := os.OpenFile(to, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+// appends a segment to a merged file
+func (t *concatTask) appendSegment(from string, to string) error {
+    out, err := os.OpenFile(to, os.O_APPEND|os.O_CREATE|os.O_WRONLY, t.options.fileMode())
     if err != nil {
         return fmt.Errorf("Unable to open output file: %v", err)
     }
     defer out.Close()
 
-    _, err = io.Copy(out, in)
-    return err
+    return t.copySegment(out, from, &t.dedup)
+}
+
+// the merged file for a part, or the only merged file without splitting
+func (t *concatTask) partFile(part int) string {
+    if t.options.SplitBySegments <= 0 {
+        return t.ffmpegInput
+    }
+    return partName(t.ffmpegInput, part)
+}
+
+// the input for muxing a part, empty if ignored or nothing was merged
+// into it
+func (t *concatTask) partOutput(part int) string {
+    if t.ignored() || !util.FileNotEmpty(t.partFile(part)) {
+        return ""
+    }
+    return t.partFile(part)
+}
+
+func (t *concatTask) removeOutputs(logger *log.Logger) {
+    files := []string { t.ffmpegInput }
+    if t.options.SplitBySegments > 0 {
+        files = files[:0]
+        for part := 0; part < t.parts; part++ {
+            if f := t.partOutput(part); f != "" {
+                files = append(files, f)
+            }
+        }
+    }
+    for _, f := range files {
+        if err := os.Remove(f); err != nil {
+            logger.Warnf("Failed to remove merged %s: %v", t.which, err)
+        }
+    }
 }
 
 func (t *concatTask) Merge(status *segments.SegmentStatus) {
     defer t.wg.Done()
+    defer func() {
+        var files []string
+        for part := 0; part < t.parts; part++ {
+            if f := t.partOutput(part); f != "" {
+                files = append(files, f)
+            }
+        }
+        if err := t.options.syncFiles(files); err != nil {
+            t.log().Errorf("%v", err)
+        }
+    }()
 
     t.forEachSegment(status, func(result segments.SegmentResult) {
+        part := 0
+        if t.options.SplitBySegments > 0 {
+            part = t.merged / t.options.SplitBySegments
+        }
+        t.merged++
+        if part + 1 > t.parts {
+            t.parts = part + 1
+            //each part is played on its own, so it needs the init segment
+            t.dedup.reset()
+        }
         if result.Ok {
-            target := t.ffmpegInput
-            err := copyFile(result.Filename, target)
+            target := t.partFile(part)
+            err := t.appendSegment(result.Filename, target)
             if err != nil {
                 t.log().Errorf("Unable to merge file '%s' into '%s': %v", result.Filename, target, err)
             } else {
@@ -0,0 +1,62 @@
+package merge
+
+import (
+    "fmt"
+    "os"
+    "path/filepath"
+    "strings"
+
+    "github.com/HoloArchivists/ytarchive-raw-go/download/segments"
+)
+
+// the concat list of a track, next to the output
+func (t *taskCommon) concatListPath() string {
+    return t.options.FinalFileBase + "." + t.which + ".ffconcat"
+}
+
+// writes the FFmpeg concat demuxer lists of the tasks, if ConcatList is set.
+// kept is whether the muxer left the segment files in place, the lists are
+// useless otherwise.
+func (opts *MuxerOptions) writeConcatLists(kept bool, tasks ...*taskCommon) error {
+    if !opts.ConcatList {
+        return nil
+    }
+    if !kept {
+        opts.Logger.Warn("Segment files were deleted, not writing concat lists")
+        return nil
+    }
+    for _, t := range tasks {
+        if t.ignored() {
+            continue
+        }
+        path := t.concatListPath()
+        if err := writeConcatList(path, t.listed, opts.fileMode()); err != nil {
+            return fmt.Errorf("Unable to write concat list '%s': %v", path, err)
+        }
+        opts.Logger.Infof("Wrote %s concat list to %s", t.which, path)
+    }
+    return nil
+}
+
+// writes the segment files in order, in the format of FFmpeg's concat
+// demuxer, with a comment for each lost segment. paths are absolute, so
+// FFmpeg needs -safe 0 to read it.
+func writeConcatList(path string, results []segments.SegmentResult, mode os.FileMode) error {
+    var b strings.Builder
+    b.WriteString("ffconcat version 1.0\n")
+    for i, r := range results {
+        if !r.Ok {
+            fmt.Fprintf(&b, "# segment %d lost\n", i)
+            continue
+        }
+        file, err := filepath.Abs(r.Filename)
+        if err != nil {
+            return err
+        }
+        fmt.Fprintf(&b, "file '%s'\n", strings.ReplaceAll(file, "'", `'\''`))
+    }
+    if err := createParentDir(path); err != nil {
+        return err
+    }
+    return os.WriteFile(path, []byte(b.String()), mode)
+}
@@ -98,7 +98,11 @@ func (m *DownloadOnlyMuxer) VideoMerger() Merger {
     return m.videoMerger
 }
 
-func (m *DownloadOnlyMuxer) Mux() error {
+func (m *DownloadOnlyMuxer) Mux() (err error) {
+    defer func() {
+        m.opts.completed(m.OutputFiles(), err)
+    }()
+
     m.audioMerger.wg.Wait()
     m.videoMerger.wg.Wait()
     m.progress.done()
@@ -113,13 +117,29 @@ func (m *DownloadOnlyMuxer) Mux() error {
     if err != nil {
         return err
     }
-    return ioutil.WriteFile(m.opts.FinalFileBase + ".json", j, 0644)
+    if err = createParentDir(m.opts.FinalFileBase); err != nil {
+        return err
+    }
+    if err = ioutil.WriteFile(m.opts.FinalFileBase + ".json", j, m.opts.fileMode()); err != nil {
+        return err
+    }
+    if err = m.opts.syncFiles(m.OutputFiles()); err != nil {
+        return err
+    }
+    if err = m.opts.writeConcatLists(true, &m.audioMerger.taskCommon, &m.videoMerger.taskCommon); err != nil {
+        return err
+    }
+    return nil
 }
 
 func (m *DownloadOnlyMuxer) OutputFilePath() string {
     return m.opts.FinalFileBase + ".json"
 }
 
+func (m *DownloadOnlyMuxer) OutputFiles() []string {
+    return []string { m.OutputFilePath() }
+}
+
 var _ Merger = &downloadOnlyTask {}
 type downloadOnlyTask struct {
     taskCommon
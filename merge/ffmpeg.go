@@ -12,26 +12,30 @@ import (
     "github.com/HoloArchivists/ytarchive-raw-go/log"
 )
 
-func ffmpeg(logger *log.Logger, args ...string) *exec.Cmd {
+// runs the ffmpeg binary at path, or found in PATH if empty
+func ffmpeg(path string, logger *log.Logger, args ...string) *exec.Cmd {
     argv := make([]string, 0)
     argv = append(argv, "-v", "warning")
     argv = append(argv, args...)
     if logger != nil {
         logger.Debugf("FFmpeg command: %v", argv)
     }
-    return exec.Command("ffmpeg", argv...)
+    if path == "" {
+        path = "ffmpeg"
+    }
+    return exec.Command(path, argv...)
 }
 
-func testFfmpeg() error {
-    cmd := ffmpeg(log.DefaultLogger, "-h")
+func testFfmpeg(path string) error {
+    cmd := ffmpeg(path, log.DefaultLogger, "-h")
     cmd.Stdin = nil
     cmd.Stdout = nil
     cmd.Stderr = nil
     return cmd.Run()
 }
 
-func hasProtocol(name string) bool {
-    cmd := ffmpeg(log.DefaultLogger, "--help", "protocol=" + name)
+func hasProtocol(path string, name string) bool {
+    cmd := ffmpeg(path, log.DefaultLogger, "--help", "protocol=" + name)
     cmd.Stdin = nil
     output, err := cmd.Output()
     if err != nil {
@@ -59,6 +63,9 @@ func muxFfmpeg(options *MuxerOptions, audio, video string) error {
     }
     args = append(args, "-c", "copy")
 
+    if err := createParentDir(options.FinalFileBase); err != nil {
+        return err
+    }
     thumbnail := options.FinalFileBase + ".jpg"
     if err := options.FregData.WriteThumbnail(thumbnail); err != nil {
         return fmt.Errorf("Unable to write thumbnail file: %v", err)
@@ -86,7 +93,7 @@ func muxFfmpeg(options *MuxerOptions, audio, video string) error {
     )
     args = append(args, options.FinalFileBase + ".mkv")
 
-    cmd := ffmpeg(options.Logger, args...)
+    cmd := ffmpeg(options.FfmpegPath, options.Logger, args...)
     logFile := filepath.Join(options.TempDir, fmt.Sprintf("ffmpeg-%s.out", options.FregData.Metadata.Id))
     cmd.Env = append(
         os.Environ(),
@@ -105,7 +112,7 @@ func muxFfmpeg(options *MuxerOptions, audio, video string) error {
     }
     printOutput(options.Logger, &stderr, true)
 
-    return nil
+    return options.chmodFiles([]string { thumbnail, options.FinalFileBase + ".mkv" })
 }
 
 func printOutput(logger *log.Logger, stderr *bytes.Buffer, success bool) {
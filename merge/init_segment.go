@@ -0,0 +1,47 @@
+package merge
+
+import (
+    "bufio"
+    "bytes"
+    "io"
+
+    "github.com/HoloArchivists/ytarchive-raw-go/util"
+)
+
+// leaves out the init segments (ftyp and moov boxes) of fragmented MP4
+// segments that repeat the one written before them, as a merged file must
+// only have it once at the start to be playable. a segment with a
+// different init segment, eg after a format change, keeps it.
+type initDedup struct {
+    // write the segments as they are, see MuxerOptions.SkipInitDedup
+    disabled bool
+    // the last init segment written, nil at the start of a file
+    last     []byte
+}
+
+// copies a segment to w, without its init segment if it's the same as the
+// last one
+func (d *initDedup) copySegment(w io.Writer, in io.Reader) error {
+    if d.disabled {
+        _, err := io.Copy(w, in)
+        return err
+    }
+    r := bufio.NewReader(in)
+    init, err := util.ReadMP4Init(r)
+    if err != nil {
+        return err
+    }
+    if init != nil && !bytes.Equal(init, d.last) {
+        if _, err := w.Write(init); err != nil {
+            return err
+        }
+        d.last = init
+    }
+    _, err = io.Copy(w, r)
+    return err
+}
+
+// the next segment starts a new file, which needs its own init segment
+func (d *initDedup) reset() {
+    d.last = nil
+}
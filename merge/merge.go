@@ -1,8 +1,12 @@
 package merge
 
 import (
+    "errors"
     "fmt"
+    "io"
     "os"
+    "os/exec"
+    "path/filepath"
     "strings"
     "sync"
     "time"
@@ -21,17 +25,31 @@ type Muxer interface {
     VideoMerger() Merger
     Mux() error
     OutputFilePath() string
+    // files written by Mux, only valid after it succeeded
+    OutputFiles() []string
 }
 
 func CreateBestMuxer(opts *MuxerOptions) (Muxer, error) {
-    if err := testFfmpeg(); err != nil {
-        return nil, fmt.Errorf("Unable to find FFmpeg: %v", err)
+    if err := testFfmpeg(opts.FfmpegPath); err != nil {
+        if errors.Is(err, exec.ErrNotFound) || errors.Is(err, os.ErrNotExist) {
+            return nil, fmt.Errorf("Unable to find FFmpeg, install it or pass its path with --ffmpeg-path: %v", err)
+        }
+        return nil, fmt.Errorf("Unable to run FFmpeg: %v", err)
     }
 
     if opts.IgnoreAudio && opts.IgnoreVideo {
         return nil, fmt.Errorf("Ignoring both audio and video")
     }
 
+    if opts.SplitBySegments > 0 {
+        switch strings.ToLower(opts.Merger) {
+        case "", "concat":
+            return CreateConcatMuxer(opts)
+        default:
+            return nil, fmt.Errorf("Splitting the output is only supported by the concat merger")
+        }
+    }
+
     switch strings.ToLower(opts.Merger) {
     case "download-only":
         return CreateDownloadOnlyMuxer(opts)
@@ -47,14 +65,14 @@ func CreateBestMuxer(opts *MuxerOptions) (Muxer, error) {
 
     //probably not worth implementing, tcp is objectively better,
     //download-only can be used as an alternative if tcp is missing.
-//    if hasProtocol("concatf") {
+//    if hasProtocol(opts.FfmpegPath, "concatf") {
 //        opts.Logger.Info("Using concatf protocol")
 //    }
-    if hasProtocol("tcp") {
+    if hasProtocol(opts.FfmpegPath, "tcp") {
         opts.Logger.Info("Using tcp protocol")
         return CreateTcpMuxer(opts)
     }
-    if hasProtocol("file") {
+    if hasProtocol(opts.FfmpegPath, "file") {
         opts.Logger.Warn("Using concat merger")
         return CreateConcatMuxer(opts)
     }
@@ -67,27 +85,119 @@ func MergeNothing(m Merger) {
 }
 
 type MuxerOptions struct {
+    // also write FFmpeg concat demuxer lists of the segment files next to
+    // the output, named FinalFileBase.audio.ffconcat and .video.ffconcat,
+    // to mux them differently later. only if the segments are kept.
+    ConcatList       bool
     // should segments be deleted after successfully muxing?
-    DeleteSegments  bool
+    DeleteSegments   bool
     // should segments be deleted after merging?
-    DisableResume   bool
+    DisableResume    bool
+    // path of the ffmpeg binary, looked up in PATH if empty
+    FfmpegPath       string
     // where to save the muxed file
-    FinalFileBase   string
+    FinalFileBase    string
     // video metadata
-    FregData        *util.FregJson
+    FregData         *util.FregJson
+    // flush the merged files and outputs to disk once they're written, so
+    // they survive a crash. slows down finishing the merge, mostly on
+    // spinning disks.
+    Fsync            bool
     // don't include audio
-    IgnoreAudio     bool
+    IgnoreAudio      bool
     // don't include video
-    IgnoreVideo     bool
-    Logger          *log.Logger
+    IgnoreVideo      bool
+    // keep the merged audio and video files in TempDir after muxing them
+    // into the output, instead of deleting them
+    KeepIntermediate bool
+    Logger           *log.Logger
+    // permissions of the merged and output files, 0644 if 0. files created
+    // by FFmpeg get it once they're written.
+    MergeFileMode    os.FileMode
     // which merger to use
-    Merger          string
+    Merger           string
     // arguments for the mergers
-    MergerArguments map[string]map[string]string
+    MergerArguments  map[string]map[string]string
+    // called by Mux right before it returns, with the output files once
+    // they're complete, or with no outputs and the error if muxing failed.
+    // the DownloadResults of the tracks aren't known here, as the download
+    // package imports this one. download.DownloadVideo returns them together
+    // with the outputs.
+    OnMergeComplete  func(outputs []string, err error)
     // if temporary files already exist, should they be overwritten?
-    OverwriteTemp   bool
-    // directory to store temporary files
-    TempDir         string
+    OverwriteTemp    bool
+    // how many of the next downloaded segments the concat and tcp mergers
+    // read into memory in the background while writing the current one, so
+    // reading overlaps writing. segments are still written in order. costs
+    // up to this many segments of memory per track, 0 reads them one after
+    // the other.
+    ReadAhead        int
+    // write the segments into the merged files as they are, for streams
+    // whose segments have no init segment. by default, init segments (ftyp
+    // and moov boxes) repeating the previous one are left out, as a merged
+    // fragmented MP4 file must only have one at its start. only used by the
+    // concat and tcp mergers.
+    SkipInitDedup    bool
+    // split the output into parts of this many segments each, named
+    // FinalFileBase.partNNN. only supported by the concat merger.
+    SplitBySegments  int
+    // directory to store temporary files, such as the merged audio and video
+    // of the concat merger. they're read from there by FFmpeg, which writes
+    // the output directly, so TempDir can be on another filesystem than the
+    // output.
+    TempDir          string
+}
+
+// calls OnMergeComplete, deferred by the muxers with their result
+func (opts *MuxerOptions) completed(outputs []string, err error) {
+    if opts.OnMergeComplete == nil {
+        return
+    }
+    if err != nil {
+        outputs = nil
+    }
+    opts.OnMergeComplete(outputs, err)
+}
+
+func (opts *MuxerOptions) fileMode() os.FileMode {
+    if opts.MergeFileMode == 0 {
+        return 0644
+    }
+    return opts.MergeFileMode
+}
+
+// gives files written by FFmpeg the configured permissions
+func (opts *MuxerOptions) chmodFiles(files []string) error {
+    if opts.MergeFileMode == 0 {
+        return nil
+    }
+    for _, f := range files {
+        if err := os.Chmod(f, opts.MergeFileMode); err != nil {
+            return fmt.Errorf("Unable to change permissions of '%s': %v", f, err)
+        }
+    }
+    return nil
+}
+
+// creates the directory a file is going to be written to
+func createParentDir(path string) error {
+    if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+        return fmt.Errorf("Unable to create parent directories of '%s': %v", path, err)
+    }
+    return nil
+}
+
+// flushes files to disk if Fsync is set
+func (opts *MuxerOptions) syncFiles(files []string) error {
+    if !opts.Fsync {
+        return nil
+    }
+    for _, f := range files {
+        if err := util.SyncFile(f); err != nil {
+            return fmt.Errorf("Unable to sync '%s': %v", f, err)
+        }
+    }
+    return nil
 }
 
 func (opts *MuxerOptions) getMergerArgument(name, arg string) (string, bool) {
@@ -101,8 +211,12 @@ func (opts *MuxerOptions) getMergerArgument(name, arg string) (string, bool) {
 
 type taskCommon struct {
     ffmpegInput string
+    // every segment merged so far, with ConcatList
+    listed      []segments.SegmentResult
     _logger     *log.Logger
     options     *MuxerOptions
+    // nil without ReadAhead
+    prefetch    *prefetcher
     progress    *mergeProgress
     wg          sync.WaitGroup
     which       string
@@ -139,11 +253,15 @@ func (t* taskCommon) forEachSegment(s *segments.SegmentStatus, f func(segments.S
     }
 
     t.progress.initTotal(s.Total())
+    if t.options.ReadAhead > 0 {
+        t.prefetch = newPrefetcher(t.options.ReadAhead)
+    }
     misses := 0
     for {
         if s.Done() {
             break
         }
+        t.progress.growTotal(s.Total())
         result, number, done := s.NextToMerge()
         if !done {
             t.log().Debugf("Waiting for segment %d to be ready for merging", number)
@@ -155,6 +273,12 @@ func (t* taskCommon) forEachSegment(s *segments.SegmentStatus, f func(segments.S
         }
         misses = 0
 
+        if t.options.ConcatList {
+            t.listed = append(t.listed, result)
+        }
+        if t.prefetch != nil {
+            t.prefetch.start(s, number)
+        }
         f(result)
 
         if t.which == "audio" {
@@ -165,6 +289,34 @@ func (t* taskCommon) forEachSegment(s *segments.SegmentStatus, f func(segments.S
     }
 }
 
+// copies a segment file to w, from the data read ahead if it was,
+// decompressing it if needed. see initDedup.
+func (t* taskCommon) copySegment(w io.Writer, file string, dedup *initDedup) error {
+    var in io.Reader
+    if t.prefetch != nil {
+        r, ok, err := t.prefetch.take(file)
+        if err != nil {
+            return err
+        }
+        if ok {
+            in = r
+        }
+    }
+    if in == nil {
+        f, err := os.Open(file)
+        if err != nil {
+            return err
+        }
+        defer f.Close()
+        in = f
+    }
+    in, err := decompressed(in)
+    if err != nil {
+        return err
+    }
+    return dedup.copySegment(w, in)
+}
+
 func deleteSegmentFiles(paths []string) {
     for _, v := range paths {
         if err := os.Remove(v); err != nil {
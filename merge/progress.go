@@ -36,6 +36,16 @@ func (m *mergeProgress) initTotal(total int) {
     }
 }
 
+// live streams keep adding segments after merging starts
+func (m *mergeProgress) growTotal(total int) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    if total > m.total {
+        m.total = total
+        m.updated()
+    }
+}
+
 func (m *mergeProgress) done() {
     m.mu.Lock()
     defer m.mu.Unlock()
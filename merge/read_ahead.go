@@ -0,0 +1,65 @@
+package merge
+
+import (
+    "bytes"
+    "io"
+    "os"
+
+    "github.com/HoloArchivists/ytarchive-raw-go/download/segments"
+)
+
+type prefetchResult struct {
+    data []byte
+    err  error
+}
+
+// reads the files of the next segments to merge in the background, so
+// reading them overlaps writing the current one, see MuxerOptions.ReadAhead.
+// only used from the merging goroutine.
+type prefetcher struct {
+    count   int
+    // reads started and not taken yet, by segment file
+    pending map[string]chan prefetchResult
+}
+
+func newPrefetcher(count int) *prefetcher {
+    return &prefetcher {
+        count:   count,
+        pending: make(map[string]chan prefetchResult),
+    }
+}
+
+// starts reading the downloaded segments among the count after current.
+// ones not downloaded yet are read once a later call gets to them.
+func (p *prefetcher) start(s *segments.SegmentStatus, current int) {
+    for n := current + 1; n <= current + p.count; n++ {
+        r, ok := s.Result(n)
+        if !ok || !r.Ok {
+            continue
+        }
+        if _, started := p.pending[r.Filename]; started {
+            continue
+        }
+        ch := make(chan prefetchResult, 1)
+        p.pending[r.Filename] = ch
+        go func(file string) {
+            data, err := os.ReadFile(file)
+            ch <- prefetchResult { data: data, err: err }
+        }(r.Filename)
+    }
+}
+
+// the data of a file read ahead, waiting for the read to finish. ok is
+// false if it wasn't read ahead.
+func (p *prefetcher) take(file string) (io.Reader, bool, error) {
+    ch, ok := p.pending[file]
+    if !ok {
+        return nil, false, nil
+    }
+    delete(p.pending, file)
+    res := <-ch
+    if res.err != nil {
+        return nil, true, res.err
+    }
+    return bytes.NewReader(res.data), true, nil
+}
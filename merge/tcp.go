@@ -2,7 +2,6 @@ package merge
 
 import (
     "fmt"
-    "io"
     "net"
     "os"
 
@@ -56,10 +55,21 @@ func (m *TcpMuxer) VideoMerger() Merger {
     return m.videoMerger
 }
 
-func (m *TcpMuxer) Mux() error {
+func (m *TcpMuxer) Mux() (err error) {
+    defer func() {
+        m.opts.completed(m.OutputFiles(), err)
+    }()
+
     if err := muxFfmpeg(m.opts, m.audioMerger.output(), m.videoMerger.output()); err != nil {
         return err
     }
+    if err := m.opts.syncFiles(m.OutputFiles()); err != nil {
+        return err
+    }
+    kept := !m.opts.DeleteSegments && !m.opts.DisableResume
+    if err := m.opts.writeConcatLists(kept, &m.audioMerger.taskCommon, &m.videoMerger.taskCommon); err != nil {
+        return err
+    }
     m.progress.done()
 
     if m.audioMerger.listener != nil {
@@ -81,6 +91,10 @@ func (m *TcpMuxer) OutputFilePath() string {
     return m.opts.FinalFileBase + ".mkv"
 }
 
+func (m *TcpMuxer) OutputFiles() []string {
+    return []string { m.OutputFilePath() }
+}
+
 var _ Merger = &tcpTask {}
 type tcpTask struct {
     taskCommon
@@ -112,17 +126,6 @@ func createTcpTask(bindAddress string, options *MuxerOptions, progress *mergePro
     return task, nil
 }
 
-func sendFile(file string, conn net.Conn) error {
-    f, err := os.Open(file)
-    if err != nil {
-        return err
-    }
-    defer f.Close()
-
-    _, err = io.Copy(conn, f)
-    return err
-}
-
 func (t *tcpTask) Merge(status *segments.SegmentStatus) {
     if t.listener == nil {
         t.forEachSegment(status, func(_ segments.SegmentResult) {})
@@ -137,9 +140,10 @@ func (t *tcpTask) Merge(status *segments.SegmentStatus) {
     defer conn.Close()
 
     t.log().Info("Got connection")
+    dedup := initDedup { disabled: t.options.SkipInitDedup }
     t.forEachSegment(status, func(result segments.SegmentResult) {
         if result.Ok {
-            err := sendFile(result.Filename, conn)
+            err := t.copySegment(conn, result.Filename, &dedup)
             if err != nil {
                 t.log().Errorf("Unable to send file '%s' to muxer: %v", result.Filename, err)
             } else {
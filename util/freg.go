@@ -0,0 +1,98 @@
+package util
+
+import (
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "net/url"
+    "regexp"
+    "strconv"
+)
+
+var itagPathRegex = regexp.MustCompile(`/itag/(\d+)(?:/|$)`)
+
+// Reads an info json written by ytarchive-raw. See ParseFregJson.
+func LoadFregJson(path string) (*FregJson, error) {
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+        return nil, fmt.Errorf("Unable to read file '%s': %v", path, err)
+    }
+    return ParseFregJson(data)
+}
+
+// Parses an info json. The audio and video URLs can either be an object of
+// itag to fragment URL, or a single URL whose itag is taken from the URL
+// itself. At least one of them must be present.
+func ParseFregJson(data []byte) (*FregJson, error) {
+    f := &FregJson {}
+    //the URLs are parsed separately, shadow them so they can't fail the
+    //rest of the parse
+    type fregAlias FregJson
+    var raw struct {
+        *fregAlias
+        Video json.RawMessage `json:"video"`
+        Audio json.RawMessage `json:"audio"`
+    }
+    raw.fregAlias = (*fregAlias)(f)
+    if err := json.Unmarshal(data, &raw); err != nil {
+        return nil, fmt.Errorf("Invalid freg json: %v", err)
+    }
+
+    var err error
+    if f.Video, err = parseFregUrls(raw.Video); err != nil {
+        return nil, fmt.Errorf("Unrecognized video URLs in freg json: %v", err)
+    }
+    if f.Audio, err = parseFregUrls(raw.Audio); err != nil {
+        return nil, fmt.Errorf("Unrecognized audio URLs in freg json: %v", err)
+    }
+    if len(f.Video) == 0 && len(f.Audio) == 0 {
+        return nil, fmt.Errorf("Unrecognized freg json: no audio or video URLs")
+    }
+    return f, nil
+}
+
+func parseFregUrls(data json.RawMessage) (map[int]string, error) {
+    if len(data) == 0 || string(data) == "null" {
+        return nil, nil
+    }
+
+    var urls map[int]string
+    if err := json.Unmarshal(data, &urls); err == nil {
+        return urls, nil
+    }
+
+    var single string
+    if err := json.Unmarshal(data, &single); err != nil {
+        return nil, fmt.Errorf("expected an object of itag to URL or a single URL")
+    }
+    if single == "" {
+        return nil, nil
+    }
+    itag, err := urlItag(single)
+    if err != nil {
+        return nil, err
+    }
+    return map[int]string { itag: single }, nil
+}
+
+// the itag of a googlevideo URL, either a query or a path parameter
+func urlItag(rawUrl string) (int, error) {
+    u, err := url.Parse(rawUrl)
+    if err != nil {
+        return 0, fmt.Errorf("invalid URL: %v", err)
+    }
+    s := u.Query().Get("itag")
+    if s == "" {
+        if m := itagPathRegex.FindStringSubmatch(u.Path); m != nil {
+            s = m[1]
+        }
+    }
+    if s == "" {
+        return 0, fmt.Errorf("no itag in URL '%s'", rawUrl)
+    }
+    itag, err := strconv.Atoi(s)
+    if err != nil {
+        return 0, fmt.Errorf("invalid itag '%s' in URL", s)
+    }
+    return itag, nil
+}
@@ -4,20 +4,22 @@ import (
     "bufio"
     "context"
     "crypto/tls"
+    "crypto/x509"
     "fmt"
     "io"
+    "io/ioutil"
     "math/rand"
     "os"
     "net"
     "net/http"
     "strings"
     "sync"
+    "sync/atomic"
     "time"
 
-    "github.com/lucas-clemente/quic-go"
-    "github.com/lucas-clemente/quic-go/http3"
-
     "inet.af/netaddr"
+
+    "github.com/HoloArchivists/ytarchive-raw-go/log"
 )
 
 type Network int
@@ -43,6 +45,19 @@ type IPPool struct {
     Addresses []netaddr.IP
 }
 
+// loads PEM encoded certificates from path into a pool usable as RootCAs
+func LoadCertPool(path string) (*x509.CertPool, error) {
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    pool := x509.NewCertPool()
+    if !pool.AppendCertsFromPEM(data) {
+        return nil, fmt.Errorf("No certificates found in '%s'", path)
+    }
+    return pool, nil
+}
+
 func ParseIPPool(path string) (*IPPool, error) {
     file, err := os.Open(path)
     if err != nil {
@@ -77,27 +92,93 @@ func (p *IPPool) random() netaddr.IP {
 }
 
 type HttpClientConfig struct {
-    IPPool  *IPPool
-    Network Network
-    UseQuic bool
+    // dials TCP connections instead of the default dialer, eg to add
+    // connection level timeouts or use a specific interface. takes priority
+    // over IPPool and Network, which are implemented with a dialer too.
+    // not used with QUIC.
+    DialContext        func(ctx context.Context, network, addr string) (net.Conn, error)
+    // close every connection after its request instead of reusing it, for
+    // hosts that misbehave with reused connections. costs a new TCP and TLS
+    // handshake per request. not used with QUIC.
+    DisableKeepAlives  bool
+    // how long an unused connection is kept open for reuse. the default of
+    // 90s is enough for download threads, which reuse their connection
+    // right away. lower it if idle connections get dropped silently by
+    // something in between. not used with QUIC. 0 uses the default.
+    IdleConnTimeout    time.Duration
+    // disables TLS certificate verification, overrides the value in TLSConfig
+    InsecureSkipVerify bool
+    IPPool             *IPPool
+    // limits simultaneous TCP connections per host, regardless of how many
+    // threads make requests. extra requests wait for a free connection.
+    // applies per bound IP address, as each one has its own connections.
+    // not used with QUIC, which sends all requests over one connection.
+    // 0 means no limit.
+    MaxConnsPerHost    int
+    // how many redirects a request follows before failing, to stop
+    // redirect loops. 0 uses the default of 10, negative disables
+    // redirects, returning the redirect response itself.
+    MaxRedirects       int
+    Network            Network
+    // extra hosts, besides the YouTube ones, that get all the headers of the
+    // original request on redirects, see checkRedirect. subdomains match
+    // too.
+    RedirectHosts      []string
+    // TLS settings used for all connections, eg custom root CAs. Cloned
+    // before use, nil uses the defaults.
+    TLSConfig          *tls.Config
+    // sends all requests instead of the TCP/QUIC transports, eg a fake
+    // RoundTripper or the Client().Transport of an httptest.Server in
+    // tests. all other connection settings are ignored when set.
+    Transport          http.RoundTripper
+    // send requests over HTTP/3, falling back to HTTP/2 over TCP for the
+    // rest of the client's lifetime if a QUIC handshake fails. ignored when
+    // built with the noquic tag.
+    UseQuic            bool
 }
 
 type HttpClient struct {
     cfg            *HttpClientConfig
     socketsLock    sync.Mutex
-    sockets        map[netaddr.IP]quic.OOBCapablePacketConn
+    sockets        map[netaddr.IP]*net.UDPConn
     requestersLock sync.Mutex
     requesters     map[netaddr.IP]*HttpRequester
     // used for NetworkAny
     anyRequester   *HttpRequester
+    // set once requests fell back from QUIC to TCP, see quicFallback
+    quicFailed     int32
+    // set once a request succeeded over QUIC
+    quicWorked     int32
 }
 
 func NewClient(cfg *HttpClientConfig) *HttpClient {
+    if cfg.DialContext != nil && cfg.UseQuic {
+        log.Warn("Custom dialer is not used with QUIC")
+    }
+    if cfg.UseQuic && !QuicSupported {
+        log.Warn("Built without QUIC support, using TCP")
+    }
+    if cfg.InsecureSkipVerify {
+        log.Warn("TLS certificate verification is disabled, connections are not secure")
+    }
     return &HttpClient {
         cfg: cfg,
     }
 }
 
+func (c *HttpClient) tlsConfig() *tls.Config {
+    var cfg *tls.Config
+    if c.cfg.TLSConfig != nil {
+        cfg = c.cfg.TLSConfig.Clone()
+    } else {
+        cfg = &tls.Config {}
+    }
+    if c.cfg.InsecureSkipVerify {
+        cfg.InsecureSkipVerify = true
+    }
+    return cfg
+}
+
 func (c *HttpClient) GetRequester() *HttpRequester {
     var bindAddr *netaddr.IP
     if c.cfg.IPPool != nil {
@@ -145,11 +226,53 @@ func (c *HttpClient) GetRequester() *HttpRequester {
     return req
 }
 
-func (c *HttpClient) getSocket(ip netaddr.IP) (quic.OOBCapablePacketConn, error) {
+// the requesters created so far
+func (c *HttpClient) allRequesters() []*HttpRequester {
+    c.requestersLock.Lock()
+    defer c.requestersLock.Unlock()
+
+    requesters := make([]*HttpRequester, 0, len(c.requesters) + 1)
+    if c.anyRequester != nil {
+        requesters = append(requesters, c.anyRequester)
+    }
+    for _, r := range c.requesters {
+        requesters = append(requesters, r)
+    }
+    return requesters
+}
+
+// Closes the connections that aren't used by a request, including those
+// of a Transport from the config. The client can still be used afterwards.
+func (c *HttpClient) CloseIdleConnections() {
+    for _, r := range c.allRequesters() {
+        r.mu.Lock()
+        if r.client != nil {
+            r.client.client.CloseIdleConnections()
+        }
+        r.mu.Unlock()
+    }
+}
+
+// Closes all connections and QUIC sockets of the client. Must only be called
+// once no requests are running anymore, the client can't be used afterwards.
+func (c *HttpClient) Close() {
+    for _, r := range c.allRequesters() {
+        r.Dispose()
+    }
+
+    c.socketsLock.Lock()
+    defer c.socketsLock.Unlock()
+    for ip, conn := range c.sockets {
+        conn.Close()
+        delete(c.sockets, ip)
+    }
+}
+
+func (c *HttpClient) getSocket(ip netaddr.IP) (*net.UDPConn, error) {
     c.socketsLock.Lock()
     defer c.socketsLock.Unlock()
     if c.sockets == nil {
-        c.sockets = make(map[netaddr.IP]quic.OOBCapablePacketConn)
+        c.sockets = make(map[netaddr.IP]*net.UDPConn)
     }
     if conn, ok := c.sockets[ip]; ok {
         return conn, nil
@@ -173,48 +296,141 @@ func (c *HttpClient) getSocket(ip netaddr.IP) (quic.OOBCapablePacketConn, error)
 
 func (c *HttpClient) createClient(ip *netaddr.IP) *internalClient {
     var rt http.RoundTripper
-    if c.cfg.UseQuic {
-        t := &http3.RoundTripper {}
-        if ip != nil {
-            t.Dial = func(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error) {
-                var network string
-                if ip.Is6() {
-                    network = "udp6"
-                } else {
-                    network = "udp4"
-                }
-
-                remoteAddr, err := net.ResolveUDPAddr(network, addr)
-                if err != nil {
-                    return nil, err
-                }
-                udpConn, err := c.getSocket(*ip)
-                if err != nil {
-                    return nil, err
-                }
-                return quic.DialEarly(udpConn, remoteAddr, addr, tlsCfg, cfg)
-            }
+    if c.cfg.Transport != nil {
+        rt = c.cfg.Transport
+    } else if c.cfg.UseQuic && QuicSupported {
+        rt = &quicFallback {
+            owner: c,
+            quic:  c.quicTransport(ip),
+            tcp:   c.tcpTransport(ip),
         }
-        rt = t
     } else {
-        t := http.DefaultTransport.(*http.Transport).Clone()
-        if ip != nil {
-            dialer := &net.Dialer{
-                Timeout:   30 * time.Second,
-                KeepAlive: 30 * time.Second,
-                LocalAddr: &net.TCPAddr{IP: netaddr2net(*ip), Port: 0},
-            }
-            t.DialContext = dialer.DialContext
-        }
-        rt = t
+        rt = c.tcpTransport(ip)
     }
     return &internalClient {
         client: &http.Client {
-            Transport: rt,
+            CheckRedirect: c.checkRedirect,
+            Transport:     rt,
         },
+        shared: c.cfg.Transport != nil,
     }
 }
 
+func (c *HttpClient) tcpTransport(ip *netaddr.IP) *http.Transport {
+    t := http.DefaultTransport.(*http.Transport).Clone()
+    t.TLSClientConfig = c.tlsConfig()
+    t.DisableKeepAlives = c.cfg.DisableKeepAlives
+    if c.cfg.IdleConnTimeout > 0 {
+        t.IdleConnTimeout = c.cfg.IdleConnTimeout
+    }
+    if c.cfg.MaxConnsPerHost > 0 {
+        t.MaxConnsPerHost = c.cfg.MaxConnsPerHost
+        t.MaxIdleConnsPerHost = c.cfg.MaxConnsPerHost
+    }
+    if ip != nil {
+        dialer := &net.Dialer{
+            Timeout:   30 * time.Second,
+            KeepAlive: 30 * time.Second,
+            LocalAddr: &net.TCPAddr{IP: netaddr2net(*ip), Port: 0},
+        }
+        t.DialContext = dialer.DialContext
+    }
+    if c.cfg.DialContext != nil {
+        t.DialContext = c.cfg.DialContext
+    }
+    return t
+}
+
+// sends requests over QUIC until a QUIC handshake fails, eg because UDP is
+// blocked, then over TCP (HTTP/2) for all requesters of the client.
+type quicFallback struct {
+    owner *HttpClient
+    quic  http.RoundTripper
+    tcp   *http.Transport
+}
+
+func (f *quicFallback) RoundTrip(req *http.Request) (*http.Response, error) {
+    if !f.owner.QuicFailed() {
+        resp, err := f.quic.RoundTrip(req)
+        if err == nil {
+            atomic.StoreInt32(&f.owner.quicWorked, 1)
+            return resp, nil
+        }
+        //requests with a body can't be sent again
+        canResend := req.Body == nil || req.Body == http.NoBody
+        if !canResend || !isQuicHandshakeError(err, atomic.LoadInt32(&f.owner.quicWorked) != 0) {
+            return resp, err
+        }
+        if atomic.CompareAndSwapInt32(&f.owner.quicFailed, 0, 1) {
+            log.Warnf("QUIC handshake failed (%v), falling back to HTTP/2 over TCP", err)
+        }
+    }
+    return f.tcp.RoundTrip(req)
+}
+
+func (f *quicFallback) CloseIdleConnections() {
+    f.tcp.CloseIdleConnections()
+}
+
+func (f *quicFallback) Close() error {
+    f.tcp.CloseIdleConnections()
+    if cl, ok := f.quic.(io.Closer); ok {
+        return cl.Close()
+    }
+    return nil
+}
+
+// Whether a QUIC handshake failed and requests fell back to TCP. Always
+// false if UseQuic isn't set.
+func (c *HttpClient) QuicFailed() bool {
+    return atomic.LoadInt32(&c.quicFailed) != 0
+}
+
+const defaultMaxRedirects = 10
+
+// hosts that get all the headers of the original request on redirects,
+// including their subdomains
+var trustedRedirectHosts = []string { "googlevideo.com", "youtube.com" }
+
+// caps the redirect chain and copies the headers of the original request to
+// redirects to YouTube hosts or RedirectHosts. net/http drops Authorization
+// and Cookie on cross host redirects, which CDN edges still need, but other
+// hosts a redirect points at must not get them.
+func (c *HttpClient) checkRedirect(req *http.Request, via []*http.Request) error {
+    max := c.cfg.MaxRedirects
+    if max == 0 {
+        max = defaultMaxRedirects
+    }
+    if max < 0 {
+        return http.ErrUseLastResponse
+    }
+    if len(via) >= max {
+        return fmt.Errorf("Stopped after %d redirects", len(via))
+    }
+    if c.trustedRedirect(req.URL.Hostname()) {
+        for key, values := range via[0].Header {
+            if _, ok := req.Header[key]; !ok {
+                req.Header[key] = append([]string(nil), values...)
+            }
+        }
+    }
+    log.Debugf("Redirected from %s to %s%s (%d)", via[len(via) - 1].URL.Host, req.URL.Host, req.URL.Path, len(via))
+    return nil
+}
+
+func (c *HttpClient) trustedRedirect(host string) bool {
+    host = strings.ToLower(host)
+    for _, lists := range [][]string { trustedRedirectHosts, c.cfg.RedirectHosts } {
+        for _, trusted := range lists {
+            trusted = strings.ToLower(strings.TrimPrefix(trusted, "."))
+            if host == trusted || strings.HasSuffix(host, "." + trusted) {
+                return true
+            }
+        }
+    }
+    return false
+}
+
 type HttpRequester struct {
     owner  *HttpClient
     client *internalClient
@@ -255,12 +471,18 @@ func (r *HttpRequester) Get(url string) (*http.Response, error) {
 // so instead closing here only requests that it gets closed later
 type internalClient struct {
     client          *http.Client
+    // the transport comes from the config and isn't closed with the client
+    shared          bool
     mu              sync.Mutex
     shouldClose     bool
     pendingRequests int
 }
 
 func (c *internalClient) doClose() {
+    if c.shared {
+        return
+    }
+    c.client.CloseIdleConnections()
     if cl, ok := c.client.Transport.(io.Closer); ok {
         cl.Close()
     }
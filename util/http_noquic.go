@@ -0,0 +1,21 @@
+//go:build noquic
+
+package util
+
+import (
+    "net/http"
+
+    "inet.af/netaddr"
+)
+
+// Whether HTTP/3 can be used, false when built with the noquic tag, which
+// drops the quic-go dependency.
+const QuicSupported = false
+
+func (c *HttpClient) quicTransport(ip *netaddr.IP) http.RoundTripper {
+    panic("Built without QUIC support")
+}
+
+func isQuicHandshakeError(err error, connected bool) bool {
+    return false
+}
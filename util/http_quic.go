@@ -0,0 +1,68 @@
+//go:build !noquic
+
+package util
+
+import (
+    "context"
+    "crypto/tls"
+    "errors"
+    "net"
+    "net/http"
+
+    "github.com/lucas-clemente/quic-go"
+    "github.com/lucas-clemente/quic-go/http3"
+
+    "inet.af/netaddr"
+)
+
+// Whether HTTP/3 can be used, false when built with the noquic tag, which
+// drops the quic-go dependency.
+const QuicSupported = true
+
+func (c *HttpClient) quicTransport(ip *netaddr.IP) http.RoundTripper {
+    t := &http3.RoundTripper {
+        TLSClientConfig: c.tlsConfig(),
+    }
+    if ip != nil {
+        t.Dial = func(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error) {
+            var network string
+            if ip.Is6() {
+                network = "udp6"
+            } else {
+                network = "udp4"
+            }
+
+            remoteAddr, err := net.ResolveUDPAddr(network, addr)
+            if err != nil {
+                return nil, err
+            }
+            udpConn, err := c.getSocket(*ip)
+            if err != nil {
+                return nil, err
+            }
+            return quic.DialEarly(udpConn, remoteAddr, addr, tlsCfg, cfg)
+        }
+    }
+    return t
+}
+
+// errors meaning QUIC doesn't work on this network or with this host, as
+// opposed to a failure of one request. connected is whether a QUIC request
+// succeeded before, quic-go reports a handshake that never got an answer as
+// an idle timeout.
+func isQuicHandshakeError(err error, connected bool) bool {
+    var timeout *quic.HandshakeTimeoutError
+    if errors.As(err, &timeout) {
+        return true
+    }
+    var idle *quic.IdleTimeoutError
+    if !connected && errors.As(err, &idle) {
+        return true
+    }
+    var version *quic.VersionNegotiationError
+    if errors.As(err, &version) {
+        return true
+    }
+    var transport *quic.TransportError
+    return errors.As(err, &transport) && transport.ErrorCode.IsCryptoError()
+}
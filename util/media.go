@@ -0,0 +1,275 @@
+package util
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/binary"
+    "fmt"
+    "io"
+    "os"
+)
+
+// How many bytes SniffMedia needs to recognize a segment.
+const MediaSniffLen = 8
+
+type Container int
+const (
+    ContainerUnknown Container = iota
+    ContainerMP4
+    ContainerWebM
+)
+
+func (c Container) String() string {
+    switch c {
+    case ContainerMP4:
+        return "mp4"
+    case ContainerWebM:
+        return "webm"
+    default:
+        return "unknown"
+    }
+}
+
+var (
+    ebmlHeaderID = []byte { 0x1A, 0x45, 0xDF, 0xA3 }
+    //segments without their own header start directly with a cluster
+    ebmlClusterID = []byte { 0x1F, 0x43, 0xB6, 0x75 }
+)
+
+// Detects the container of a segment from its first MediaSniffLen bytes.
+// Anything else, eg an HTML error page served with a 200 status, is
+// ContainerUnknown.
+func SniffMedia(data []byte) Container {
+    if LooksLikeMP4(data) {
+        return ContainerMP4
+    }
+    if LooksLikeWebM(data) {
+        return ContainerWebM
+    }
+    return ContainerUnknown
+}
+
+// top level ISO-BMFF boxes a fragmented MP4 segment can start with
+var mp4SegmentBoxes = map[string]bool {
+    "ftyp": true,
+    "styp": true,
+    "sidx": true,
+    "moof": true,
+    "emsg": true,
+    "prft": true,
+    "free": true,
+    "skip": true,
+}
+
+// Checks whether data, the start of a segment, looks like a fragmented MP4
+// box instead of eg an HTML error page served with a 200 status.
+func LooksLikeMP4(data []byte) bool {
+    if len(data) < MediaSniffLen {
+        return false
+    }
+    size := binary.BigEndian.Uint32(data[:4])
+    //1 means a 64 bit size follows the type
+    if size != 1 && size < 8 {
+        return false
+    }
+    return mp4SegmentBoxes[string(data[4:8])]
+}
+
+// Checks whether data, the start of a segment, starts with an EBML header
+// or a Matroska cluster.
+func LooksLikeWebM(data []byte) bool {
+    return bytes.HasPrefix(data, ebmlHeaderID) || bytes.HasPrefix(data, ebmlClusterID)
+}
+
+// Checks whether data, the start of a segment, begins with an init segment
+// (a ftyp or moov box for MP4, an EBML header for WebM), which the first
+// segment of an output needs for it to be playable.
+func StartsWithInit(data []byte) bool {
+    if LooksLikeMP4(data) {
+        typ := string(data[4:8])
+        return typ == "ftyp" || typ == "moov"
+    }
+    return bytes.HasPrefix(data, ebmlHeaderID)
+}
+
+// init segments bigger than this are assumed to be broken, real ones are a
+// few KiB
+const maxMP4InitSize = 1 << 20
+
+// Reads the init segment of a fragmented MP4 segment from r: its leading
+// ftyp and moov boxes. Returns nil without reading anything if the segment
+// doesn't start with them, eg because it's a WebM segment or a media only
+// MP4 segment.
+func ReadMP4Init(r *bufio.Reader) ([]byte, error) {
+    var init []byte
+    for {
+        header, err := r.Peek(8)
+        if err != nil {
+            return init, nil
+        }
+        typ := string(header[4:8])
+        if typ != "ftyp" && typ != "moov" {
+            return init, nil
+        }
+        size := uint64(binary.BigEndian.Uint32(header[:4]))
+        if size == 1 {
+            if header, err = r.Peek(16); err != nil {
+                return init, nil
+            }
+            size = binary.BigEndian.Uint64(header[8:16])
+        }
+        //0 extends to the end of the file, which an init box doesn't
+        if size < 8 || size > uint64(maxMP4InitSize - len(init)) {
+            return init, nil
+        }
+        box := make([]byte, size)
+        if _, err := io.ReadFull(r, box); err != nil {
+            return nil, fmt.Errorf("Truncated '%s' box", typ)
+        }
+        init = append(init, box...)
+    }
+}
+
+// Counts the segments in a file made by concatenating segments, like the
+// merged files of the concat merger, without decoding any media: moof boxes
+// for MP4, clusters for WebM. Each YouTube segment holds exactly one of
+// them, so a count lower than expected means segments are missing.
+func CountMediaSegments(path string) (Container, int, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return ContainerUnknown, 0, err
+    }
+    defer f.Close()
+
+    r := bufio.NewReader(f)
+    head, _ := r.Peek(MediaSniffLen)
+    switch c := SniffMedia(head); c {
+    case ContainerMP4:
+        n, err := countMP4Fragments(r)
+        return c, n, err
+    case ContainerWebM:
+        n, err := countWebMClusters(r)
+        return c, n, err
+    default:
+        return c, 0, fmt.Errorf("Not a MP4 or WebM file")
+    }
+}
+
+func discard(r *bufio.Reader, n uint64) error {
+    for n > 0 {
+        chunk := n
+        if chunk > 1 << 30 {
+            chunk = 1 << 30
+        }
+        if _, err := r.Discard(int(chunk)); err != nil {
+            return err
+        }
+        n -= chunk
+    }
+    return nil
+}
+
+func countMP4Fragments(r *bufio.Reader) (int, error) {
+    count := 0
+    var header [16]byte
+    for {
+        if _, err := io.ReadFull(r, header[:8]); err != nil {
+            if err == io.EOF {
+                return count, nil
+            }
+            return count, fmt.Errorf("Truncated box header after %d fragment(s)", count)
+        }
+        size := uint64(binary.BigEndian.Uint32(header[:4]))
+        headerSize := uint64(8)
+        switch size {
+        case 0:
+            //extends to the end of the file
+            if string(header[4:8]) == "moof" {
+                count++
+            }
+            return count, nil
+        case 1:
+            if _, err := io.ReadFull(r, header[8:16]); err != nil {
+                return count, fmt.Errorf("Truncated box header after %d fragment(s)", count)
+            }
+            size = binary.BigEndian.Uint64(header[8:16])
+            headerSize = 16
+        }
+        if size < headerSize {
+            return count, fmt.Errorf("Invalid box size %d after %d fragment(s)", size, count)
+        }
+        if string(header[4:8]) == "moof" {
+            count++
+        }
+        if err := discard(r, size - headerSize); err != nil {
+            return count, fmt.Errorf("Truncated '%s' box after %d fragment(s)", header[4:8], count)
+        }
+    }
+}
+
+const (
+    ebmlSegmentElement = 0x18538067
+    ebmlClusterElement = 0x1F43B675
+)
+
+// reads an EBML variable size integer. IDs keep their length marker,
+// sizes don't. returns whether all value bits are set, which means an
+// unknown size.
+func readEBMLVint(r *bufio.Reader, maxLen int, keepMarker bool) (uint64, bool, error) {
+    first, err := r.ReadByte()
+    if err != nil {
+        return 0, false, err
+    }
+    length := 1
+    for mask := byte(0x80); length <= maxLen && first & mask == 0; mask >>= 1 {
+        length++
+    }
+    if length > maxLen {
+        return 0, false, fmt.Errorf("Invalid EBML integer")
+    }
+    value := uint64(first)
+    if !keepMarker {
+        value &= uint64(0xFF >> length)
+    }
+    allOnes := value == uint64(0xFF >> length)
+    for i := 1; i < length; i++ {
+        b, err := r.ReadByte()
+        if err != nil {
+            return 0, false, io.ErrUnexpectedEOF
+        }
+        value = value << 8 | uint64(b)
+        allOnes = allOnes && b == 0xFF
+    }
+    return value, allOnes, nil
+}
+
+func countWebMClusters(r *bufio.Reader) (int, error) {
+    count := 0
+    for {
+        id, _, err := readEBMLVint(r, 4, true)
+        if err != nil {
+            if err == io.EOF {
+                return count, nil
+            }
+            return count, fmt.Errorf("Invalid element after %d cluster(s): %v", count, err)
+        }
+        size, unknown, err := readEBMLVint(r, 8, false)
+        if err != nil {
+            return count, fmt.Errorf("Invalid element size after %d cluster(s): %v", count, err)
+        }
+        //the elements of segments and clusters are read as if they were
+        //top level, which also handles unknown sizes
+        if id == ebmlSegmentElement || id == ebmlClusterElement {
+            if id == ebmlClusterElement {
+                count++
+            }
+            continue
+        }
+        if unknown {
+            return count, fmt.Errorf("Element 0x%X with unknown size after %d cluster(s)", id, count)
+        }
+        if err := discard(r, size); err != nil {
+            return count, fmt.Errorf("Truncated element 0x%X after %d cluster(s)", id, count)
+        }
+    }
+}
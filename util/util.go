@@ -5,6 +5,7 @@ import (
     "fmt"
     "os"
     "regexp"
+    "strconv"
     "strings"
     "sync"
     "time"
@@ -19,6 +20,20 @@ func FileNotEmpty(path string) bool {
     return false
 }
 
+// Flushes a file that was already written and closed to stable storage.
+func SyncFile(path string) error {
+    //opened for writing, as windows can't flush read only handles
+    f, err := os.OpenFile(path, os.O_WRONLY, 0)
+    if err != nil {
+        return err
+    }
+    if err = f.Sync(); err != nil {
+        f.Close()
+        return err
+    }
+    return f.Close()
+}
+
 var bestVideoFormats = []int{
     337, 315, 266, 138, // 2160p60
     313, 336, // 2160p
@@ -84,6 +99,8 @@ type FregJson struct {
     CreateTime time.Time         `json:"createTime"`
     formatVals map[string]string
     formatLock sync.Mutex
+    // see PreferVideo
+    videoOrder []int
 }
 
 func pickBestID(urls map[int]string, order []int, guess bool) int {
@@ -136,6 +153,49 @@ func (f *FregJson) BestAudio(preferredFormats []int) string {
     return pickBest(f.Audio, preferredFormats, bestAudioFormats, audioFormatNames, "audio")
 }
 
+// Sets the video itags BestVideo will be called with, so the height and itag
+// template keys match the downloaded format. Must be called before the first
+// FormatTemplate call.
+func (f *FregJson) PreferVideo(preferredFormats []int) {
+    f.formatLock.Lock()
+    defer f.formatLock.Unlock()
+    f.videoOrder = preferredFormats
+}
+
+// the itag BestVideo picks, without logging or failing. 0 if none.
+func (f *FregJson) expectedVideoItag() int {
+    order := bestVideoFormats
+    if f.videoOrder != nil {
+        order = f.videoOrder
+    }
+    for _, itag := range order {
+        if _, ok := f.Video[itag]; ok {
+            return itag
+        }
+    }
+    if f.videoOrder != nil {
+        return 0
+    }
+    best := 0
+    for itag := range f.Video {
+        if itag > best {
+            best = itag
+        }
+    }
+    return best
+}
+
+// the vertical resolution of a video itag, from its name. 0 if unknown.
+func videoHeight(itag int) int {
+    name := videoFormatNames[itag]
+    idx := strings.IndexByte(name, 'p')
+    if idx < 0 {
+        return 0
+    }
+    height, _ := strconv.Atoi(name[:idx])
+    return height
+}
+
 func (f *FregJson) fillFormatVals() {
     f.formatLock.Lock()
     defer f.formatLock.Unlock()
@@ -148,10 +208,20 @@ func (f *FregJson) fillFormatVals() {
     vals["title"] = f.Metadata.Title
     vals["channel"] = f.Metadata.ChannelName
     vals["upload_date"] = f.Metadata.StartTimestamp.Format("20060102")
+    vals["date"] = vals["upload_date"]
     vals["start_date"] = vals["upload_date"]
     vals["publish_date"] = vals["upload_date"]
     vals["start_timestamp"] = f.Metadata.StartTimestamp.Format(time.RFC3339)
     vals["description"] = f.Metadata.Description
+    //like youtube-dl, NA for values that aren't available
+    vals["itag"] = "NA"
+    vals["height"] = "NA"
+    if itag := f.expectedVideoItag(); itag > 0 {
+        vals["itag"] = strconv.Itoa(itag)
+        if height := videoHeight(itag); height > 0 {
+            vals["height"] = strconv.Itoa(height)
+        }
+    }
 
     channelUrlRegex := regexp.MustCompile(`^https?://(?:www\.)youtube.com/channel/([a-zA-Z0-9\-_]+)$`)
     channelIdMatch := channelUrlRegex.FindStringSubmatch(f.Metadata.ChannelURL)
@@ -166,7 +236,7 @@ func (f *FregJson) fillFormatVals() {
 
 func (f *FregJson) FormatTemplate(template string, filename bool) (string, error) {
     f.fillFormatVals()
-    pythonMapKey := regexp.MustCompile(`%\((\w+)\)s`)
+    pythonMapKey := regexp.MustCompile(`%\((\w+)\)([sd])`)
     for {
         match := pythonMapKey.FindStringSubmatch(template)
         if match == nil {
@@ -178,6 +248,11 @@ func (f *FregJson) FormatTemplate(template string, filename bool) (string, error
             return "", fmt.Errorf("Unknown format key '%s'", key)
         }
         val := f.formatVals[key]
+        if match[2] == "d" && val != "NA" {
+            if _, err := strconv.Atoi(val); err != nil {
+                return "", fmt.Errorf("Format key '%s' isn't a number", key)
+            }
+        }
 
         if filename && (key == "description" || key == "url" || key == "channel_url") {
             val = ""
@@ -231,7 +306,14 @@ var fnameReplacer = strings.NewReplacer(
 	"*",  "_",
 )
 
+// replaces characters that aren't allowed in file names on windows, and
+// control characters, which are allowed on unix but break most tools
 func sanitizeFilename(s string) string {
-    return fnameReplacer.Replace(s)
+    return strings.Map(func(r rune) rune {
+        if r < 0x20 || r == 0x7f {
+            return '_'
+        }
+        return r
+    }, fnameReplacer.Replace(s))
 }
 